@@ -0,0 +1,193 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	klog "github.com/go-kit/kit/log"
+	"github.com/skroutz/downloader/job"
+	"github.com/skroutz/downloader/storage"
+)
+
+// aggregations returns (GET), replaces (PUT) or partially updates (PATCH)
+// the settings of the aggregation with the given id. Requests to the "pause"
+// and "resume" subpaths of the aggregation are handled by pause.
+//
+// The request body of PUT has the same format as the aggregation fields of
+// POST /download, while PATCH expects a JSON merge patch (RFC 7396) of the
+// aggregation fields to be updated. Running worker pools pick up the new
+// settings shortly after they are saved. The saved settings are persisted,
+// i.e. they are kept while the aggregation has no pending jobs.
+func (as *API) aggregations(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/aggregations/"), "/")
+	if len(parts) == 2 && (parts[1] == "pause" || parts[1] == "resume") {
+		as.pause(w, r, parts[0], parts[1] == "pause")
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "PUT" && r.Method != "PATCH" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	aggr, err := as.Storage.GetAggregation(id)
+	exists := true
+	if err != nil {
+		if err != storage.ErrNotFound {
+			http.Error(w, fmt.Sprintf("Error fetching aggregation %s from Redis: %s", id, err),
+				http.StatusInternalServerError)
+			return
+		}
+		exists = false
+	}
+
+	if r.Method == "GET" {
+		if !exists {
+			http.Error(w, fmt.Sprintf("Aggregation %s not found", id), http.StatusNotFound)
+			return
+		}
+		as.writeAggregation(w, aggr)
+		return
+	}
+
+	if r.Method == "PATCH" && !exists {
+		http.Error(w, fmt.Sprintf("Aggregation %s not found", id), http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+
+	var fields map[string]interface{}
+	err = json.Unmarshal(body, &fields)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error unmarshalling body '%s': %s", body, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	if aggrID, ok := fields["aggr_id"]; ok && aggrID != id {
+		http.Error(w, fmt.Sprintf("Aggregation ID %v does not match %s", aggrID, id),
+			http.StatusBadRequest)
+		return
+	}
+
+	doc := fields
+	if r.Method == "PATCH" {
+		current, err := json.Marshal(aggr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error marshaling json: %v", err), http.StatusInternalServerError)
+			return
+		}
+		doc = make(map[string]interface{})
+		err = json.Unmarshal(current, &doc)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error unmarshalling json: %v", err), http.StatusInternalServerError)
+			return
+		}
+		mergePatch(doc, fields)
+	}
+	doc["aggr_id"] = id
+
+	updated, err := json.Marshal(doc)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error marshaling json: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	paused := exists && aggr.Paused
+	aggr = new(job.Aggregation)
+	err = json.Unmarshal(updated, aggr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error unmarshalling body '%s' to Aggregation: %s", body, err),
+			http.StatusBadRequest)
+		return
+	}
+	aggr.Paused = paused
+	aggr.Persisted = true
+
+	err = as.Storage.SaveAggregation(aggr)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error persisting aggregation %s: %s", id, err),
+			http.StatusInternalServerError)
+		return
+	}
+	klog.With(as.Logger, "aggregation_id", aggr.ID, "aggregation_limit", aggr.Limit).
+		Log("action", "aggregation_update")
+
+	as.writeAggregation(w, aggr)
+}
+
+// pause pauses or resumes the aggregation with the given id, depending on
+// paused. Jobs of paused aggregations are still accepted but they are not
+// downloaded until the aggregation is resumed. Idle aggregations are created
+// with the default settings when paused, until a job is enqueued in them.
+func (as *API) pause(w http.ResponseWriter, r *http.Request, id string, paused bool) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := as.Storage.SetAggregationPaused(id, paused)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			http.Error(w, fmt.Sprintf("Aggregation %s not found", id), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error updating aggregation %s: %s", id, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	action := "aggregation_resume"
+	if paused {
+		action = "aggregation_pause"
+	}
+	as.Logger.Log("aggregation_id", id, "action", action)
+
+	aggr, err := as.Storage.GetAggregation(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching aggregation %s from Redis: %s", id, err),
+			http.StatusInternalServerError)
+		return
+	}
+	as.writeAggregation(w, aggr)
+}
+
+// writeAggregation writes the JSON representation of aggr to w.
+func (as *API) writeAggregation(w http.ResponseWriter, aggr *job.Aggregation) {
+	as.writeJSON(w, http.StatusOK, aggr)
+}
+
+// mergePatch applies the JSON merge patch (RFC 7396) patch to doc.
+func mergePatch(doc, patch map[string]interface{}) {
+	for k, v := range patch {
+		if v == nil {
+			delete(doc, k)
+			continue
+		}
+
+		if vm, ok := v.(map[string]interface{}); ok {
+			dm, ok := doc[k].(map[string]interface{})
+			if !ok {
+				dm = make(map[string]interface{})
+			}
+			mergePatch(dm, vm)
+			doc[k] = dm
+			continue
+		}
+		doc[k] = v
+	}
+}
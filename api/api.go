@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/base64"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -10,18 +11,72 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	klog "github.com/go-kit/kit/log"
+	"github.com/skroutz/downloader/blobstore"
 	"github.com/skroutz/downloader/job"
+	"github.com/skroutz/downloader/stats"
 	"github.com/skroutz/downloader/storage"
 )
 
+const (
+	//Metric Identifiers
+	statsEnqueuedJobs         = "enqueuedJobs"         //Counter
+	statsCancellationRequests = "cancellationRequests" //Counter
+	statsScheduledJobs        = "scheduledJobs"        //Counter
+
+	// Prometheus metrics
+	metricsNamespace = "downloader_api"
+)
+
+// metricDescs describe the metrics of the api, as exported in the
+// Prometheus format
+var metricDescs = map[string]stats.Desc{
+	statsEnqueuedJobs:         {Name: "enqueued_jobs_total", Kind: stats.Counter, Help: "Number of enqueued jobs."},
+	statsCancellationRequests: {Name: "cancellation_requests_total", Kind: stats.Counter, Help: "Number of accepted job cancellation requests."},
+	statsScheduledJobs:        {Name: "scheduled_jobs_total", Kind: stats.Counter, Help: "Number of jobs enqueued by schedules."},
+}
+
 // API represents the api server.
 type API struct {
 	Server  *http.Server
 	Storage *storage.Storage
 	Logger  klog.Logger
+
+	// Metrics exposes the metrics of the api in the Prometheus format
+	Metrics *stats.Exporter
+
+	// counters holds the metrics of the api
+	counters *stats.Stats
+
+	// Files is the store of downloaded files. It is used to report the
+	// download URL of successful jobs. If it is a *blobstore.Signed, the
+	// files are also served under /files/, and their URLs are not reported.
+	Files blobstore.Store
+}
+
+// jobStatus is the JSON representation of a job, as returned by
+// GET /jobs/:id.
+type jobStatus struct {
+	ID            string         `json:"id"`
+	URL           string         `json:"url"`
+	AggrID        string         `json:"aggr_id"`
+	Priority      int            `json:"priority"`
+	RunAt         int64          `json:"run_at,omitempty"`
+	ExpiresAt     int64          `json:"expires_at,omitempty"`
+	DownloadState job.State      `json:"download_state"`
+	DownloadCount int            `json:"download_count"`
+	DownloadMeta  string         `json:"download_meta"`
+	CallbackState job.State      `json:"callback_state"`
+	CallbackCount int            `json:"callback_count"`
+	CallbackMeta  string         `json:"callback_meta"`
+	ResponseCode  int            `json:"response_code"`
+	NotModified   bool           `json:"not_modified"`
+	DownloadURL   string         `json:"download_url,omitempty"`
+	Checksums     *job.Checksums `json:"checksums,omitempty"`
+	Attempts      []job.Attempt  `json:"attempts"`
 }
 
 var idgen *rng
@@ -96,16 +151,263 @@ func (as *API) retry(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// jobs returns (GET) or cancels (DELETE) the job with the given id.
+func (as *API) jobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	j, err := as.Storage.GetJob(id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			http.Error(w, fmt.Sprintf("Job %s not found", id), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error fetching %s from Redis: %s", id, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		as.cancel(w, r, &j)
+		return
+	}
+	as.writeJobStatus(w, http.StatusOK, &j)
+}
+
+// cancel cancels j, whether it is queued for download, being downloaded or
+// waiting for its callback to be performed. A cancellation callback is
+// performed if the "callback" query parameter is true.
+//
+// Queued jobs are cancelled right away. Jobs that are being downloaded are
+// cancelled asynchronously by the processor performing them, in which case
+// HTTP status 202 is returned.
+func (as *API) cancel(w http.ResponseWriter, r *http.Request, j *job.Job) {
+	var callback bool
+	if v := r.URL.Query().Get("callback"); v != "" {
+		var err error
+		callback, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid callback parameter '%s': %s", v, err),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	logger := klog.With(as.Logger, "aggregation_id", j.AggrID, "job_id", j.ID, "job_url", j.URL)
+
+	var removed bool
+	var err error
+	switch {
+	case j.DownloadState == job.StatePending || j.DownloadState == job.StateInProgress:
+		removed, err = as.Storage.RemovePendingDownload(j)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error removing %s from its queue: %s", j, err),
+				http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			// The job has already been popped by a worker pool
+			err = as.Storage.RequestCancellation(j.ID, callback)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error requesting cancellation of %s: %s", j, err),
+					http.StatusInternalServerError)
+				return
+			}
+			logger.Log("action", "job_cancel_request")
+			as.counters.Add(statsCancellationRequests, 1)
+			as.writeJobStatus(w, http.StatusAccepted, j)
+			return
+		}
+	case j.CallbackState == job.StatePending:
+		removed, err = as.Storage.RemovePendingCallback(j)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error removing %s from the callback queue: %s", j, err),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if !removed {
+		http.Error(w, fmt.Sprintf("Job %s cannot be cancelled (download state: %s, callback state: %s)",
+			j.ID, j.DownloadState, j.CallbackState), http.StatusConflict)
+		return
+	}
+
+	err = as.Storage.QueueCancelledJob(j, callback)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error cancelling %s: %s", j, err), http.StatusInternalServerError)
+		return
+	}
+	logger.Log("action", "job_cancel")
+	as.counters.Add(statsCancellationRequests, 1)
+	as.writeJobStatus(w, http.StatusOK, j)
+}
+
+// assignID assigns a unique random ID to j.
+func (as *API) assignID(j *job.Job) error {
+	for i := 0; i < 3; i++ {
+		j.ID = idgen.rand()
+		exists, err := as.Storage.JobExists(j)
+		if err != nil {
+			return fmt.Errorf("Error fetching %s from Redis: %s", j, err)
+		}
+		if !exists {
+			return nil
+		}
+	}
+	return fmt.Errorf("Could not find unique ID after 3 tries for %s", j)
+}
+
+// ensureAggregation saves aggr, the aggregation of j, unless it already
+// exists, and returns the aggregation that j is enqueued in. Placeholder
+// aggregations, created by pausing an idle aggregation, take the settings
+// of aggr.
+//
+// TODO: do we want to throw error or override the previous aggr?
+func (as *API) ensureAggregation(j *job.Job, aggr *job.Aggregation, logger klog.Logger) (*job.Aggregation, error) {
+	existing, err := as.Storage.GetAggregation(aggr.ID)
+	if err == nil {
+		if !existing.Placeholder {
+			return existing, nil
+		}
+
+		replaced, err := as.Storage.ReplacePlaceholderAggregation(aggr)
+		if err != nil {
+			return nil, fmt.Errorf("Error replacing placeholder aggregation for %s: %s", j, err)
+		}
+		if !replaced {
+			// The placeholder was replaced or removed in the meantime
+			return as.ensureAggregation(j, aggr, logger)
+		}
+		logger.Log("action", "aggregation_replace_placeholder")
+		aggr.Paused = existing.Paused
+		return aggr, nil
+	}
+	if err != storage.ErrNotFound {
+		return nil, fmt.Errorf("Error fetching aggregation for %s: %s", j, err)
+	}
+
+	err = as.Storage.SaveAggregation(aggr)
+	if err != nil {
+		return nil, fmt.Errorf("Error persisting aggregation for %s: %s", j, err)
+	}
+	logger.Log("action", "aggregation_save")
+	return aggr, nil
+}
+
+// writeJobStatus writes the JSON representation of j to w, along with the
+// given HTTP status code.
+func (as *API) writeJobStatus(w http.ResponseWriter, code int, j *job.Job) {
+	status := jobStatus{
+		ID:            j.ID,
+		URL:           j.URL,
+		AggrID:        j.AggrID,
+		Priority:      j.Priority,
+		RunAt:         j.RunAt,
+		ExpiresAt:     j.ExpiresAt,
+		DownloadState: j.DownloadState,
+		DownloadCount: j.DownloadCount,
+		DownloadMeta:  j.DownloadMeta,
+		CallbackState: j.CallbackState,
+		CallbackCount: j.CallbackCount,
+		CallbackMeta:  j.CallbackMeta,
+		ResponseCode:  j.ResponseCode,
+		NotModified:   j.NotModified,
+	}
+	// Signed URLs are only given to the recipients of callbacks, since
+	// anyone may request the status of a job
+	if _, signed := as.Files.(*blobstore.Signed); as.Files != nil && !signed {
+		status.DownloadURL = j.DownloadURL(as.Files)
+	}
+	if !j.Checksums.Empty() {
+		status.Checksums = &j.Checksums
+	}
+
+	var err error
+	status.Attempts, err = as.Storage.GetAttempts(j.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching download attempts of %s: %s", j, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error marshaling json: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(body); err != nil {
+		as.Logger.Log("level", "error", "msg", err)
+	}
+}
+
+// files serves the downloaded file under the path that follows /files/,
+// supporting Range requests. The URL of the request must be signed by
+// as.Files (see blobstore.Signed).
+func (as *API) files(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	signed, ok := as.Files.(*blobstore.Signed)
+	if !ok {
+		http.Error(w, "Files are not served", http.StatusNotFound)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/files/")
+	if key == "" || path.Clean(key) != key {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+	if err := signed.Verify(key, r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	f, info, err := blobstore.Open(r.Context(), signed, key)
+	if err == blobstore.ErrNotExist {
+		http.Error(w, fmt.Sprintf("Could not find file %s", key), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error opening file %s: %s", key, err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, path.Base(key), info.ModTime, f)
+}
+
 // New creates a new API server, listening on the given host & port.
 func New(s *storage.Storage, host string, port int, heartbeatPath string,
 	logger klog.Logger) *API {
 	as := &API{Storage: s}
+	as.counters = stats.New("API", time.Second, func(m *expvar.Map) {})
+	as.Metrics = stats.NewExporter("API", metricsNamespace)
+	for key, d := range metricDescs {
+		as.Metrics.Describe(key, d)
+	}
+
 	mux := http.NewServeMux()
 	mux.Handle("/download", as)
+	mux.HandleFunc("/download/batch", as.downloadBatch)
 	mux.HandleFunc("/hb", heartbeat(heartbeatPath))
 	mux.HandleFunc("/stats/", as.stats)
 	mux.HandleFunc("/retry/", as.retry)
+	mux.HandleFunc("/jobs/", as.jobs)
+	mux.HandleFunc("/aggregations/", as.aggregations)
+	mux.HandleFunc("/schedules", as.schedules)
+	mux.HandleFunc("/schedules/", as.schedules)
 	mux.HandleFunc("/dashboard/aggregations", as.dashboardAggregations)
+	mux.HandleFunc("/files/", as.files)
 	if fs, err := staticFs(); err == nil {
 		mux.Handle("/", http.StripPrefix("/", http.FileServer(fs)))
 	}
@@ -123,10 +425,14 @@ func (as *API) dashboardAggregations(w http.ResponseWriter, r *http.Request) {
 	}
 	resp := make([]aggr, 0)
 
-	iter := as.Storage.Redis.Scan(0, storage.JobsKeyPrefix+"*", 0).Iterator()
+	ids, err := as.Storage.GetActiveAggregations()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching active aggregations: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-	for iter.Next() {
-		a := iter.Val()
+	for _, id := range ids {
+		a := storage.JobsKeyPrefix + id
 		count, err := as.Storage.Redis.ZCount(a, "-inf", "+inf").Result()
 		if err != nil {
 			count = -1
@@ -134,11 +440,6 @@ func (as *API) dashboardAggregations(w http.ResponseWriter, r *http.Request) {
 		resp = append(resp, aggr{a, count})
 	}
 
-	if err := iter.Err(); err != nil {
-		http.Error(w, fmt.Sprintf("Error scanning for aggregation keys: %v", err), http.StatusInternalServerError)
-		return
-	}
-
 	body, err := json.Marshal(resp)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Error marshaling json: %v", err), http.StatusInternalServerError)
@@ -174,23 +475,9 @@ func (as *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	foundJID := false
-	for i := 0; i < 3; i++ {
-		j.ID = idgen.rand()
-		exists, err := as.Storage.JobExists(j)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error fetching %s from Redis: %s", j, err),
-				http.StatusInternalServerError)
-			return
-		}
-		if !exists {
-			foundJID = true
-			break
-		}
-	}
-	if !foundJID {
-		http.Error(w, fmt.Sprintf("Could not find unique ID after 3 tries for %s", j),
-			http.StatusInternalServerError)
+	err = as.assignID(j)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -206,22 +493,12 @@ func (as *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"aggregation_limit", aggr.Limit,
 		"job_id", j.ID, "job_url", j.URL)
 
-	// TODO: do we want to throw error or override the previous aggr?
-	exists, err := as.Storage.AggregationExists(aggr)
+	aggr, err = as.ensureAggregation(j, aggr, logger)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error fetching aggregation for %s: %s", j, err),
-			http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if !exists {
-		err = as.Storage.SaveAggregation(aggr)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error persisting aggregation for %s: %s", j, err),
-				http.StatusInternalServerError)
-			return
-		}
-		logger.Log("action", "aggregation_save")
-	}
+	j.Inherit(aggr)
 
 	err = as.Storage.QueuePendingDownload(j, 0)
 	if err != nil {
@@ -230,6 +507,7 @@ func (as *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.Log("action", "job_enqueue")
+	as.counters.Add(statsEnqueuedJobs, 1)
 
 	w.WriteHeader(http.StatusCreated)
 	w.Header().Set("Content-Type", "application/json")
@@ -1,17 +1,21 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	klog "github.com/go-kit/kit/log"
 	"github.com/go-redis/redis"
+	"github.com/skroutz/downloader/blobstore"
 	"github.com/skroutz/downloader/config"
 	"github.com/skroutz/downloader/job"
 	"github.com/skroutz/downloader/storage"
@@ -120,3 +124,544 @@ func TestRetryHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestJobsHandler(t *testing.T) {
+	as := New(store, "example.com", 80, "", logger)
+	as.Files = blobstore.NewLocal("", &url.URL{Scheme: "http", Host: "localhost", Path: "/foo"})
+
+	testJob := job.Job{
+		ID:            "JobsHandlerJob",
+		URL:           "http://example.com/image.png",
+		AggrID:        "foo",
+		DownloadState: job.StateSuccess,
+		DownloadCount: 2,
+		CallbackState: job.StatePending,
+		ResponseCode:  200,
+	}
+	err := as.Storage.SaveJob(&testJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := map[string]int{
+		testJob.ID:    http.StatusOK,
+		`NonExisting`: http.StatusNotFound,
+	}
+
+	for id, expected := range testcases {
+		req := httptest.NewRequest("GET", "/jobs/"+id, nil)
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(as.jobs)
+		handler.ServeHTTP(rr, req)
+		result := rr.Result()
+
+		if result.StatusCode != expected {
+			t.Errorf("Expected status code %d, got %d (%s)", expected, result.StatusCode, id)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/jobs/"+testJob.ID, nil)
+	rr := httptest.NewRecorder()
+	as.jobs(rr, req)
+
+	var status jobStatus
+	err = json.Unmarshal(rr.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.DownloadState != job.StateSuccess || status.DownloadCount != 2 || status.ResponseCode != 200 {
+		t.Errorf("Unexpected job status: %#v", status)
+	}
+
+	expectedURL := "http://localhost/foo/Job/JobsHandlerJob"
+	if status.DownloadURL != expectedURL {
+		t.Errorf("Expected download url %s, got %s", expectedURL, status.DownloadURL)
+	}
+
+	// Signed URLs are not given to anyone holding the job id
+	as.Files = blobstore.NewSigned(as.Files, &url.URL{Scheme: "http", Host: "localhost", Path: "/files"}, "secret", time.Hour)
+	req = httptest.NewRequest("GET", "/jobs/"+testJob.ID, nil)
+	rr = httptest.NewRecorder()
+	as.jobs(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if body := rr.Body.String(); strings.Contains(body, "signature") || strings.Contains(body, "download_url") {
+		t.Errorf("Expected no signed download url in the job status, got %s", body)
+	}
+}
+
+func TestFilesHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api-files-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := blobstore.NewLocal(dir, nil)
+	err = local.Put(context.TODO(), "Job/JobFile", strings.NewReader("0123456789"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	as := New(store, "example.com", 80, "", logger)
+	as.Files = blobstore.NewSigned(local, &url.URL{Scheme: "http", Host: "example.com", Path: "/files"}, "secret", time.Hour)
+
+	get := func(target, rangeHeader string) *http.Response {
+		req := httptest.NewRequest("GET", target, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+		as.files(rr, req)
+		return rr.Result()
+	}
+
+	signedURL := as.Files.URL("Job/JobFile")
+	resp := get(signedURL, "")
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "0123456789" {
+		t.Errorf("Expected the file to be served, got %d %q", resp.StatusCode, body)
+	}
+
+	resp = get(signedURL, "bytes=2-4")
+	body, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "234" {
+		t.Errorf("Expected the requested range to be served, got %d %q", resp.StatusCode, body)
+	}
+
+	testcases := map[string]int{
+		"/files/Job/JobFile": http.StatusForbidden,
+		strings.Replace(signedURL, "signature=", "signature=0", 1): http.StatusForbidden,
+		as.Files.URL("Job/Missing"):                                http.StatusNotFound,
+	}
+	for target, expected := range testcases {
+		if resp := get(target, ""); resp.StatusCode != expected {
+			t.Errorf("Expected status code %d, got %d (%s)", expected, resp.StatusCode, target)
+		}
+	}
+
+	as.Files = local
+	if resp := get(signedURL, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected files not to be served by unsigned stores, got %d", resp.StatusCode)
+	}
+}
+
+func TestCancelHandler(t *testing.T) {
+	as := New(store, "example.com", 80, "", logger)
+
+	queued := job.Job{ID: "CancelQueued", AggrID: "cancelfoo"}
+	err := as.Storage.QueuePendingDownload(&queued, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inProgress := job.Job{ID: "CancelInProgress", AggrID: "cancelfoo", DownloadState: job.StateInProgress}
+	err = as.Storage.SaveJob(&inProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	completed := job.Job{ID: "CancelCompleted", AggrID: "cancelfoo",
+		DownloadState: job.StateSuccess, CallbackState: job.StateInProgress}
+	err = as.Storage.SaveJob(&completed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		id       string
+		query    string
+		expected int
+	}{
+		{queued.ID, "", http.StatusOK},
+		{inProgress.ID, "?callback=true", http.StatusAccepted},
+		{completed.ID, "", http.StatusConflict},
+		{inProgress.ID, "?callback=foo", http.StatusBadRequest},
+		{"NonExisting", "", http.StatusNotFound},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest("DELETE", "/jobs/"+tc.id+tc.query, nil)
+		rr := httptest.NewRecorder()
+		as.jobs(rr, req)
+
+		if rr.Code != tc.expected {
+			t.Errorf("Expected status code %d, got %d (%s%s)", tc.expected, rr.Code, tc.id, tc.query)
+		}
+	}
+
+	j, err := as.Storage.GetJob(queued.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.DownloadState != job.StateCancelled {
+		t.Errorf("Expected download state %s, got %s", job.StateCancelled, j.DownloadState)
+	}
+
+	requested, callback, err := as.Storage.CancellationRequested(inProgress.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !requested || !callback {
+		t.Error("Expected cancellation with callback to have been requested")
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	valid := `{"aggr_id":"batchfoo","aggr_limit":8,"url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}`
+	invalid := `{"aggr_id":"batchfoo","url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}`
+
+	cases := map[string][]bool{
+		// NDJSON
+		valid + "\n" + invalid + "\n" + valid + "\n": {true, false, true},
+		// JSON array
+		" [" + valid + "," + valid + "," + invalid + "]": {true, true, false},
+		// malformed NDJSON line
+		valid + "\nmeh\n" + valid: {true, false, true},
+		// document exceeding the maximum line size
+		valid + "\n" + strings.Repeat(" ", maxLineSize) + valid + "\n" + valid: {true, false, true},
+		// malformed JSON array
+		"[" + valid + ",meh," + valid + "]": {true, false},
+		"":                                  {},
+	}
+
+	as := New(store, "example.com", 80, "", logger)
+
+	for data, expected := range cases {
+		req := httptest.NewRequest("POST", "/download/batch", strings.NewReader(data))
+		w := httptest.NewRecorder()
+		as.downloadBatch(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status code %d, got %d (%s)", http.StatusOK, w.Code, data)
+		}
+
+		dec := json.NewDecoder(w.Body)
+		for i, success := range expected {
+			var res batchResult
+			err := dec.Decode(&res)
+			if err != nil {
+				t.Fatalf("Expected result #%d, got error %s (%s)", i, err, data)
+			}
+
+			if success {
+				if res.ID == "" || res.Error != "" {
+					t.Fatalf("Expected result #%d to contain a job id, got %#v (%s)", i, res, data)
+				}
+
+				exists, err := store.JobExists(&job.Job{ID: res.ID})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !exists {
+					t.Fatalf("Expected job %s to have been enqueued", res.ID)
+				}
+			} else if res.Error == "" {
+				t.Fatalf("Expected result #%d to contain an error, got %#v (%s)", i, res, data)
+			}
+		}
+
+		if dec.More() {
+			t.Fatalf("Expected exactly %d results (%s)", len(expected), data)
+		}
+	}
+}
+
+func TestInheritedSettings(t *testing.T) {
+	as := New(store, "example.com", 80, "", logger)
+
+	err := store.SaveAggregation(&job.Aggregation{ID: "inheritbar", Limit: 1, Retention: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		data      string
+		retention int
+	}{
+		{`{"aggr_id":"inheritfoo","aggr_limit":8,"aggr_retention":5,"url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}`, 5},
+		{`{"aggr_id":"inheritfoo","aggr_limit":8,"retention":10,"url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}`, 10},
+		// the settings of an existing aggregation are not overridden
+		{`{"aggr_id":"inheritbar","aggr_limit":8,"aggr_retention":5,"url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}`, 7},
+	}
+
+	for _, c := range cases {
+		for _, handler := range []http.HandlerFunc{as.ServeHTTP, as.downloadBatch} {
+			req := httptest.NewRequest("POST", "/download", strings.NewReader(c.data))
+			w := httptest.NewRecorder()
+			handler(w, req)
+
+			var res batchResult
+			err := json.NewDecoder(w.Body).Decode(&res)
+			if err != nil || res.ID == "" {
+				t.Fatalf("Expected a job id, got %#v (%s)", res, c.data)
+			}
+
+			// The aggregation is removed once its worker pool
+			// drains, before the callback of the job is delivered
+			err = store.Redis.Del(storage.JobsKeyPrefix + "inheritfoo").Err()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.RemoveAggregation("inheritfoo")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			j, err := store.GetJob(res.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j.Retention != c.retention {
+				t.Errorf("Expected retention %d, got %d (%s)", c.retention, j.Retention, c.data)
+			}
+		}
+	}
+}
+
+func TestAggregationsHandler(t *testing.T) {
+	as := New(store, "example.com", 80, "", logger)
+
+	steps := []struct {
+		method   string
+		id       string
+		body     string
+		expected int
+	}{
+		{"GET", "aggrsfoo", "", http.StatusNotFound},
+		{"PATCH", "aggrsfoo", `{"aggr_limit":2}`, http.StatusNotFound},
+		{"PUT", "aggrsfoo", `{"aggr_limit":0}`, http.StatusBadRequest},
+		{"PUT", "aggrsfoo", `{"aggr_id":"aggrsbar","aggr_limit":4}`, http.StatusBadRequest},
+		{"PUT", "aggrsfoo", `{"aggr_limit":4,"aggr_proxy":"http://proxy.example.com","aggr_rate":"60/m"}`, http.StatusOK},
+		{"GET", "aggrsfoo", "", http.StatusOK},
+		{"PATCH", "aggrsfoo", `{"aggr_limit":"8"}`, http.StatusBadRequest},
+		{"PATCH", "aggrsfoo", `{"aggr_limit":8,"aggr_proxy":null,"aggr_retry":{"max_attempts":5}}`, http.StatusOK},
+		{"DELETE", "aggrsfoo", "", http.StatusMethodNotAllowed},
+		{"POST", "aggrsbar/resume", "", http.StatusNotFound},
+		{"GET", "aggrsfoo/pause", "", http.StatusMethodNotAllowed},
+		{"POST", "aggrsfoo/pause", "", http.StatusOK},
+		{"PATCH", "aggrsfoo", `{"aggr_rate":1}`, http.StatusOK},
+	}
+
+	for _, s := range steps {
+		req := httptest.NewRequest(s.method, "/aggregations/"+s.id, strings.NewReader(s.body))
+		rr := httptest.NewRecorder()
+		as.aggregations(rr, req)
+
+		if rr.Code != s.expected {
+			t.Fatalf("Expected status code %d for %s %s '%s', got %d (%s)",
+				s.expected, s.method, s.id, s.body, rr.Code, rr.Body.String())
+		}
+	}
+
+	aggr, err := store.GetAggregation("aggrsfoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := job.Aggregation{ID: "aggrsfoo", Limit: 8, Rate: 1, Retry: job.RetryPolicy{MaxAttempts: 5}, Paused: true, Persisted: true}
+	if *aggr != expected {
+		t.Errorf("Expected aggregation to be %#v, got %#v", expected, *aggr)
+	}
+
+	req := httptest.NewRequest("POST", "/aggregations/aggrsfoo/resume", nil)
+	rr := httptest.NewRecorder()
+	as.aggregations(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d (%s)", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	aggr, err = store.GetAggregation("aggrsfoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aggr.Paused {
+		t.Error("Expected aggregation to have been resumed")
+	}
+}
+
+func TestPauseIdleAggregation(t *testing.T) {
+	as := New(store, "example.com", 80, "", logger)
+
+	data := `{"aggr_id":"idlefoo","aggr_limit":8,"url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}`
+	req := httptest.NewRequest("POST", "/download", strings.NewReader(data))
+	rr := httptest.NewRecorder()
+	as.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d (%s)", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	// The queue of the aggregation drains
+	err := store.Redis.Del(storage.JobsKeyPrefix + "idlefoo").Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.RemoveAggregation("idlefoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetAggregation("idlefoo")
+	if err != storage.ErrNotFound {
+		t.Fatalf("Expected the idle aggregation to have been removed, got %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/aggregations/idlefoo/pause", nil)
+	rr = httptest.NewRecorder()
+	as.aggregations(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d (%s)", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	aggr, err := store.GetAggregation("idlefoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aggr.Paused {
+		t.Error("Expected idle aggregation to have been paused")
+	}
+
+	data = `{"aggr_id":"idlefoo","aggr_limit":2,"aggr_rate":1,"aggr_proxy":"http://proxy.example.com:3128","url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}`
+	req = httptest.NewRequest("POST", "/download", strings.NewReader(data))
+	rr = httptest.NewRecorder()
+	as.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d (%s)", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	aggr, err = store.GetAggregation("idlefoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := job.Aggregation{ID: "idlefoo", Limit: 2, Rate: 1, Proxy: "http://proxy.example.com:3128", Paused: true}
+	if *aggr != expected {
+		t.Errorf("Expected the settings of the enqueued job to be stored as %#v, got %#v", expected, *aggr)
+	}
+}
+
+func TestPersistedAggregation(t *testing.T) {
+	as := New(store, "example.com", 80, "", logger)
+
+	req := httptest.NewRequest("PUT", "/aggregations/persistedfoo", strings.NewReader(`{"aggr_limit":2,"aggr_rate":1,"aggr_retention":30}`))
+	rr := httptest.NewRecorder()
+	as.aggregations(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d (%s)", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// The queue of the aggregation drains
+	err := store.RemoveAggregation("persistedfoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := `{"aggr_id":"persistedfoo","aggr_limit":8,"url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}`
+	req = httptest.NewRequest("POST", "/download", strings.NewReader(data))
+	rr = httptest.NewRecorder()
+	as.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d (%s)", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	aggr, err := store.GetAggregation("persistedfoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := job.Aggregation{ID: "persistedfoo", Limit: 2, Rate: 1, Retention: 30, Persisted: true}
+	if *aggr != expected {
+		t.Errorf("Expected the settings of the aggregation to be kept as %#v, got %#v", expected, *aggr)
+	}
+}
+
+func TestSchedulesHandler(t *testing.T) {
+	as := New(store, "example.com", 80, "", logger)
+
+	cases := map[string]int{
+		`{"interval":3600,"job":{"aggr_id":"schedulesfoo","aggr_limit":2,"url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}}`:    http.StatusCreated,
+		`{"cron":"0 2 * * *","job":{"aggr_id":"schedulesfoo","aggr_limit":2,"url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}}`: http.StatusCreated,
+		`{"job":{"aggr_id":"schedulesfoo","aggr_limit":2,"url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}}`:                    http.StatusBadRequest,
+		`{"interval":3600,"job":{"aggr_id":"schedulesfoo","url":"https://httpbin.org/image/png","callback_url":"http://localhost:8080"}}`:                   http.StatusBadRequest,
+	}
+
+	var id string
+	for data, expected := range cases {
+		req := httptest.NewRequest("POST", "/schedules", strings.NewReader(data))
+		rr := httptest.NewRecorder()
+		as.schedules(rr, req)
+
+		if rr.Code != expected {
+			t.Fatalf("Expected status code %d, got %d (%s)", expected, rr.Code, rr.Body.String())
+		}
+		if rr.Code == http.StatusCreated && strings.Contains(data, "interval") {
+			v := make(map[string]interface{})
+			err := json.Unmarshal(rr.Body.Bytes(), &v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, _ = v["id"].(string)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/schedules", nil)
+	rr := httptest.NewRecorder()
+	as.schedules(rr, req)
+	var list []map[string]interface{}
+	err := json.Unmarshal(rr.Body.Bytes(), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("Expected 2 schedules, got %s", rr.Body.String())
+	}
+
+	sc, err := store.GetSchedule(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAt := time.Unix(sc.NextRunAt, 0)
+	as.runSchedules(runAt)
+
+	sc, err = store.GetSchedule(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.LastJobID == "" || sc.LastRunAt != runAt.Unix() {
+		t.Fatalf("Expected schedule to have run at %d, got %#v", runAt.Unix(), sc)
+	}
+	if sc.NextRunAt != runAt.Add(time.Hour).Unix() {
+		t.Errorf("Expected next run to be at %d, got %d", runAt.Add(time.Hour).Unix(), sc.NextRunAt)
+	}
+
+	j, err := store.GetJob(sc.LastJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.DownloadState != job.StatePending || j.AggrID != "schedulesfoo" {
+		t.Fatalf("Expected pending job of schedulesfoo, got %s", j)
+	}
+
+	// The next run is skipped, since the previous job is still pending
+	as.runSchedules(runAt.Add(time.Hour))
+	skipped, err := store.GetSchedule(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped.LastJobID != sc.LastJobID || skipped.NextRunAt != runAt.Add(2*time.Hour).Unix() {
+		t.Errorf("Expected run to be skipped, got %#v", skipped)
+	}
+
+	req = httptest.NewRequest("DELETE", "/schedules/"+id, nil)
+	rr = httptest.NewRecorder()
+	as.schedules(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d (%s)", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/schedules/"+id, nil)
+	rr = httptest.NewRecorder()
+	as.schedules(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected status code %d, got %d (%s)", http.StatusNotFound, rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,278 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"unicode"
+
+	klog "github.com/go-kit/kit/log"
+	"github.com/skroutz/downloader/job"
+)
+
+// batchSize is the maximum number of jobs that are enqueued at once by
+// POST /download/batch, using a single Redis pipeline.
+const batchSize = 500
+
+// maxLineSize is the maximum size of a job document in the newline-delimited
+// JSON body of POST /download/batch.
+const maxLineSize = 1 << 20
+
+// batchResult is the outcome of enqueueing a single job of a batch. Exactly
+// one of its fields is set.
+type batchResult struct {
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// batchEntry is a job document of a batch along with its validation error,
+// if any.
+type batchEntry struct {
+	job *job.Job
+	err error
+}
+
+// batch accumulates the job documents of a POST /download/batch request and
+// enqueues them in chunks.
+type batch struct {
+	as      *API
+	entries []batchEntry
+
+	// aggrs contains the aggregations that are known to exist in Redis
+	aggrs map[string]*job.Aggregation
+}
+
+// downloadBatch enqueues multiple downloads to the backend Redis instance.
+//
+// The request body is either a stream of newline-delimited JSON documents or a
+// JSON array of documents, each one having the same format as the body of
+// POST /download. The response is a stream of newline-delimited JSON
+// documents, one for each job document in the request and in the same order,
+// containing either the id of the enqueued job or its validation error.
+// Malformed lines of newline-delimited JSON are rejected individually, while
+// a malformed array stops the batch.
+func (as *API) downloadBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	br := bufio.NewReaderSize(r.Body, maxLineSize)
+	isArray, err := startsWithArray(br)
+	if err != nil && err != io.EOF {
+		http.Error(w, "Error reading request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	next := lineReader(br)
+	if isArray {
+		dec := json.NewDecoder(br)
+		// Consume the opening bracket of the array
+		if _, err := dec.Token(); err != nil {
+			http.Error(w, "Error reading request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		next = arrayReader(dec)
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	b := &batch{as: as, aggrs: make(map[string]*job.Aggregation)}
+
+	for {
+		raw, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b.entries = append(b.entries, batchEntry{err: err})
+		} else {
+			b.add(raw)
+		}
+
+		if len(b.entries) >= batchSize {
+			if !b.flush(enc, w) {
+				return
+			}
+		}
+	}
+	b.flush(enc, w)
+}
+
+// lineReader returns a function that reads the next job document of an NDJSON
+// stream from br, skipping blank lines. Lines that are too long result in an
+// error, after which reading continues with the next line. The returned
+// documents are only valid until the next call.
+func lineReader(br *bufio.Reader) func() ([]byte, error) {
+	done := false
+	return func() ([]byte, error) {
+		for !done {
+			line, err := br.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				// Skip the rest of the line
+				for err == bufio.ErrBufferFull {
+					_, err = br.ReadSlice('\n')
+				}
+				if err == nil || err == io.EOF {
+					done = err == io.EOF
+					return nil, fmt.Errorf("Error decoding job: document exceeds %d bytes", maxLineSize)
+				}
+			}
+			if err == io.EOF {
+				done = true
+			} else if err != nil {
+				// The rest of the stream cannot be read
+				done = true
+				return nil, errors.New("Error reading job: " + err.Error())
+			}
+
+			if len(bytes.TrimSpace(line)) > 0 {
+				return line, nil
+			}
+		}
+		return nil, io.EOF
+	}
+}
+
+// arrayReader returns a function that reads the next job document of a JSON
+// array from dec, whose opening bracket is already consumed. Reading stops
+// at the first syntax error, since the rest of the array cannot be decoded
+// reliably.
+func arrayReader(dec *json.Decoder) func() ([]byte, error) {
+	done := false
+	return func() ([]byte, error) {
+		if done || !dec.More() {
+			return nil, io.EOF
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			done = true
+			return nil, errors.New("Error decoding job: " + err.Error())
+		}
+		return raw, nil
+	}
+}
+
+// add validates the job document raw and appends it to b.
+func (b *batch) add(raw []byte) {
+	j := new(job.Job)
+	if err := json.Unmarshal(raw, j); err != nil {
+		b.entries = append(b.entries, batchEntry{err: fmt.Errorf("Error unmarshalling to Job: %s", err)})
+		return
+	}
+
+	aggr := new(job.Aggregation)
+	if err := json.Unmarshal(raw, aggr); err != nil {
+		b.entries = append(b.entries, batchEntry{err: fmt.Errorf("Error unmarshalling to Aggregation: %s", err)})
+		return
+	}
+
+	if existing, ok := b.aggrs[aggr.ID]; ok {
+		aggr = existing
+	} else {
+		logger := klog.With(b.as.Logger, "aggregation_id", aggr.ID, "aggregation_limit", aggr.Limit)
+		var err error
+		aggr, err = b.as.ensureAggregation(j, aggr, logger)
+		if err != nil {
+			b.entries = append(b.entries, batchEntry{err: err})
+			return
+		}
+		b.aggrs[aggr.ID] = aggr
+	}
+	j.Inherit(aggr)
+
+	b.entries = append(b.entries, batchEntry{job: j})
+}
+
+// flush enqueues the valid jobs of b and writes the results of all entries
+// to w, using enc. It reports whether the results were written successfully.
+func (b *batch) flush(enc *json.Encoder, w http.ResponseWriter) bool {
+	var jobs []*job.Job
+	for _, e := range b.entries {
+		if e.err == nil {
+			jobs = append(jobs, e.job)
+		}
+	}
+
+	err := b.assignIDs(jobs)
+	if err == nil {
+		err = b.as.Storage.QueuePendingDownloads(jobs, 0)
+	}
+	if err == nil && len(jobs) > 0 {
+		b.as.Logger.Log("action", "batch_enqueue", "jobs", len(jobs))
+		b.as.counters.Add(statsEnqueuedJobs, int64(len(jobs)))
+	}
+
+	for _, e := range b.entries {
+		var res batchResult
+		switch {
+		case e.err != nil:
+			res.Error = e.err.Error()
+		case err != nil:
+			res.Error = fmt.Sprintf("Error queueing %s: %s", e.job, err)
+		default:
+			res.ID = e.job.ID
+		}
+
+		if werr := enc.Encode(res); werr != nil {
+			b.as.Logger.Log("level", "error", "action", "response_write", "msg", werr)
+			return false
+		}
+	}
+	b.entries = b.entries[:0]
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return true
+}
+
+// assignIDs assigns a unique random ID to each one of jobs.
+func (b *batch) assignIDs(jobs []*job.Job) error {
+	pending := jobs
+	for i := 0; i < 3 && len(pending) > 0; i++ {
+		for _, j := range pending {
+			j.ID = idgen.rand()
+		}
+
+		exist, err := b.as.Storage.JobsExist(pending)
+		if err != nil {
+			return fmt.Errorf("Error checking job existence: %s", err)
+		}
+
+		var collisions []*job.Job
+		for k, exists := range exist {
+			if exists {
+				collisions = append(collisions, pending[k])
+			}
+		}
+		pending = collisions
+	}
+
+	if len(pending) > 0 {
+		return errors.New("Could not find unique ID after 3 tries")
+	}
+	return nil
+}
+
+// startsWithArray reports whether the first non-whitespace character of br is
+// the opening bracket of a JSON array, without consuming it.
+func startsWithArray(br *bufio.Reader) (bool, error) {
+	for {
+		r, _, err := br.ReadRune()
+		if err != nil {
+			return false, err
+		}
+		if !unicode.IsSpace(r) {
+			return r == '[', br.UnreadRune()
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	klog "github.com/go-kit/kit/log"
+	"github.com/skroutz/downloader/job"
+	"github.com/skroutz/downloader/storage"
+)
+
+// schedules creates (POST /schedules) or lists (GET /schedules) schedules,
+// and returns (GET) or removes (DELETE) the schedule with the given id
+// (/schedules/:id).
+//
+// The request body of POST contains either an "interval" in seconds or a
+// "cron" expression, along with a "job" object in the format of the body of
+// POST /download.
+func (as *API) schedules(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schedules"), "/")
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			as.listSchedules(w)
+		case "POST":
+			as.createSchedule(w, r)
+		default:
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "DELETE" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sc, err := as.Storage.GetSchedule(id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			http.Error(w, fmt.Sprintf("Schedule %s not found", id), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Error fetching schedule %s from Redis: %s", id, err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		err = as.Storage.RemoveSchedule(id)
+		if err != nil && err != storage.ErrNotFound {
+			http.Error(w, fmt.Sprintf("Error removing schedule %s: %s", id, err),
+				http.StatusInternalServerError)
+			return
+		}
+		as.Logger.Log("schedule_id", id, "action", "schedule_remove")
+	}
+	as.writeJSON(w, http.StatusOK, sc)
+}
+
+// createSchedule creates a schedule from the request body. Its first run is
+// due after one interval, or at the next time matching its cron expression.
+func (as *API) createSchedule(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+
+	sc := new(job.Schedule)
+	err = json.Unmarshal(body, sc)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error unmarshalling body '%s' to Schedule: %s", body, err),
+			http.StatusBadRequest)
+		return
+	}
+
+	foundID := false
+	for i := 0; i < 3; i++ {
+		sc.ID = idgen.rand()
+		exists, err := as.Storage.ScheduleExists(sc.ID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error fetching schedule %s from Redis: %s", sc.ID, err),
+				http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			foundID = true
+			break
+		}
+	}
+	if !foundID {
+		http.Error(w, "Could not find unique ID after 3 tries for schedule",
+			http.StatusInternalServerError)
+		return
+	}
+
+	sc.NextRunAt = sc.Next(time.Now()).Unix()
+	err = as.Storage.SaveSchedule(sc)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error persisting schedule %s: %s", sc.ID, err),
+			http.StatusInternalServerError)
+		return
+	}
+	as.Logger.Log("schedule_id", sc.ID, "action", "schedule_save")
+
+	as.writeJSON(w, http.StatusCreated, sc)
+}
+
+// listSchedules writes all schedules to w, in the order of their next run.
+func (as *API) listSchedules(w http.ResponseWriter) {
+	schedules, err := as.Storage.GetSchedules()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching schedules from Redis: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+	as.writeJSON(w, http.StatusOK, schedules)
+}
+
+// writeJSON writes the JSON representation of v to w, along with the given
+// HTTP status code.
+func (as *API) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error marshaling json: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(body); err != nil {
+		as.Logger.Log("level", "error", "msg", err)
+	}
+}
+
+// RunScheduler enqueues a job for each due schedule, checking for due
+// schedules every interval, until ctx is cancelled. Multiple schedulers may
+// run concurrently, since each due schedule is claimed by one of them.
+func (as *API) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			as.runSchedules(time.Now())
+		}
+	}
+}
+
+// runSchedules runs the schedules that are due at now.
+func (as *API) runSchedules(now time.Time) {
+	ids, err := as.Storage.ClaimDueSchedules(now)
+	if err != nil {
+		as.Logger.Log("level", "error", "action", "schedule_claim", "msg", err)
+		return
+	}
+
+	for _, id := range ids {
+		logger := klog.With(as.Logger, "schedule_id", id)
+
+		sc, err := as.Storage.GetSchedule(id)
+		if err != nil {
+			if err != storage.ErrNotFound {
+				logger.Log("level", "error", "action", "schedule_run", "msg", err)
+			}
+			continue
+		}
+
+		err = as.runSchedule(sc, now, logger)
+		if err != nil {
+			// The schedule is retried after its lease expires
+			logger.Log("level", "error", "action", "schedule_run", "msg", err)
+			continue
+		}
+
+		next := sc.Next(now)
+		if next.IsZero() {
+			logger.Log("level", "error", "action", "schedule_run", "msg", "Schedule has no next run")
+			continue
+		}
+		sc.NextRunAt = next.Unix()
+
+		err = as.Storage.RescheduleSchedule(sc)
+		if err != nil && err != storage.ErrNotFound {
+			logger.Log("level", "error", "action", "schedule_run", "msg", err)
+		}
+	}
+}
+
+// runSchedule enqueues a new job from sc, unless the job of its previous run
+// is still pending.
+func (as *API) runSchedule(sc *job.Schedule, now time.Time, logger klog.Logger) error {
+	if sc.LastJobID != "" {
+		last, err := as.Storage.GetJob(sc.LastJobID)
+		if err != nil && err != storage.ErrNotFound {
+			return err
+		}
+		if err == nil && (last.DownloadState == job.StatePending || last.DownloadState == job.StateInProgress) {
+			logger.Log("action", "schedule_skip", "job_id", last.ID)
+			return nil
+		}
+	}
+
+	j, aggr, err := sc.NewJob()
+	if err != nil {
+		return errors.New("Invalid job document: " + err.Error())
+	}
+
+	err = as.assignID(j)
+	if err != nil {
+		return err
+	}
+
+	logger = klog.With(logger, "aggregation_id", aggr.ID, "job_id", j.ID, "job_url", j.URL)
+	aggr, err = as.ensureAggregation(j, aggr, logger)
+	if err != nil {
+		return err
+	}
+	j.Inherit(aggr)
+
+	err = as.Storage.QueuePendingDownload(j, 0)
+	if err != nil {
+		return fmt.Errorf("Error queueing %s: %s", j, err)
+	}
+	logger.Log("action", "schedule_enqueue")
+	as.counters.Add(statsScheduledJobs, 1)
+
+	sc.LastJobID = j.ID
+	sc.LastRunAt = now.Unix()
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/skroutz/downloader/blobstore"
 	"github.com/skroutz/downloader/config"
 	"github.com/skroutz/downloader/job"
 )
@@ -52,7 +53,7 @@ func TestHttpBackendNotifySucess(t *testing.T) {
 		t.Fatalf("Start should not return error")
 	}
 
-	cbInfoS, _ := jobS.CallbackInfo(*dwURL)
+	cbInfoS, _ := jobS.CallbackInfo(blobstore.NewLocal("", dwURL))
 
 	wg.Add(1)
 	go func() {
@@ -0,0 +1,199 @@
+// Package blobstore provides the stores in which downloaded files are kept.
+//
+// Files are addressed by keys, which are their paths relative to the root of
+// the store (see job.Job.Path). Downloads are first written to temporary
+// local files, which are then put into the store.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ErrNotExist is returned when a requested file does not exist in a store.
+var ErrNotExist = errors.New("File does not exist")
+
+// Store is a store of downloaded files.
+type Store interface {
+	// Put stores the size bytes read from r under key, replacing any
+	// existing file.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+
+	// Get returns the contents of the file under key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete removes the file under key. Removing a file that does not
+	// exist is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// Stat returns information about the file under key.
+	Stat(ctx context.Context, key string) (Info, error)
+
+	// URL returns the URL from which the file under key can be fetched.
+	URL(key string) string
+}
+
+// Info describes a stored file.
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// File is a stored file, opened for reading.
+type File interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// mover is implemented by stores that can take over local files without
+// copying them.
+type mover interface {
+	Move(ctx context.Context, key, path string) error
+}
+
+// copier is implemented by stores that can copy files without reading them.
+type copier interface {
+	Copy(ctx context.Context, src, dst string) error
+}
+
+// ranger is implemented by stores that can read a part of a file.
+type ranger interface {
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// PutFile stores the local file at path under key in s, and removes it.
+func PutFile(ctx context.Context, s Store, key, path string) error {
+	if m, ok := s.(mover); ok {
+		return m.Move(ctx, key, path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err = s.Put(ctx, key, f, fi.Size()); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Copy copies the file under src to dst in s.
+func Copy(ctx context.Context, s Store, src, dst string) error {
+	if c, ok := s.(copier); ok {
+		return c.Copy(ctx, src, dst)
+	}
+
+	info, err := s.Stat(ctx, src)
+	if err != nil {
+		return err
+	}
+	r, err := s.Get(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return s.Put(ctx, dst, r, info.Size)
+}
+
+// Open opens the file under key in s for reading, along with information
+// about it. Seeking into files of stores that cannot read parts of files
+// reads them from their start.
+func Open(ctx context.Context, s Store, key string) (File, Info, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	if f, ok := r.(File); ok {
+		return f, info, nil
+	}
+	return &rangeReader{ctx: ctx, s: s, key: key, size: info.Size, r: r}, info, nil
+}
+
+// rangeReader reads a stored file from its current offset, requesting it
+// again after seeking.
+type rangeReader struct {
+	ctx  context.Context
+	s    Store
+	key  string
+	size int64
+	off  int64
+
+	// r reads the file from off, if requested
+	r io.ReadCloser
+}
+
+func (rr *rangeReader) Read(p []byte) (int, error) {
+	if rr.off >= rr.size {
+		return 0, io.EOF
+	}
+	if rr.r == nil {
+		r, err := rr.open()
+		if err != nil {
+			return 0, err
+		}
+		rr.r = r
+	}
+	n, err := rr.r.Read(p)
+	rr.off += int64(n)
+	return n, err
+}
+
+// open requests the file from rr.off onwards.
+func (rr *rangeReader) open() (io.ReadCloser, error) {
+	if g, ok := rr.s.(ranger); ok {
+		return g.GetRange(rr.ctx, rr.key, rr.off, rr.size-rr.off)
+	}
+
+	r, err := rr.s.Get(rr.ctx, rr.key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.CopyN(ioutil.Discard, r, rr.off); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (rr *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += rr.off
+	case io.SeekEnd:
+		offset += rr.size
+	default:
+		return 0, errors.New("Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek: negative position")
+	}
+
+	if offset != rr.off && rr.r != nil {
+		rr.r.Close()
+		rr.r = nil
+	}
+	rr.off = offset
+	return offset, nil
+}
+
+func (rr *rangeReader) Close() error {
+	if rr.r == nil {
+		return nil
+	}
+	return rr.r.Close()
+}
@@ -0,0 +1,144 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// mkdirRetries is the number of times that a file is retried to be created
+// in a directory that was deleted in the meantime
+const mkdirRetries = 3
+
+// Local stores files in a directory of the local filesystem, which is
+// served by an external web server.
+type Local struct {
+	// Dir is the root directory of the store
+	Dir string
+
+	// BaseURL is the URL under which Dir is served, if any
+	BaseURL *url.URL
+}
+
+// NewLocal returns a store of the files under dir, which is served under
+// baseURL.
+func NewLocal(dir string, baseURL *url.URL) *Local {
+	return &Local{Dir: dir, BaseURL: baseURL}
+}
+
+// Put implements Store. The file is written to a temporary file first, so
+// that a partially written file is never visible under key.
+func (s *Local) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	p := s.path(key)
+	var tmp *os.File
+	err := inDir(p, func() (err error) {
+		tmp, err = ioutil.TempFile(filepath.Dir(p), filepath.Base(p)+".put")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err = io.CopyN(tmp, r, size); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// Move stores the local file at path under key by renaming it. path must
+// reside in the same filesystem as the store.
+func (s *Local) Move(ctx context.Context, key, path string) error {
+	p := s.path(key)
+	return inDir(p, func() error { return os.Rename(path, p) })
+}
+
+// Copy copies the file under src to dst by hard-linking it.
+func (s *Local) Copy(ctx context.Context, src, dst string) error {
+	p := s.path(dst)
+	err := inDir(p, func() error { return os.Link(s.path(src), p) })
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Get implements Store.
+func (s *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+// Delete implements Store.
+func (s *Local) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Stat implements Store.
+func (s *Local) Stat(ctx context.Context, key string) (Info, error) {
+	fi, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return Info{}, ErrNotExist
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// URL implements Store. An empty string is returned if the store is not
+// served.
+func (s *Local) URL(key string) string {
+	if s.BaseURL == nil {
+		return ""
+	}
+	u := *s.BaseURL
+	u.Path = path.Join(u.Path, key)
+	return u.String()
+}
+
+// inDir creates the parent directory of p, if missing, and calls f, which
+// creates p. Since empty directories may be deleted concurrently, e.g. by the
+// garbage collector of the processor, f is retried if the directory was
+// deleted before p was created.
+func inDir(p string, f func() error) error {
+	dir := filepath.Dir(p)
+	for i := 0; ; i++ {
+		if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+			return err
+		}
+
+		err := f()
+		if i < mkdirRetries && os.IsNotExist(err) {
+			if _, serr := os.Stat(dir); os.IsNotExist(serr) {
+				continue
+			}
+		}
+		return err
+	}
+}
+
+func (s *Local) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
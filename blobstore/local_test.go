@@ -0,0 +1,157 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testStore exercises the operations of s.
+func testStore(t *testing.T, s Store) {
+	ctx := context.TODO()
+
+	_, err := s.Stat(ctx, "abc/missing")
+	if err != ErrNotExist {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+
+	err = s.Put(ctx, "abc/file", strings.NewReader("contents"), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat(ctx, "abc/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 8 {
+		t.Errorf("Expected size 8, got %d", info.Size)
+	}
+
+	err = Copy(ctx, s, "abc/file", "def/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Get(ctx, "def/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "contents" {
+		t.Errorf("Expected the contents of the copied file, got %q", contents)
+	}
+
+	f, _, err := Open(ctx, s, "abc/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Seek(3, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	contents, err = ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "tents" {
+		t.Errorf("Expected the contents after the offset, got %q", contents)
+	}
+
+	for _, key := range []string{"abc/file", "def/copy", "abc/missing"} {
+		if err = s.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = s.Get(ctx, "abc/file"); err != ErrNotExist {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+
+	tmp, err := ioutil.TempFile("", "blobstore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.WriteString("tmp contents")
+	tmp.Close()
+
+	err = PutFile(ctx, s, "abc/tmp", tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(tmp.Name()); !os.IsNotExist(err) {
+		t.Error("Expected the local file to be removed")
+	}
+	info, err = s.Stat(ctx, "abc/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("tmp contents")) {
+		t.Errorf("Expected the size of the local file, got %d", info.Size)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewLocal(dir, &url.URL{Scheme: "http", Host: "localhost", Path: "/foo"})
+	testStore(t, s)
+
+	if _, err := os.Stat(filepath.Join(dir, "abc", "tmp")); err != nil {
+		t.Errorf("Expected file to be stored under its key: %s", err)
+	}
+	if u := s.URL("abc/tmp"); u != "http://localhost/foo/abc/tmp" {
+		t.Errorf("Expected URL under the base URL, got %s", u)
+	}
+	if u := NewLocal(dir, nil).URL("abc/tmp"); u != "" {
+		t.Errorf("Expected no URL without a base URL, got %s", u)
+	}
+}
+
+func TestLocalDeletedDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstore-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err = ioutil.WriteFile(src, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "abc", "dst")
+
+	// The directory is deleted concurrently, e.g. by the garbage
+	// collector, after it is created
+	calls := 0
+	err = inDir(dst, func() error {
+		calls++
+		if calls == 1 {
+			if err := os.Remove(filepath.Dir(dst)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return os.Rename(src, dst)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the file to be moved on the second try, got %d tries", calls)
+	}
+	if _, err := os.Stat(dst); err != nil {
+		t.Errorf("Expected file to be moved: %s", err)
+	}
+}
@@ -0,0 +1,333 @@
+package blobstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is sent in place of the checksum of request bodies, which
+// are streamed without being read in advance.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3 stores files as the objects of a bucket of an S3-compatible object
+// storage service. Requests are authenticated with AWS Signature Version 4
+// and use path-style addressing, which is supported by most such services.
+type S3 struct {
+	// Endpoint is the base URL of the service (e.g.
+	// https://s3.eu-west-1.amazonaws.com)
+	Endpoint *url.URL
+
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+
+	// PublicURL is the URL under which the objects of the bucket can be
+	// fetched by clients. It defaults to the URL of the bucket.
+	PublicURL *url.URL
+
+	Client *http.Client
+}
+
+// NewS3 returns a store of the objects of bucket, in the service at
+// endpoint.
+func NewS3(endpoint, region, bucket, accessKey, secretKey string) (*S3, error) {
+	u, err := url.ParseRequestURI(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse S3 endpoint, %v", err)
+	}
+	if bucket == "" {
+		return nil, errors.New("S3 bucket cannot be empty")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	public := *u
+	public.Path = strings.TrimSuffix(public.Path, "/") + "/" + bucket
+	return &S3{
+		Endpoint:  u,
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		PublicURL: &public,
+		Client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// Put implements Store.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	req, err := s.newRequest(ctx, "PUT", key, ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Copy copies the object under src to dst, without transferring it.
+func (s *S3) Copy(ctx context.Context, src, dst string) error {
+	req, err := s.newRequest(ctx, "PUT", dst, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-amz-copy-source", "/"+s.Bucket+"/"+escapePath(src))
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Copies may fail after the response status has been sent
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(body), "<Error>") {
+		return fmt.Errorf("Could not copy %s to %s: %s", src, dst, body)
+	}
+	return nil
+}
+
+// Get implements Store.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, "GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// GetRange returns length bytes of the object under key, starting at
+// offset.
+func (s *S3) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, "GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete implements Store.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, "DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req)
+	if err == ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stat implements Store.
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	req, err := s.newRequest(ctx, "HEAD", key, nil)
+	if err != nil {
+		return Info{}, err
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+
+	info := Info{Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info, nil
+}
+
+// URL implements Store.
+func (s *S3) URL(key string) string {
+	return strings.TrimSuffix(s.PublicURL.String(), "/") + "/" + escapePath(key)
+}
+
+// newRequest returns a request for the object under key.
+func (s *S3) newRequest(ctx context.Context, method, key string, body io.ReadCloser) (*http.Request, error) {
+	u := *s.Endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	u.RawPath = escapePath(u.Path)
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = body
+	}
+	return req.WithContext(ctx), nil
+}
+
+// do signs and performs req. ErrNotExist is returned if the object does not
+// exist, and an error if the response is not successful.
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+	s.sign(req, time.Now())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s: Received status code %s: %s", req.Method, req.URL.Path, resp.Status, body)
+}
+
+// sign adds the Authorization header of AWS Signature Version 4 to req, as
+// of t. The host, the range and the x-amz-* headers are signed. The
+// x-amz-content-sha256 header must be already set.
+func (s *S3) sign(req *http.Request, t time.Time) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	req.Header.Set("x-amz-date", t.Format("20060102T150405Z"))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		req.Header.Get("x-amz-date"),
+		scope,
+		sha256Hex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery returns the query string q sorted by key, as expected by
+// AWS Signature Version 4.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		vals := q[k]
+		sort.Strings(vals)
+		for _, v := range vals {
+			params = append(params, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// escapePath URI-encodes every byte of p, apart from the unreserved
+// characters and slashes.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escape URI-encodes every byte of s, apart from the unreserved characters.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,97 @@
+package blobstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned when verifying a URL whose signature
+	// does not match its file and expiry.
+	ErrInvalidSignature = errors.New("Invalid signature")
+
+	// ErrExpired is returned when verifying a URL that has expired.
+	ErrExpired = errors.New("URL has expired")
+)
+
+// Signed is a store whose URLs expire and are signed with HMAC-SHA256, so
+// that only their recipients can fetch the files. The files are served
+// under BaseURL by a server that verifies the URLs (see Verify).
+type Signed struct {
+	Store
+
+	// BaseURL is the URL under which the files are served
+	BaseURL *url.URL
+
+	// Secret is the key of the signatures
+	Secret []byte
+
+	// TTL is how long URLs are valid for
+	TTL time.Duration
+
+	// now returns the current time. It is overridden in tests.
+	now func() time.Time
+}
+
+// NewSigned returns a store of the files of s, served under baseURL with
+// URLs that are signed with secret and expire after ttl.
+func NewSigned(s Store, baseURL *url.URL, secret string, ttl time.Duration) *Signed {
+	return &Signed{Store: s, BaseURL: baseURL, Secret: []byte(secret), TTL: ttl, now: time.Now}
+}
+
+// WithTTL returns a copy of s whose URLs expire after ttl.
+func (s *Signed) WithTTL(ttl time.Duration) *Signed {
+	c := *s
+	c.TTL = ttl
+	return &c
+}
+
+// URL returns the signed URL of the file under key, which expires after
+// s.TTL. The expiry and the signature are passed in the expires and
+// signature query parameters respectively.
+func (s *Signed) URL(key string) string {
+	expires := strconv.FormatInt(s.now().Add(s.TTL).Unix(), 10)
+
+	u := *s.BaseURL
+	u.Path = path.Join(u.Path, key)
+	u.RawQuery = url.Values{
+		"expires":   {expires},
+		"signature": {s.signature(key, expires)},
+	}.Encode()
+	return u.String()
+}
+
+// Verify verifies the expires and signature query parameters q of a URL of
+// the file under key.
+func (s *Signed) Verify(key string, q url.Values) error {
+	expires := q.Get("expires")
+	sig, err := hex.DecodeString(q.Get("signature"))
+	if err != nil || expires == "" {
+		return ErrInvalidSignature
+	}
+	expected, _ := hex.DecodeString(s.signature(key, expires))
+	if !hmac.Equal(sig, expected) {
+		return ErrInvalidSignature
+	}
+
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if s.now().Unix() > t {
+		return ErrExpired
+	}
+	return nil
+}
+
+func (s *Signed) signature(key, expires string) string {
+	h := hmac.New(sha256.New, s.Secret)
+	h.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,56 @@
+package blobstore
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSigned(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	s := NewSigned(NewLocal("", nil), &url.URL{Scheme: "http", Host: "localhost", Path: "/files"}, "secret", time.Hour)
+	s.now = func() time.Time { return now }
+
+	u, err := url.Parse(s.URL("abc/file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/files/abc/file" {
+		t.Errorf("Expected URL under the base URL, got %s", u)
+	}
+	if expires := u.Query().Get("expires"); expires != "1500003600" {
+		t.Errorf("Expected URL to expire after the TTL, got %s", expires)
+	}
+
+	if err = s.Verify("abc/file", u.Query()); err != nil {
+		t.Errorf("Expected URL to be valid, got %s", err)
+	}
+	if err = s.Verify("abc/other", u.Query()); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature for another file, got %v", err)
+	}
+
+	q := u.Query()
+	q.Set("expires", "1600000000")
+	if err = s.Verify("abc/file", q); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature for a modified expiry, got %v", err)
+	}
+	if err = s.Verify("abc/file", url.Values{}); err != ErrInvalidSignature {
+		t.Errorf("Expected ErrInvalidSignature without a signature, got %v", err)
+	}
+
+	u, err = url.Parse(s.WithTTL(time.Minute).URL("abc/file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires := u.Query().Get("expires"); expires != "1500000060" {
+		t.Errorf("Expected URL to expire after the given TTL, got %s", expires)
+	}
+	if s.TTL != time.Hour {
+		t.Errorf("Expected the TTL of the store to be kept, got %s", s.TTL)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if err = s.Verify("abc/file", u.Query()); err != ErrExpired {
+		t.Errorf("Expected ErrExpired, got %v", err)
+	}
+}
@@ -2,23 +2,63 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
+
+	"github.com/skroutz/downloader/job"
 )
 
 // Config holds the app's configuration
 type Config struct {
 	Redis struct {
 		Addr string `json:"addr"`
+
+		// JobTTL is the time in minutes after which finished jobs
+		// expire since they were last updated, if positive
+		JobTTL int `json:"job_ttl"`
 	} `json:"redis"`
 
 	API struct {
 		HeartbeatPath string `json:"heartbeat_path"`
+		MetricsAddr   string `json:"metrics_addr"`
+
+		// FilesSecret enables serving downloaded files under /files/,
+		// with download URLs that are signed with it and expire along
+		// with the files
+		FilesSecret string `json:"files_secret"`
 	} `json:"api"`
 
 	Processor struct {
 		StorageDir    string `json:"storage_dir"`
 		UserAgent     string `json:"user_agent"`
 		StatsInterval int    `json:"stats_interval"`
+		MetricsAddr   string `json:"metrics_addr"`
+
+		// ContentAddressable enables the content-addressable layout of
+		// downloaded files
+		ContentAddressable bool `json:"content_addressable"`
+
+		// Retry overrides the default retry policy of downloads
+		Retry job.RetryPolicy `json:"retry"`
+
+		// MaxThrottles overrides the number of times a download may be
+		// throttled by the origin server before its job fails
+		MaxThrottles int `json:"max_throttles"`
+
+		// GC configures the garbage collection of storage_dir
+		GC struct {
+			// Interval is the time in minutes between garbage
+			// collections, which are disabled if it is zero
+			Interval int `json:"interval"`
+
+			// GracePeriod is the time in minutes since their last
+			// modification after which files may be collected
+			GracePeriod int `json:"grace_period"`
+
+			// Throttle is the pause in milliseconds after each
+			// batch of collected files
+			Throttle int `json:"throttle"`
+		} `json:"gc"`
 	} `json:"processor"`
 
 	Notifier struct {
@@ -26,8 +66,35 @@ type Config struct {
 		Concurrency      int    `json:"concurrency"`
 		StatsInterval    int    `json:"stats_interval"`
 		DeletionInterval int    `json:"deletion_interval"`
+		MetricsAddr      string `json:"metrics_addr"`
+
+		// FailedRetention is the time in minutes after which jobs whose
+		// callback failed are deleted, if positive, or else job_ttl
+		FailedRetention int `json:"failed_retention"`
+
+		// Retry overrides the default retry policy of callbacks
+		Retry job.RetryPolicy `json:"retry"`
 	} `json:"notifier"`
 
+	// BlobStore selects the store in which downloaded files are kept
+	BlobStore struct {
+		// Type is either "local" (the default), which keeps files
+		// in the storage_dir of the processor, or "s3"
+		Type string `json:"type"`
+
+		S3 struct {
+			Endpoint  string `json:"endpoint"`
+			Region    string `json:"region"`
+			Bucket    string `json:"bucket"`
+			AccessKey string `json:"access_key"`
+			SecretKey string `json:"secret_key"`
+
+			// PublicURL is the URL under which the bucket is
+			// served to clients, if not the URL of the bucket
+			PublicURL string `json:"public_url"`
+		} `json:"s3"`
+	} `json:"blobstore"`
+
 	Backends map[string]map[string]interface{}
 }
 
@@ -42,5 +109,18 @@ func Parse(filename string) (Config, error) {
 
 	dec := json.NewDecoder(f)
 	dec.UseNumber()
-	return cfg, dec.Decode(&cfg)
+	if err = dec.Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+// validate reports an error if the settings of cfg are inconsistent.
+func (cfg *Config) validate() error {
+	// Jobs should not expire before they are deleted
+	ttl := cfg.Redis.JobTTL
+	if ttl > 0 && (ttl <= cfg.Notifier.DeletionInterval || ttl <= cfg.Notifier.FailedRetention) {
+		return errors.New("job_ttl must exceed deletion_interval and failed_retention")
+	}
+	return nil
 }
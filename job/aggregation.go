@@ -3,7 +3,11 @@ package job
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
 // Aggregation is the concept through which the rate limit rules are defined
@@ -16,6 +20,54 @@ type Aggregation struct {
 
 	// Proxy url for the client to use, optional
 	Proxy string `json:"aggr_proxy"`
+
+	// Override of the retry policy of the aggregation's downloads, optional
+	Retry RetryPolicy `json:"aggr_retry"`
+
+	// Override of the retry policy of the callbacks of the aggregation's
+	// jobs, optional. It can be overridden per job.
+	CallbackRetry RetryPolicy `json:"aggr_callback_retry"`
+
+	// Maximum number of download requests per second, optional. It is
+	// enforced across all processors.
+	Rate float64 `json:"aggr_rate,omitempty"`
+
+	// Maximum number of download requests that may be performed at once,
+	// exceeding Rate, optional
+	Burst int `json:"aggr_burst,omitempty"`
+
+	// Number of ranged segments in which the downloads of the aggregation
+	// are split, if the server supports ranges, optional. It can be
+	// overridden per job.
+	Segments int `json:"aggr_segments,omitempty"`
+
+	// How long the downloaded files of the aggregation's jobs are kept
+	// after their callbacks are delivered, in minutes, optional. It can be
+	// overridden per job.
+	Retention int `json:"aggr_retention,omitempty"`
+
+	// Whether the aggregation's downloads are paused. It is not part of
+	// the aggregation's settings, since it is only changed by pausing or
+	// resuming the aggregation.
+	Paused bool `json:"aggr_paused"`
+
+	// Whether the aggregation's settings were set through the API, in
+	// which case they are kept while the aggregation has no pending jobs,
+	// instead of being taken from the next enqueued job.
+	Persisted bool `json:"aggr_persisted"`
+
+	// Whether the aggregation was created with the default settings by
+	// pausing it while idle, in which case its settings are replaced by
+	// those of the next enqueued job, while it stays paused.
+	Placeholder bool `json:"aggr_placeholder"`
+}
+
+// rateUnits are the time units in which an aggregation rate may be
+// expressed, e.g. "10/m"
+var rateUnits = map[string]float64{
+	"s": 1,
+	"m": 60,
+	"h": 3600,
 }
 
 // NewAggregation creates an aggregation with the provided ID and limit.
@@ -76,9 +128,103 @@ func (a *Aggregation) UnmarshalJSON(b []byte) error {
 		}
 	}
 
+	var rate float64
+	if rateField, ok := tmp["aggr_rate"]; ok {
+		rate, err = parseRate(rateField)
+		if err != nil {
+			return err
+		}
+	}
+
+	var burst int
+	if burstField, ok := tmp["aggr_burst"]; ok {
+		burstf, ok := burstField.(float64)
+		if !ok {
+			return errors.New("Aggregation burst must be a number")
+		}
+		burst = int(burstf)
+		if burst <= 0 {
+			return errors.New("Aggregation burst must be greater than 0")
+		}
+	}
+
+	var segments int
+	if segmentsField, ok := tmp["aggr_segments"]; ok {
+		segments, err = segmentsFromJSON(segmentsField)
+		if err != nil {
+			return errors.New("Aggregation " + err.Error())
+		}
+	}
+
+	var retention int
+	if retentionField, ok := tmp["aggr_retention"]; ok {
+		retention, err = retentionFromJSON(retentionField)
+		if err != nil {
+			return errors.New("Aggregation " + err.Error())
+		}
+	}
+
+	retry, err := retryPolicyFromJSON(tmp["aggr_retry"])
+	if err != nil {
+		return fmt.Errorf("Invalid aggr_retry: %s", err)
+	}
+
+	callbackRetry, err := retryPolicyFromJSON(tmp["aggr_callback_retry"])
+	if err != nil {
+		return fmt.Errorf("Invalid aggr_callback_retry: %s", err)
+	}
+
 	a.ID = id
 	a.Limit = limit
 	a.Proxy = proxy
+	a.Retry = retry
+	a.CallbackRetry = callbackRetry
+	a.Rate = rate
+	a.Burst = burst
+	a.Segments = segments
+	a.Retention = retention
 
 	return nil
 }
+
+// BurstSize returns the maximum number of download requests that may be
+// performed at once. It defaults to 1, if no burst is set.
+func (a *Aggregation) BurstSize() int {
+	if a.Burst <= 0 {
+		return 1
+	}
+	return a.Burst
+}
+
+// parseRate parses an aggregation rate, which is either a number of requests
+// per second or a string in the form "<requests>/<unit>", where unit is one
+// of "s", "m" or "h". The rate is returned in requests per second.
+func parseRate(v interface{}) (float64, error) {
+	var rate float64
+
+	switch v := v.(type) {
+	case float64:
+		rate = v
+	case string:
+		parts := strings.Split(v, "/")
+		if len(parts) != 2 {
+			return 0, errors.New("Aggregation rate must be in the form <requests>/<s|m|h>")
+		}
+		n, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return 0, errors.New("Aggregation rate must be in the form <requests>/<s|m|h>")
+		}
+		unit, ok := rateUnits[parts[1]]
+		if !ok {
+			return 0, errors.New("Aggregation rate must be in the form <requests>/<s|m|h>")
+		}
+		rate = n / unit
+	default:
+		return 0, errors.New("Aggregation rate must be a number or a string")
+	}
+
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return 0, errors.New("Aggregation rate must be greater than 0")
+	}
+	return rate, nil
+}
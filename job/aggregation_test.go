@@ -25,6 +25,33 @@ func TestAggregationUnmarshal(t *testing.T) {
 		`{"aggr_id":"proxybaz", "aggr_limit":4, "aggr_proxy":null, "url":"http://foobar.com","callback_url":"http://foo.bar","extra":"whatever"}`:                  true,
 		`{"aggr_id":"proxyquux", "aggr_limit":4, "aggr_proxy":"example", "url":"http://foobar.com","callback_url":"http://foo.bar","extra":"whatever"}`:            true,
 		`{"aggr_id":"proxycorge", "aggr_limit":4, "aggr_proxy":4, "url":"http://foobar.com","callback_url":"http://foo.bar","extra":"whatever"}`:                   true,
+
+		// retry policy
+		`{"aggr_id":"retryfoo", "aggr_limit":4, "aggr_retry":{"max_attempts":10,"max_delay":600}, "url":"http://foobar.com","callback_url":"http://foo.bar"}`: false,
+		`{"aggr_id":"retrybar", "aggr_limit":4, "aggr_retry":"often", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                             true,
+		`{"aggr_id":"retrybaz", "aggr_limit":4, "aggr_retry":{"max_delay":0}, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                     true,
+		`{"aggr_id":"retryqux", "aggr_limit":4, "aggr_callback_retry":{"max_attempts":5}, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:         false,
+		`{"aggr_id":"retryqux", "aggr_limit":4, "aggr_callback_retry":[5], "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                        true,
+
+		// rate
+		`{"aggr_id":"ratefoo", "aggr_limit":4, "aggr_rate":2.5, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                    false,
+		`{"aggr_id":"ratebar", "aggr_limit":4, "aggr_rate":"10/m", "aggr_burst":5, "url":"http://foobar.com","callback_url":"http://foo.bar"}`: false,
+		`{"aggr_id":"ratebaz", "aggr_limit":4, "aggr_rate":0, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                      true,
+		`{"aggr_id":"ratequx", "aggr_limit":4, "aggr_rate":"10/d", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                 true,
+		`{"aggr_id":"ratequux", "aggr_limit":4, "aggr_rate":"often", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:               true,
+		`{"aggr_id":"ratecorge", "aggr_limit":4, "aggr_rate":true, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                 true,
+		`{"aggr_id":"rategrault", "aggr_limit":4, "aggr_rate":1, "aggr_burst":0, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:   true,
+		`{"aggr_id":"rategarply", "aggr_limit":4, "aggr_rate":1, "aggr_burst":"5", "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
+
+		// segments
+		`{"aggr_id":"segmentsfoo", "aggr_limit":4, "aggr_segments":4, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:  false,
+		`{"aggr_id":"segmentsbar", "aggr_limit":4, "aggr_segments":0, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:  true,
+		`{"aggr_id":"segmentsbaz", "aggr_limit":4, "aggr_segments":17, "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
+
+		// retention
+		`{"aggr_id":"retentionfoo", "aggr_limit":4, "aggr_retention":10080, "url":"http://foobar.com","callback_url":"http://foo.bar"}`: false,
+		`{"aggr_id":"retentionbar", "aggr_limit":4, "aggr_retention":0, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:     true,
+		`{"aggr_id":"retentionbaz", "aggr_limit":4, "aggr_retention":"1w", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:  true,
 	}
 
 	for data, expectErr := range tc {
@@ -39,3 +66,24 @@ func TestAggregationUnmarshal(t *testing.T) {
 		}
 	}
 }
+
+func TestAggregationRate(t *testing.T) {
+	tc := map[string]float64{
+		`{"aggr_id":"foo", "aggr_limit":4}`:                     0,
+		`{"aggr_id":"foo", "aggr_limit":4, "aggr_rate":2.5}`:    2.5,
+		`{"aggr_id":"foo", "aggr_limit":4, "aggr_rate":"5/s"}`:  5,
+		`{"aggr_id":"foo", "aggr_limit":4, "aggr_rate":"6/m"}`:  0.1,
+		`{"aggr_id":"foo", "aggr_limit":4, "aggr_rate":"36/h"}`: 0.01,
+	}
+
+	for data, expected := range tc {
+		aggr := new(Aggregation)
+		err := aggr.UnmarshalJSON([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aggr.Rate != expected {
+			t.Errorf("Expected rate of '%s' to be %v, got %v", data, expected, aggr.Rate)
+		}
+	}
+}
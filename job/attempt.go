@@ -0,0 +1,31 @@
+package job
+
+import "time"
+
+// Attempt holds information about a single download attempt of a job.
+type Attempt struct {
+	// When the attempt started
+	StartedAt time.Time `json:"started_at"`
+
+	// How long the attempt took, in milliseconds
+	Duration int64 `json:"duration_ms"`
+
+	// Number of bytes downloaded
+	Bytes int64 `json:"bytes"`
+
+	// Response code of the download request, if any
+	ResponseCode int `json:"response_code"`
+
+	// Error contains the error that occurred during the attempt, if any
+	Error string `json:"error,omitempty"`
+
+	// Phase is the phase of the download in which the error occurred
+	Phase string `json:"phase,omitempty"`
+
+	// Retriable and Internal describe the error that occurred
+	Retriable bool `json:"retriable"`
+	Internal  bool `json:"internal"`
+
+	// The proxy through which the download request was performed, if any
+	Proxy string `json:"proxy,omitempty"`
+}
@@ -27,11 +27,26 @@ type Callback struct {
 	// ResponseCode is the http response for the downloaded resource e.g 200, 404
 	ResponseCode int `json:"response_code"`
 
+	// NotModified signifies whether the resource was not modified since
+	// it was last downloaded, in which case DownloadURL points to a copy
+	// of the previous download, if any
+	NotModified bool `json:"not_modified"`
+
+	// Checksums contains the checksums of the downloaded resource
+	Checksums *Checksums `json:"checksums,omitempty"`
+
+	// Metadata contains information about the downloaded resource and its
+	// download, if requested
+	Metadata *Metadata `json:"metadata,omitempty"`
+
 	// Delivered signifies where the callback has been delivered or not
 	Delivered bool `json:"delivered"`
 
 	// DeliveryError contains the error occured while delivering a callback
 	DeliveryError string `json:"delivery_error"`
+
+	// Attempts contains the download attempts of the job, if requested
+	Attempts []Attempt `json:"attempts,omitempty"`
 }
 
 // Bytes returns a byte slice for a callback info encoded as JSON
@@ -0,0 +1,135 @@
+package job
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ChecksumSHA256 is the checksum algorithm that is used for every download.
+// The rest of the supported algorithms are used on request.
+const ChecksumSHA256 = "sha256"
+
+// checksumSizes maps the supported checksum algorithms to the length of
+// their hex-encoded checksums.
+var checksumSizes = map[string]int{
+	ChecksumSHA256: 64,
+	"sha1":         40,
+	"md5":          32,
+}
+
+// Checksums are the hex-encoded checksums of a downloaded file.
+type Checksums struct {
+	SHA256 string `json:"sha256,omitempty"`
+	SHA1   string `json:"sha1,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+}
+
+// MarshalBinary is used by redis driver to marshall custom type Checksums
+func (c Checksums) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(c)
+}
+
+// Empty reports whether no checksum has been computed.
+func (c Checksums) Empty() bool {
+	return c == Checksums{}
+}
+
+// Get returns the checksum computed with the given algorithm, if any.
+func (c Checksums) Get(algorithm string) string {
+	switch algorithm {
+	case ChecksumSHA256:
+		return c.SHA256
+	case "sha1":
+		return c.SHA1
+	case "md5":
+		return c.MD5
+	}
+	return ""
+}
+
+// Set sets the checksum computed with the given algorithm.
+func (c *Checksums) Set(algorithm, sum string) {
+	switch algorithm {
+	case ChecksumSHA256:
+		c.SHA256 = sum
+	case "sha1":
+		c.SHA1 = sum
+	case "md5":
+		c.MD5 = sum
+	}
+}
+
+// HashAlgorithms returns the checksum algorithms used for the download of
+// j, which always include ChecksumSHA256 and the algorithm of its expected
+// checksum.
+func (j *Job) HashAlgorithms() []string {
+	algorithms := []string{ChecksumSHA256}
+	if j.ChecksumAlgorithms != "" {
+		algorithms = append(algorithms, strings.Split(j.ChecksumAlgorithms, ",")...)
+	}
+	if algorithm, _ := j.ExpectedSum(); algorithm != "" {
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms
+}
+
+// ExpectedSum returns the algorithm and the hex-encoded checksum of the
+// expected checksum of j, or empty strings if there is none.
+func (j *Job) ExpectedSum() (string, string) {
+	i := strings.Index(j.ExpectedChecksum, ":")
+	if i < 0 {
+		return "", ""
+	}
+	return j.ExpectedChecksum[:i], j.ExpectedChecksum[i+1:]
+}
+
+// checksumAlgorithmsFromJSON parses a list of checksum algorithms, and
+// returns them comma-separated.
+func checksumAlgorithmsFromJSON(v interface{}) (string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return "", errors.New("checksum_algorithms must be an array of strings")
+	}
+
+	var algorithms []string
+	for _, a := range list {
+		algorithm, ok := a.(string)
+		if !ok {
+			return "", errors.New("checksum_algorithms must be an array of strings")
+		}
+		algorithm = strings.ToLower(algorithm)
+		if _, ok := checksumSizes[algorithm]; !ok {
+			return "", fmt.Errorf("Unsupported checksum algorithm '%s'", a)
+		}
+		if algorithm != ChecksumSHA256 {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return strings.Join(algorithms, ","), nil
+}
+
+// expectedChecksumFromJSON parses an expected checksum in the form
+// "<algorithm>:<hex>" or, for SHA-256, just "<hex>", and returns it in the
+// former form.
+func expectedChecksumFromJSON(v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", errors.New("expected_checksum must be a string")
+	}
+
+	algorithm, sum := ChecksumSHA256, strings.ToLower(s)
+	if i := strings.Index(sum, ":"); i >= 0 {
+		algorithm, sum = sum[:i], sum[i+1:]
+	}
+	size, ok := checksumSizes[algorithm]
+	if !ok {
+		return "", fmt.Errorf("Unsupported checksum algorithm '%s'", algorithm)
+	}
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != size {
+		return "", fmt.Errorf("expected_checksum must be a %s checksum of %d hex digits", algorithm, size)
+	}
+	return algorithm + ":" + sum, nil
+}
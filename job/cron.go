@@ -0,0 +1,149 @@
+package job
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed cron expression, consisting of the minute, hour, day of
+// month, month and day of week fields. Its times are in UTC.
+type Cron struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day of month or the day of week field is "*"
+	domAny, dowAny bool
+}
+
+// cronFields are the bounds of the fields of a cron expression, in order.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// cronHorizon is the maximum time span searched for the next matching time
+// of a cron expression.
+const cronHorizon = 5 * 366 * 24 * time.Hour
+
+// ParseCron parses a standard cron expression of five space-separated fields
+// (e.g. "30 2 * * 1-5"). Each field is either "*" or a comma-separated list
+// of values and ranges (e.g. "1,10-20"), optionally followed by a step
+// (e.g. "*/15"). Day of week 0 and 7 both stand for Sunday.
+func ParseCron(expr string) (Cron, error) {
+	var c Cron
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return c, fmt.Errorf("Cron expression must have %d fields, got %d", len(cronFields), len(fields))
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return c, fmt.Errorf("Invalid %s field '%s': %s", cronFields[i].name, f, err)
+		}
+		sets[i] = set
+	}
+
+	c.minute, c.hour, c.dom, c.month, c.dow = sets[0], sets[1], sets[2], sets[3], sets[4]
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+	return c, nil
+}
+
+// parseCronField returns the values of field, which are bounded by min and
+// max, as a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, errors.New("Step must be a positive integer")
+			}
+		}
+
+		lo, hi := min, max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("Invalid value '%s'", bounds[0])
+			}
+			if hi, err = strconv.Atoi(bounds[1]); err != nil {
+				return 0, fmt.Errorf("Invalid value '%s'", bounds[1])
+			}
+		default:
+			var err error
+			if lo, err = strconv.Atoi(rng); err != nil {
+				return 0, fmt.Errorf("Invalid value '%s'", rng)
+			}
+			// A single value with a step stands for a range up to max
+			hi = lo
+			if rng != part {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("Values must be between %d and %d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first time after t matching c, or the zero time if there
+// is no such time in the next few years.
+func (c Cron) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(cronHorizon)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches reports whether the day of t matches c. As in cron(8), if both
+// the day of month and the day of week are restricted, a day matches if
+// either of them does.
+func (c Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,61 @@
+package job
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tc := map[string]bool{
+		"* * * * *":        false,
+		"*/15 2-4 * * 1-5": false,
+		"0 0 1,15 * 0":     false,
+		"30 2 * * 7":       false,
+		"5/10 * * * *":     false,
+		"* * * *":          true,
+		"* * * * * *":      true,
+		"60 * * * *":       true,
+		"* 24 * * *":       true,
+		"* * 0 * *":        true,
+		"* * * 13 *":       true,
+		"* * * * 8":        true,
+		"*/0 * * * *":      true,
+		"5-1 * * * *":      true,
+		"a * * * *":        true,
+	}
+
+	for expr, expectErr := range tc {
+		_, err := ParseCron(expr)
+		if (err != nil) != expectErr {
+			t.Errorf("Expected error to be %v for '%s', got %v", expectErr, expr, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, time.January, 31, 22, 47, 30, 0, time.UTC) // Wednesday
+
+	tc := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.January, 31, 22, 48, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.January, 31, 23, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2024, time.February, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 3 * * 0", time.Date(2024, time.February, 4, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2024, time.February, 4, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 5", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, c := range tc {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := cron.Next(from); !next.Equal(c.expected) {
+			t.Errorf("Expected next time of '%s' to be %s, got %s", c.expr, c.expected, next)
+		}
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/skroutz/downloader/processor/mimetype"
 )
@@ -21,8 +23,18 @@ const (
 	StateFailed     = "Failed"
 	StateSuccess    = "Success"
 	StateInProgress = "InProgress"
+	StateCancelled  = "Cancelled"
 )
 
+// MaxSegments is the maximum number of segments in which a download may be
+// split.
+const MaxSegments = 16
+
+// MaxPriority is the highest priority of a job. Jobs with higher priority
+// are downloaded before the rest of the jobs of their aggregation that are
+// ready to be downloaded.
+const MaxPriority = 9
+
 // Job represents a user request for downloading a resource.
 //
 // It is the core entity of the downloader and holds all info and state of
@@ -47,6 +59,10 @@ type Job struct {
 	// How many times the download request was attempted
 	DownloadCount int `json:"-"`
 
+	// How many times the download was throttled by the origin server.
+	// Throttled attempts are not counted in DownloadCount.
+	ThrottleCount int `json:"-"`
+
 	// Auxiliary ad-hoc information. Typically used for communicating
 	// download errors back to the user.
 	DownloadMeta string `json:"-"`
@@ -79,6 +95,72 @@ type Job struct {
 
 	// The User-Agent to set in download requests
 	UserAgent string `json:"user_agent"`
+
+	// Whether the download attempts of the job should be included in its
+	// callback
+	IncludeAttempts bool `json:"include_attempts"`
+
+	// Overrides of the retry policies of the download and the callback
+	DownloadRetry RetryPolicy `json:"retry"`
+	CallbackRetry RetryPolicy `json:"callback_retry"`
+
+	// Priority of the job among the jobs of its aggregation, from 0
+	// (default) to MaxPriority
+	Priority int `json:"priority"`
+
+	// Unix time before which the job is not downloaded. Zero means that
+	// the job is downloaded as soon as possible.
+	RunAt int64 `json:"run_at"`
+
+	// Unix time after which the job is failed instead of being downloaded,
+	// if it is still queued. Zero means that the job never expires.
+	ExpiresAt int64 `json:"expires_at"`
+
+	// Cache validators of a copy of the resource that the client already
+	// has. If given, they are sent along with the download request
+	// instead of the validators of the downloader's own copy.
+	IfNoneMatch     string `json:"if_none_match"`
+	IfModifiedSince string `json:"if_modified_since"`
+
+	// Whether the download request was answered with 304 Not Modified
+	NotModified bool `json:"-"`
+
+	// Validator of the resource that was partially downloaded by previous
+	// attempts, sent in the If-Range header when the download is resumed
+	ResumeValidator string `json:"-"`
+
+	// Number of ranged segments in which the download is split, if the
+	// server supports ranges. Zero means that the setting of the
+	// aggregation is used.
+	Segments int `json:"segments"`
+
+	// How long the downloaded file is kept after the callback of the job
+	// is delivered, in minutes. Zero means that the setting of the
+	// aggregation is used.
+	Retention int `json:"retention"`
+
+	// Comma-separated checksum algorithms to be used for the downloaded
+	// file, in addition to ChecksumSHA256
+	ChecksumAlgorithms string `json:"checksum_algorithms"`
+
+	// Checksum that the downloaded file is expected to have, in the form
+	// "<algorithm>:<hex>". The download fails if it does not match.
+	ExpectedChecksum string `json:"expected_checksum"`
+
+	// Checksums of the downloaded file
+	Checksums Checksums `json:"-"`
+
+	// Whether the metadata of the downloaded file should be included in
+	// the callback of the job
+	IncludeMetadata bool `json:"include_metadata"`
+
+	// Metadata of the downloaded file
+	Metadata Metadata `json:"-"`
+
+	// SHA-256 checksum of the shared file that holds the resource, if the
+	// job was downloaded in the content-addressable layout. The file is
+	// referenced by every job whose resource has the same content.
+	Blob string `json:"-"`
 }
 
 // MarshalBinary is used by redis driver to marshall custom type State
@@ -86,11 +168,25 @@ func (s State) MarshalBinary() (data []byte, err error) {
 	return []byte(string(s)), nil
 }
 
-// Path returns the relative job path
+// BlobDir is the directory, relative to the storage directory, holding the
+// files of the content-addressable layout.
+const BlobDir = "blobs"
+
+// Path returns the relative job path, which is the path of its blob if it
+// references one.
 func (j *Job) Path() string {
+	if j.Blob != "" {
+		return BlobPath(j.Blob)
+	}
 	return path.Join(string(j.ID[0:3]), j.ID)
 }
 
+// BlobPath returns the relative path of the blob with the given SHA-256
+// checksum.
+func BlobPath(sum string) string {
+	return path.Join(BlobDir, sum[0:3], sum)
+}
+
 // UnmarshalJSON is used to populate a job from the values in
 // the provided JSON message.
 func (j *Job) UnmarshalJSON(b []byte) error {
@@ -199,34 +295,258 @@ func (j *Job) UnmarshalJSON(b []byte) error {
 	}
 	j.UserAgent = useragent
 
+	var includeAttempts bool
+	if includeAttemptsField, ok := tmp["include_attempts"]; ok {
+		includeAttempts, ok = includeAttemptsField.(bool)
+		if !ok {
+			return errors.New("include_attempts must be a boolean")
+		}
+	}
+	j.IncludeAttempts = includeAttempts
+
+	j.DownloadRetry, err = retryPolicyFromJSON(tmp["retry"])
+	if err != nil {
+		return fmt.Errorf("Invalid retry: %s", err)
+	}
+
+	j.CallbackRetry, err = retryPolicyFromJSON(tmp["callback_retry"])
+	if err != nil {
+		return fmt.Errorf("Invalid callback_retry: %s", err)
+	}
+
+	var priority int
+	if priorityField, ok := tmp["priority"]; ok {
+		priorityf, ok := priorityField.(float64)
+		if !ok {
+			return errors.New("Priority must be a number")
+		}
+		priority = int(priorityf)
+		if float64(priority) != priorityf || priority < 0 || priority > MaxPriority {
+			return fmt.Errorf("Priority must be an integer between 0 and %d", MaxPriority)
+		}
+	}
+	j.Priority = priority
+
+	var runAt int64
+	if runAtField, ok := tmp["run_at"]; ok {
+		runAt, err = timestampFromJSON(runAtField)
+		if err != nil {
+			return fmt.Errorf("Invalid run_at: %s", err)
+		}
+	}
+	if delayField, ok := tmp["delay"]; ok {
+		if runAt != 0 {
+			return errors.New("run_at and delay cannot be both provided")
+		}
+		delay, ok := delayField.(float64)
+		if !ok {
+			return errors.New("Delay must be a number")
+		}
+		if delay < 0 {
+			return errors.New("Delay cannot be negative")
+		}
+		runAt = time.Now().Add(time.Duration(delay * float64(time.Second))).Unix()
+	}
+	j.RunAt = runAt
+
+	var expiresAt int64
+	if expiresAtField, ok := tmp["expires_at"]; ok {
+		expiresAt, err = timestampFromJSON(expiresAtField)
+		if err != nil {
+			return fmt.Errorf("Invalid expires_at: %s", err)
+		}
+		if expiresAt <= time.Now().Unix() {
+			return errors.New("expires_at must be in the future")
+		}
+		if expiresAt <= runAt {
+			return errors.New("expires_at must be later than run_at")
+		}
+	}
+	j.ExpiresAt = expiresAt
+
+	var ifNoneMatch string
+	if ifNoneMatchField, ok := tmp["if_none_match"]; ok {
+		ifNoneMatch, ok = ifNoneMatchField.(string)
+		if !ok {
+			return errors.New("if_none_match must be a string")
+		}
+	}
+	j.IfNoneMatch = ifNoneMatch
+
+	var ifModifiedSince string
+	if ifModifiedSinceField, ok := tmp["if_modified_since"]; ok {
+		ifModifiedSince, ok = ifModifiedSinceField.(string)
+		if !ok {
+			return errors.New("if_modified_since must be a string")
+		}
+		if _, err = http.ParseTime(ifModifiedSince); err != nil {
+			return errors.New("if_modified_since must be an HTTP date")
+		}
+	}
+	j.IfModifiedSince = ifModifiedSince
+
+	var segments int
+	if segmentsField, ok := tmp["segments"]; ok {
+		segments, err = segmentsFromJSON(segmentsField)
+		if err != nil {
+			return errors.New("Job " + err.Error())
+		}
+	}
+	j.Segments = segments
+
+	var retention int
+	if retentionField, ok := tmp["retention"]; ok {
+		retention, err = retentionFromJSON(retentionField)
+		if err != nil {
+			return errors.New("Job " + err.Error())
+		}
+	}
+	j.Retention = retention
+
+	var algorithms string
+	if algorithmsField, ok := tmp["checksum_algorithms"]; ok {
+		algorithms, err = checksumAlgorithmsFromJSON(algorithmsField)
+		if err != nil {
+			return err
+		}
+	}
+	j.ChecksumAlgorithms = algorithms
+
+	var expectedChecksum string
+	if expectedChecksumField, ok := tmp["expected_checksum"]; ok {
+		expectedChecksum, err = expectedChecksumFromJSON(expectedChecksumField)
+		if err != nil {
+			return err
+		}
+	}
+	j.ExpectedChecksum = expectedChecksum
+
+	var includeMetadata bool
+	if includeMetadataField, ok := tmp["include_metadata"]; ok {
+		includeMetadata, ok = includeMetadataField.(bool)
+		if !ok {
+			return errors.New("include_metadata must be a boolean")
+		}
+	}
+	j.IncludeMetadata = includeMetadata
+
 	return nil
 }
 
-// CallbackInfo validates the state of a job and returns a callback info
-// along with an error if appropriate. The expected argument downloadURL is
-// the base path of a downloaded resource in the downloader.
-func (j *Job) CallbackInfo(downloadURL url.URL) (Callback, error) {
-	var dwURL string
+// HasValidators reports whether the client provided the cache validators
+// of its own copy of the resource.
+func (j *Job) HasValidators() bool {
+	return j.IfNoneMatch != "" || j.IfModifiedSince != ""
+}
 
-	if j.DownloadState != StateSuccess && j.DownloadState != StateFailed {
-		return Callback{}, fmt.Errorf("Invalid job download state: '%s'", j.DownloadState)
+// Expired reports whether the deadline of j has passed at t.
+func (j *Job) Expired(t time.Time) bool {
+	return j.ExpiresAt > 0 && t.Unix() >= j.ExpiresAt
+}
+
+// Inherit copies onto j the settings of its aggregation a that are needed
+// after j is downloaded, unless j overrides them, since the aggregation may
+// be removed once its downloads are processed.
+func (j *Job) Inherit(a *Aggregation) {
+	if j.Retention == 0 {
+		j.Retention = a.Retention
 	}
+	j.CallbackRetry = a.CallbackRetry.Override(j.CallbackRetry)
+}
+
+// URLBuilder builds the URLs of downloaded files from their relative paths
+// (see Path). It is implemented by the stores of downloaded files.
+type URLBuilder interface {
+	URL(path string) string
+}
 
-	if j.DownloadState == StateSuccess {
-		downloadURL.Path = path.Join(downloadURL.Path, j.Path())
-		dwURL = downloadURL.String()
+// CallbackInfo validates the state of a job and returns a callback info
+// along with an error if appropriate. The URL of the downloaded resource is
+// built by files.
+func (j *Job) CallbackInfo(files URLBuilder) (Callback, error) {
+	if j.DownloadState != StateSuccess && j.DownloadState != StateFailed &&
+		j.DownloadState != StateCancelled {
+		return Callback{}, fmt.Errorf("Invalid job download state: '%s'", j.DownloadState)
 	}
 
-	return Callback{
+	cb := Callback{
 		Success:      j.DownloadState == StateSuccess,
 		Error:        j.DownloadMeta,
 		Extra:        j.Extra,
 		ResourceURL:  j.URL,
-		DownloadURL:  dwURL,
+		DownloadURL:  j.DownloadURL(files),
 		JobID:        j.ID,
 		ResponseCode: j.ResponseCode,
+		NotModified:  j.NotModified,
 		Delivered:    true,
-	}, nil
+	}
+	if cb.Success && !j.Checksums.Empty() {
+		checksums := j.Checksums
+		cb.Checksums = &checksums
+	}
+	if j.IncludeMetadata {
+		metadata := j.Metadata
+		metadata.DownloadCount = j.DownloadCount
+		cb.Metadata = &metadata
+	}
+	return cb, nil
+}
+
+// DownloadURL returns the URL where the downloaded resource of j resides,
+// as built by files. An empty string is returned if the download has not
+// been completed successfully, or if the resource was not modified since the
+// client's own copy.
+func (j *Job) DownloadURL(files URLBuilder) string {
+	if j.DownloadState != StateSuccess || (j.NotModified && j.HasValidators()) {
+		return ""
+	}
+	return files.URL(j.Path())
+}
+
+// segmentsFromJSON parses the number of segments of a download.
+func segmentsFromJSON(v interface{}) (int, error) {
+	segmentsf, ok := v.(float64)
+	if !ok {
+		return 0, errors.New("segments must be a number")
+	}
+	segments := int(segmentsf)
+	if float64(segments) != segmentsf || segments < 1 || segments > MaxSegments {
+		return 0, fmt.Errorf("segments must be an integer between 1 and %d", MaxSegments)
+	}
+	return segments, nil
+}
+
+// retentionFromJSON parses a retention period in minutes.
+func retentionFromJSON(v interface{}) (int, error) {
+	retentionf, ok := v.(float64)
+	if !ok {
+		return 0, errors.New("retention must be a number")
+	}
+	retention := int(retentionf)
+	if float64(retention) != retentionf || retention < 1 {
+		return 0, errors.New("retention must be a positive integer number of minutes")
+	}
+	return retention, nil
+}
+
+// timestampFromJSON parses a time given either as a Unix timestamp or as an
+// RFC 3339 string, and returns it as a Unix timestamp.
+func timestampFromJSON(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case float64:
+		if t <= 0 {
+			return 0, errors.New("Timestamp must be greater than 0")
+		}
+		return int64(t), nil
+	case string:
+		parsed, err := time.Parse(time.RFC3339, t)
+		if err != nil {
+			return 0, fmt.Errorf("Could not parse time: %s", err)
+		}
+		return parsed.Unix(), nil
+	default:
+		return 0, errors.New("Time must be a Unix timestamp or an RFC 3339 string")
+	}
 }
 
 func (j Job) String() string {
@@ -3,6 +3,7 @@ package job
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestUnmarshalJSON(t *testing.T) {
@@ -40,6 +41,70 @@ func TestUnmarshalJSON(t *testing.T) {
 		`{"aggr_id":"useragentfoo", "user_agent":"", "url":"http://foobar.com","callback_url":"http://foo.bar","extra":"whatever"}`:                false,
 		`{"aggr_id":"useragentfoo", "user_agent":null, "url":"http://foobar.com","callback_url":"http://foo.bar","extra":"whatever"}`:              true,
 		`{"aggr_id":"useragentfoo", "user_agent":3, "url":"http://foobar.com","callback_url":"http://foo.bar","extra":"whatever"}`:                 true,
+
+		// include attempts
+		`{"aggr_id":"attemptsfoo", "include_attempts":true, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:  false,
+		`{"aggr_id":"attemptsfoo", "include_attempts":"yes", "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
+
+		// retry policies
+		`{"aggr_id":"retryfoo", "retry":{"max_attempts":5,"base_delay":30,"multiplier":2,"max_delay":3600,"jitter":0.2}, "url":"http://foobar.com","callback_url":"http://foo.bar"}`: false,
+		`{"aggr_id":"retryfoo", "callback_retry":{"max_attempts":1}, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                     false,
+		`{"aggr_id":"retryfoo", "retry":5, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                                               true,
+		`{"aggr_id":"retryfoo", "retry":{"max_attempts":"5"}, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                            true,
+		`{"aggr_id":"retryfoo", "retry":{"max_attempts":0}, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                              true,
+		`{"aggr_id":"retryfoo", "retry":{"multiplier":0.5}, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                              true,
+		`{"aggr_id":"retryfoo", "callback_retry":{"jitter":2}, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                           true,
+		`{"aggr_id":"retryfoo", "callback_retry":{"base_delay":-1}, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                      true,
+
+		// priority
+		`{"aggr_id":"priorityfoo", "priority":9, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:   false,
+		`{"aggr_id":"priorityfoo", "priority":0, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:   false,
+		`{"aggr_id":"priorityfoo", "priority":10, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:  true,
+		`{"aggr_id":"priorityfoo", "priority":-1, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:  true,
+		`{"aggr_id":"priorityfoo", "priority":1.5, "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
+		`{"aggr_id":"priorityfoo", "priority":"9", "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
+
+		// scheduling
+		`{"aggr_id":"schedulefoo", "run_at":4102444800, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                      false,
+		`{"aggr_id":"schedulefoo", "run_at":"2100-01-01T02:00:00+02:00", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                     false,
+		`{"aggr_id":"schedulefoo", "delay":3600, "expires_at":4102444800, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                    false,
+		`{"aggr_id":"schedulefoo", "run_at":"2100-01-01", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                    true,
+		`{"aggr_id":"schedulefoo", "run_at":true, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                            true,
+		`{"aggr_id":"schedulefoo", "run_at":4102444800, "delay":60, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                          true,
+		`{"aggr_id":"schedulefoo", "delay":-1, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                               true,
+		`{"aggr_id":"schedulefoo", "delay":"60", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                             true,
+		`{"aggr_id":"schedulefoo", "expires_at":946684800, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                   true,
+		`{"aggr_id":"schedulefoo", "run_at":4102444800, "expires_at":"2099-12-31T00:00:00Z", "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
+
+		// cache validators
+		`{"aggr_id":"validatorsfoo", "if_none_match":"\"v1\"", "if_modified_since":"Mon, 02 Jan 2006 15:04:05 GMT", "url":"http://foobar.com","callback_url":"http://foo.bar"}`: false,
+		`{"aggr_id":"validatorsfoo", "if_none_match":1, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                             true,
+		`{"aggr_id":"validatorsfoo", "if_modified_since":"2006-01-02", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                              true,
+
+		// segments
+		`{"aggr_id":"segmentsfoo", "segments":16, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:  false,
+		`{"aggr_id":"segmentsfoo", "segments":1, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:   false,
+		`{"aggr_id":"segmentsfoo", "segments":0, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:   true,
+		`{"aggr_id":"segmentsfoo", "segments":2.5, "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
+		`{"aggr_id":"segmentsfoo", "segments":"4", "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
+
+		// retention
+		`{"aggr_id":"retentionfoo", "retention":5, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:   false,
+		`{"aggr_id":"retentionfoo", "retention":-5, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:  true,
+		`{"aggr_id":"retentionfoo", "retention":1.5, "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
+
+		// checksums
+		`{"aggr_id":"checksumfoo", "checksum_algorithms":["md5","SHA1"], "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                       false,
+		`{"aggr_id":"checksumfoo", "expected_checksum":"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:     false,
+		`{"aggr_id":"checksumfoo", "expected_checksum":"md5:d41d8cd98f00b204e9800998ecf8427e", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                 false,
+		`{"aggr_id":"checksumfoo", "checksum_algorithms":["crc32"], "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                            true,
+		`{"aggr_id":"checksumfoo", "checksum_algorithms":"md5", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                                true,
+		`{"aggr_id":"checksumfoo", "expected_checksum":"md5:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
+		`{"aggr_id":"checksumfoo", "expected_checksum":"sha256:zz", "url":"http://foobar.com","callback_url":"http://foo.bar"}`:                                                            true,
+
+		// metadata
+		`{"aggr_id":"metadatafoo", "include_metadata":true, "url":"http://foobar.com","callback_url":"http://foo.bar"}`:  false,
+		`{"aggr_id":"metadatafoo", "include_metadata":"yes", "url":"http://foobar.com","callback_url":"http://foo.bar"}`: true,
 	}
 
 	for data, expectErr := range tc {
@@ -54,3 +119,33 @@ func TestUnmarshalJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestSchedule(t *testing.T) {
+	j := new(Job)
+	err := j.UnmarshalJSON([]byte(`{"aggr_id":"foo", "run_at":"2100-01-01T02:00:00+02:00", "expires_at":4102448400, "url":"http://foobar.com","callback_url":"http://foo.bar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.RunAt != 4102444800 {
+		t.Errorf("Expected run_at to be 4102444800, got %d", j.RunAt)
+	}
+	if j.Expired(time.Unix(4102448399, 0)) {
+		t.Error("Expected job not to be expired before expires_at")
+	}
+	if !j.Expired(time.Unix(4102448400, 0)) {
+		t.Error("Expected job to be expired at expires_at")
+	}
+
+	j = new(Job)
+	before := time.Now().Unix()
+	err = j.UnmarshalJSON([]byte(`{"aggr_id":"foo", "delay":60, "url":"http://foobar.com","callback_url":"http://foo.bar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.RunAt < before+60 || j.RunAt > time.Now().Unix()+60 {
+		t.Errorf("Expected run_at to be 60 seconds from now, got %d", j.RunAt)
+	}
+	if j.Expired(time.Now().Add(24 * time.Hour)) {
+		t.Error("Expected job without expires_at to never expire")
+	}
+}
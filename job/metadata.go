@@ -0,0 +1,63 @@
+package job
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Metadata holds information about the downloaded file of a job and the
+// response it was downloaded from. It is included in the callback of the job
+// if requested.
+type Metadata struct {
+	// Size of the downloaded file in bytes
+	Size int64 `json:"size"`
+
+	// Mime type of the file, as detected from its content
+	MimeType string `json:"mime_type"`
+
+	// Content-Type header of the response
+	ContentType string `json:"content_type"`
+
+	// URL of the response, after following any redirects
+	FinalURL string `json:"final_url"`
+
+	// Selected headers of the response
+	Headers ResponseHeaders `json:"headers"`
+
+	// How long the last download attempt took, in milliseconds
+	Duration int64 `json:"duration_ms"`
+
+	// How many times the download request was attempted. It is set when
+	// the callback is built.
+	DownloadCount int `json:"download_count"`
+}
+
+// ResponseHeaders are the headers of a download response that are included
+// in the metadata of a job.
+type ResponseHeaders struct {
+	CacheControl       string `json:"Cache-Control,omitempty"`
+	ContentDisposition string `json:"Content-Disposition,omitempty"`
+	ContentEncoding    string `json:"Content-Encoding,omitempty"`
+	ContentLanguage    string `json:"Content-Language,omitempty"`
+	ETag               string `json:"ETag,omitempty"`
+	Expires            string `json:"Expires,omitempty"`
+	LastModified       string `json:"Last-Modified,omitempty"`
+}
+
+// NewResponseHeaders returns the selected headers of h.
+func NewResponseHeaders(h http.Header) ResponseHeaders {
+	return ResponseHeaders{
+		CacheControl:       h.Get("Cache-Control"),
+		ContentDisposition: h.Get("Content-Disposition"),
+		ContentEncoding:    h.Get("Content-Encoding"),
+		ContentLanguage:    h.Get("Content-Language"),
+		ETag:               h.Get("ETag"),
+		Expires:            h.Get("Expires"),
+		LastModified:       h.Get("Last-Modified"),
+	}
+}
+
+// MarshalBinary is used by redis driver to marshall custom type Metadata
+func (m Metadata) MarshalBinary() (data []byte, err error) {
+	return json.Marshal(m)
+}
@@ -0,0 +1,203 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how failed download or callback attempts are
+// retried. Delays between retries grow exponentially, starting from
+// BaseDelay.
+//
+// A zero field is considered unset, so that a policy can be partially
+// overridden by another one (see Override).
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first one
+	MaxAttempts int
+
+	// Delay before the first retry
+	BaseDelay time.Duration
+
+	// Factor by which the delay is multiplied after each retry
+	Multiplier float64
+
+	// Upper bound of the delay between retries. If unset, the delay is
+	// not bounded.
+	MaxDelay time.Duration
+
+	// Fraction of the delay (0-1) that is randomized, so that retries of
+	// jobs that failed together are spread over time.
+	Jitter float64
+}
+
+// retryPolicyJSON is the JSON representation of a RetryPolicy, with delays
+// expressed in seconds.
+type retryPolicyJSON struct {
+	MaxAttempts int     `json:"max_attempts,omitempty"`
+	BaseDelay   float64 `json:"base_delay,omitempty"`
+	Multiplier  float64 `json:"multiplier,omitempty"`
+	MaxDelay    float64 `json:"max_delay,omitempty"`
+	Jitter      float64 `json:"jitter,omitempty"`
+}
+
+// Override returns a copy of p with its fields replaced by the non-zero
+// fields of o.
+func (p RetryPolicy) Override(o RetryPolicy) RetryPolicy {
+	if o.MaxAttempts != 0 {
+		p.MaxAttempts = o.MaxAttempts
+	}
+	if o.BaseDelay != 0 {
+		p.BaseDelay = o.BaseDelay
+	}
+	if o.Multiplier != 0 {
+		p.Multiplier = o.Multiplier
+	}
+	if o.MaxDelay != 0 {
+		p.MaxDelay = o.MaxDelay
+	}
+	if o.Jitter != 0 {
+		p.Jitter = o.Jitter
+	}
+	return p
+}
+
+// Exhausted reports whether no more attempts should be made, given the
+// number of attempts made so far.
+func (p RetryPolicy) Exhausted(attempts int) bool {
+	return attempts >= p.MaxAttempts
+}
+
+// Delay returns the time to wait before retrying, given the number of
+// attempts made so far.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+
+	d := float64(p.BaseDelay) * math.Pow(mult, float64(attempts-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	if d >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// MarshalJSON encodes p, with delays expressed in seconds.
+func (p RetryPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(retryPolicyJSON{
+		MaxAttempts: p.MaxAttempts,
+		BaseDelay:   p.BaseDelay.Seconds(),
+		Multiplier:  p.Multiplier,
+		MaxDelay:    p.MaxDelay.Seconds(),
+		Jitter:      p.Jitter,
+	})
+}
+
+// MarshalBinary is used by redis driver to marshall custom type RetryPolicy
+func (p RetryPolicy) MarshalBinary() (data []byte, err error) {
+	return p.MarshalJSON()
+}
+
+// UnmarshalJSON populates the policy with the values in the provided JSON.
+// Delays are expected in seconds.
+func (p *RetryPolicy) UnmarshalJSON(b []byte) error {
+	var tmp interface{}
+
+	err := json.Unmarshal(b, &tmp)
+	if err != nil {
+		return err
+	}
+
+	policy, err := retryPolicyFromJSON(tmp)
+	if err != nil {
+		return err
+	}
+	*p = policy
+
+	return nil
+}
+
+// retryPolicyFromJSON validates and converts a decoded JSON object to a
+// RetryPolicy. A nil v results in an empty policy.
+func retryPolicyFromJSON(v interface{}) (RetryPolicy, error) {
+	var p RetryPolicy
+
+	if v == nil {
+		return p, nil
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return p, errors.New("Retry policy must be an object")
+	}
+
+	if f, ok := m["max_attempts"]; ok {
+		attempts, ok := f.(float64)
+		if !ok {
+			return p, errors.New("Retry policy max_attempts must be a number")
+		}
+		if attempts < 1 {
+			return p, errors.New("Retry policy max_attempts must be greater than 0")
+		}
+		p.MaxAttempts = int(attempts)
+	}
+
+	if f, ok := m["base_delay"]; ok {
+		delay, ok := f.(float64)
+		if !ok {
+			return p, errors.New("Retry policy base_delay must be a number")
+		}
+		if delay <= 0 {
+			return p, errors.New("Retry policy base_delay must be greater than 0")
+		}
+		p.BaseDelay = time.Duration(delay * float64(time.Second))
+	}
+
+	if f, ok := m["multiplier"]; ok {
+		mult, ok := f.(float64)
+		if !ok {
+			return p, errors.New("Retry policy multiplier must be a number")
+		}
+		if mult < 1 {
+			return p, errors.New("Retry policy multiplier must be at least 1")
+		}
+		p.Multiplier = mult
+	}
+
+	if f, ok := m["max_delay"]; ok {
+		delay, ok := f.(float64)
+		if !ok {
+			return p, errors.New("Retry policy max_delay must be a number")
+		}
+		if delay <= 0 {
+			return p, errors.New("Retry policy max_delay must be greater than 0")
+		}
+		p.MaxDelay = time.Duration(delay * float64(time.Second))
+	}
+
+	if f, ok := m["jitter"]; ok {
+		jitter, ok := f.(float64)
+		if !ok {
+			return p, errors.New("Retry policy jitter must be a number")
+		}
+		if jitter < 0 || jitter > 1 {
+			return p, errors.New("Retry policy jitter must be between 0 and 1")
+		}
+		p.Jitter = jitter
+	}
+
+	return p, nil
+}
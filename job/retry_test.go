@@ -0,0 +1,71 @@
+package job
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Minute, Multiplier: 2, MaxDelay: 5 * time.Minute}
+
+	tc := map[int]time.Duration{
+		0: time.Minute,
+		1: time.Minute,
+		2: 2 * time.Minute,
+		3: 4 * time.Minute,
+		4: 5 * time.Minute,
+		9: 5 * time.Minute,
+	}
+
+	for attempts, expected := range tc {
+		if d := p.Delay(attempts); d != expected {
+			t.Errorf("Expected delay after %d attempts to be %s, got %s", attempts, expected, d)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.Delay(2)
+		if d < time.Minute || d > 3*time.Minute {
+			t.Fatalf("Expected jittered delay to be within [1m, 3m], got %s", d)
+		}
+	}
+
+	if p.Exhausted(4) {
+		t.Error("Expected policy not to be exhausted after 4 attempts")
+	}
+	if !p.Exhausted(5) {
+		t.Error("Expected policy to be exhausted after 5 attempts")
+	}
+}
+
+func TestRetryPolicyOverride(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute, Multiplier: 2}
+
+	p = p.Override(RetryPolicy{MaxAttempts: 10, MaxDelay: time.Hour}).Override(RetryPolicy{})
+
+	expected := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Minute, Multiplier: 2, MaxDelay: time.Hour}
+	if p != expected {
+		t.Errorf("Expected policy to be %#v, got %#v", expected, p)
+	}
+}
+
+func TestRetryPolicyJSON(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 4, BaseDelay: 1500 * time.Millisecond, Multiplier: 3, Jitter: 0.1}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded RetryPolicy
+	err = json.Unmarshal(b, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded != p {
+		t.Errorf("Expected decoded policy to be %#v, got %#v (%s)", p, decoded, b)
+	}
+}
@@ -0,0 +1,155 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MinScheduleInterval is the minimum interval between the runs of a
+// schedule, in seconds.
+const MinScheduleInterval = 60
+
+// Schedule is a recurring job. Each time it is due, a new job is created
+// from its document, unless the job of its previous run is still pending.
+type Schedule struct {
+	// Auto-generated
+	ID string `json:"id"`
+
+	// Seconds between consecutive runs. Exactly one of Interval and Cron
+	// is set.
+	Interval int `json:"interval,omitempty"`
+
+	// Cron expression describing the times of the runs, in UTC
+	Cron string `json:"cron,omitempty"`
+
+	// JSON document of the created jobs, in the format expected by
+	// POST /download
+	Job string `json:"-"`
+
+	// The ID of the job created by the most recent run, if any
+	LastJobID string `json:"last_job_id"`
+
+	// Unix times of the most recent and of the next run
+	LastRunAt int64 `json:"last_run_at"`
+	NextRunAt int64 `json:"next_run_at"`
+}
+
+// UnmarshalJSON populates s from the provided JSON message, which contains
+// either an interval or a cron expression along with the job document.
+// The auto-generated and run fields of s are left intact.
+func (s *Schedule) UnmarshalJSON(b []byte) error {
+	var tmp map[string]interface{}
+
+	err := json.Unmarshal(b, &tmp)
+	if err != nil {
+		return err
+	}
+
+	var interval int
+	if intervalField, ok := tmp["interval"]; ok {
+		intervalf, ok := intervalField.(float64)
+		if !ok {
+			return errors.New("Interval must be a number")
+		}
+		interval = int(intervalf)
+		if float64(interval) != intervalf || interval < MinScheduleInterval {
+			return fmt.Errorf("Interval must be an integer of at least %d seconds", MinScheduleInterval)
+		}
+	}
+
+	var cron string
+	if cronField, ok := tmp["cron"]; ok {
+		cron, ok = cronField.(string)
+		if !ok {
+			return errors.New("Cron must be a string")
+		}
+		c, err := ParseCron(cron)
+		if err != nil {
+			return err
+		}
+		if c.Next(time.Now()).IsZero() {
+			return errors.New("Cron expression never matches")
+		}
+	}
+
+	if (interval == 0) == (cron == "") {
+		return errors.New("Exactly one of interval and cron must be provided")
+	}
+
+	doc, ok := tmp["job"].(map[string]interface{})
+	if !ok {
+		return errors.New("Job must be an object")
+	}
+	if _, ok := doc["run_at"]; ok {
+		return errors.New("Job of a schedule cannot have a run_at")
+	}
+	if _, ok := doc["expires_at"]; ok {
+		return errors.New("Job of a schedule cannot have an expires_at")
+	}
+
+	jobDoc, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	err = new(Job).UnmarshalJSON(jobDoc)
+	if err != nil {
+		return fmt.Errorf("Invalid job: %s", err)
+	}
+	err = new(Aggregation).UnmarshalJSON(jobDoc)
+	if err != nil {
+		return fmt.Errorf("Invalid job: %s", err)
+	}
+
+	s.Interval = interval
+	s.Cron = cron
+	s.Job = string(jobDoc)
+	return nil
+}
+
+// MarshalJSON returns the JSON representation of s, including its job
+// document.
+func (s Schedule) MarshalJSON() ([]byte, error) {
+	type schedule Schedule
+	doc := json.RawMessage(s.Job)
+	if s.Job == "" {
+		doc = json.RawMessage("null")
+	}
+	return json.Marshal(struct {
+		schedule
+		Job json.RawMessage `json:"job"`
+	}{schedule(s), doc})
+}
+
+// Next returns the time of the first run of s after t. The zero time is
+// returned if there is no such run.
+func (s *Schedule) Next(t time.Time) time.Time {
+	if s.Interval > 0 {
+		return t.Add(time.Duration(s.Interval) * time.Second)
+	}
+
+	c, err := ParseCron(s.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	return c.Next(t)
+}
+
+// NewJob returns a new job, along with its aggregation, from the job
+// document of s. The ID of the job is not set.
+func (s *Schedule) NewJob() (*Job, *Aggregation, error) {
+	j := new(Job)
+	err := json.Unmarshal([]byte(s.Job), j)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aggr := new(Aggregation)
+	err = json.Unmarshal([]byte(s.Job), aggr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return j, aggr, nil
+}
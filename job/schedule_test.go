@@ -0,0 +1,75 @@
+package job
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestScheduleUnmarshalJSON(t *testing.T) {
+	tc := map[string]bool{
+		`{"interval":3600, "job":{"aggr_id":"foo","aggr_limit":1,"url":"http://foobar.com","callback_url":"http://foo.bar"}}`:                     false,
+		`{"cron":"0 2 * * *", "job":{"aggr_id":"foo","aggr_limit":1,"url":"http://foobar.com","callback_url":"http://foo.bar","delay":60}}`:       false,
+		`{"job":{"aggr_id":"foo","aggr_limit":1,"url":"http://foobar.com","callback_url":"http://foo.bar"}}`:                                      true,
+		`{"interval":3600, "cron":"0 2 * * *", "job":{"aggr_id":"foo","aggr_limit":1,"url":"http://foobar.com","callback_url":"http://foo.bar"}}`: true,
+		`{"interval":10, "job":{"aggr_id":"foo","aggr_limit":1,"url":"http://foobar.com","callback_url":"http://foo.bar"}}`:                       true,
+		`{"interval":"3600", "job":{"aggr_id":"foo","aggr_limit":1,"url":"http://foobar.com","callback_url":"http://foo.bar"}}`:                   true,
+		`{"cron":"0 2 * *", "job":{"aggr_id":"foo","aggr_limit":1,"url":"http://foobar.com","callback_url":"http://foo.bar"}}`:                    true,
+		`{"cron":"0 0 31 2 *", "job":{"aggr_id":"foo","aggr_limit":1,"url":"http://foobar.com","callback_url":"http://foo.bar"}}`:                 true,
+		`{"interval":3600}`:                            true,
+		`{"interval":3600, "job":"http://foobar.com"}`: true,
+		`{"interval":3600, "job":{"aggr_id":"foo","aggr_limit":1,"url":"foobar","callback_url":"http://foo.bar"}}`:                                true,
+		`{"interval":3600, "job":{"aggr_id":"foo","aggr_limit":0,"url":"http://foobar.com","callback_url":"http://foo.bar"}}`:                     true,
+		`{"interval":3600, "job":{"aggr_id":"foo","aggr_limit":1,"url":"http://foobar.com","callback_url":"http://foo.bar","run_at":4102444800}}`: true,
+	}
+
+	for data, expectErr := range tc {
+		s := new(Schedule)
+		err := json.Unmarshal([]byte(data), s)
+		if (err != nil) != expectErr {
+			t.Errorf("Expected error to be %v for '%s', got %v", expectErr, data, err)
+		}
+	}
+}
+
+func TestScheduleNewJob(t *testing.T) {
+	s := new(Schedule)
+	err := json.Unmarshal([]byte(`{"interval":3600, "job":{"aggr_id":"foo","aggr_limit":2,"url":"http://foobar.com","callback_url":"http://foo.bar","extra":"feed"}}`), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if next := s.Next(now); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected next run to be in an hour, got %s", next)
+	}
+
+	j, aggr, err := s.NewJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.URL != "http://foobar.com" || j.Extra != "feed" {
+		t.Errorf("Expected job to be created from the schedule's document, got %s", j)
+	}
+	if aggr.ID != "foo" || aggr.Limit != 2 {
+		t.Errorf("Expected aggregation foo with limit 2, got %#v", aggr)
+	}
+
+	s.ID = "bar"
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	err = json.Unmarshal(b, &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["id"] != "bar" || doc["interval"] != 3600.0 {
+		t.Errorf("Unexpected JSON representation of schedule: %s", b)
+	}
+	if jobDoc, ok := doc["job"].(map[string]interface{}); !ok || jobDoc["url"] != "http://foobar.com" {
+		t.Errorf("Expected JSON representation to include the job document, got %s", b)
+	}
+}
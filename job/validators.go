@@ -0,0 +1,21 @@
+package job
+
+// Validators are the cache validators of a downloaded resource, which are
+// used for conditional re-downloads of its URL.
+type Validators struct {
+	// The ETag and Last-Modified response headers of the download
+	ETag         string
+	LastModified string
+
+	// JobID is the ID of the job whose file holds the resource
+	JobID string
+
+	// Blob is the blob of that job, if it was downloaded in the
+	// content-addressable layout
+	Blob string
+}
+
+// Empty reports whether v contains no validator.
+func (v Validators) Empty() bool {
+	return v.ETag == "" && v.LastModified == ""
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/go-stack/stack"
 	"github.com/skroutz/downloader/api"
+	"github.com/skroutz/downloader/blobstore"
 	"github.com/skroutz/downloader/config"
 	"github.com/skroutz/downloader/notifier"
 	"github.com/skroutz/downloader/processor"
@@ -92,13 +94,28 @@ func main() {
 
 				signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-				storage, err := storage.New(redisClient("api", cfg.Redis.Addr))
+				storage, err := newStorage("api")
 				if err != nil {
 					return err
 				}
 				api := api.New(storage, c.String("host"),
 					c.Int("port"), cfg.API.HeartbeatPath, logger)
 
+				if cfg.Notifier.DownloadURL != "" || cfg.BlobStore.Type != "" {
+					api.Files, err = newServedBlobStore(cfg)
+					if err != nil {
+						return err
+					}
+				}
+
+				serveMetrics(cfg.API.MetricsAddr, api.Metrics, func(err error) {
+					logger.Log("level", "error", "action", "metrics_serve", "msg", err)
+				})
+
+				schedCtx, cancelScheduler := context.WithCancel(context.Background())
+				defer cancelScheduler()
+				go api.RunScheduler(schedCtx, time.Second)
+
 				go func() {
 					logger.Log("action", "startup", "address", api.Server.Addr)
 					err := api.Server.ListenAndServe()
@@ -132,7 +149,7 @@ func main() {
 			Action: func(c *cli.Context) error {
 				signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-				storage, err := storage.New(redisClient("processor", cfg.Redis.Addr))
+				storage, err := newStorage("processor")
 				if err != nil {
 					return err
 				}
@@ -141,12 +158,26 @@ func main() {
 				if err != nil {
 					return err
 				}
+				processor.Files, err = newBlobStore(cfg)
+				if err != nil {
+					return err
+				}
 				processor.UserAgent = cfg.Processor.UserAgent
+				processor.ContentAddressable = cfg.Processor.ContentAddressable
+				processor.RetryPolicy = processor.RetryPolicy.Override(cfg.Processor.Retry)
+				if cfg.Processor.MaxThrottles > 0 {
+					processor.MaxThrottles = cfg.Processor.MaxThrottles
+				}
+				configureGC(&processor)
 
 				if cfg.Processor.StatsInterval > 0 {
 					processor.StatsIntvl = time.Duration(cfg.Processor.StatsInterval) * time.Millisecond
 				}
 
+				serveMetrics(cfg.Processor.MetricsAddr, processor.Metrics, func(err error) {
+					processor.Log.Println("Error serving metrics:", err)
+				})
+
 				closeChan := make(chan struct{})
 				go processor.Start(closeChan)
 
@@ -173,7 +204,7 @@ func main() {
 			Action: func(c *cli.Context) error {
 				signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-				storage, err := storage.New(redisClient("notifier", cfg.Redis.Addr))
+				storage, err := newStorage("notifier")
 				if err != nil {
 					return err
 				}
@@ -183,10 +214,18 @@ func main() {
 					logger.Fatal(err)
 				}
 
+				notifier.Files, err = newServedBlobStore(cfg)
+				if err != nil {
+					logger.Fatal(err)
+				}
+				notifier.RetryPolicy = notifier.RetryPolicy.Override(cfg.Notifier.Retry)
+
 				if cfg.Notifier.StatsInterval > 0 {
 					notifier.StatsIntvl = time.Duration(cfg.Notifier.StatsInterval) * time.Millisecond
 				}
 
+				notifier.FailedRetention = time.Duration(cfg.Notifier.FailedRetention) * time.Minute
+
 				if cfg.Notifier.DeletionInterval > 0 {
 					notifier.DeletionIntvl = time.Duration(cfg.Notifier.DeletionInterval) * time.Minute
 				} else {
@@ -195,6 +234,10 @@ func main() {
 						"will be scheduled for deletion, after a job's callback has been delivered successfully.")
 				}
 
+				serveMetrics(cfg.Notifier.MetricsAddr, notifier.Metrics, func(err error) {
+					notifier.Log.Println("Error serving metrics:", err)
+				})
+
 				closeChan := make(chan struct{})
 				go notifier.Start(closeChan, cfg.Backends)
 
@@ -208,6 +251,49 @@ func main() {
 			},
 			Before: parseCliConfig,
 		},
+		cli.Command{
+			Name:  "gc",
+			Usage: "Delete the files in the storage directory that are not needed any more",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config, c",
+					Usage: "`FILE` to load config from",
+					Value: "config.json",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run, n",
+					Usage: "Only report the files that would be deleted",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+				storage, err := newStorage("gc")
+				if err != nil {
+					return err
+				}
+				logger := log.New(os.Stderr, "[gc] ", log.Ldate|log.Ltime)
+				processor, err := processor.New(storage, 3, cfg.Processor.StorageDir, logger)
+				if err != nil {
+					return err
+				}
+				configureGC(&processor)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go func() {
+					<-sigCh
+					cancel()
+				}()
+
+				res, err := processor.CollectGarbage(ctx, c.Bool("dry-run"))
+				logger.Printf("Scanned %d files. Temporary files: %d, orphan files: %d (%d bytes), "+
+					"empty directories: %d, failures: %d", res.Scanned, res.TmpFiles, res.Orphans,
+					res.Bytes, res.Dirs, res.Failures)
+				return err
+			},
+			Before: parseCliConfig,
+		},
 		cli.Command{
 			Name:  "version",
 			Usage: "Show downloader version",
@@ -229,6 +315,97 @@ func parseCliConfig(ctx *cli.Context) error {
 	return err
 }
 
+// serveMetrics serves the metrics of h in the Prometheus format under
+// /metrics on addr, unless addr is empty. Errors are reported to onError.
+func serveMetrics(addr string, h http.Handler, onError func(error)) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", h)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			onError(err)
+		}
+	}()
+}
+
+// newBlobStore returns the store of downloaded files that is selected by cfg.
+func newBlobStore(cfg config.Config) (blobstore.Store, error) {
+	switch cfg.BlobStore.Type {
+	case "", "local":
+		var downloadURL *url.URL
+		if cfg.Notifier.DownloadURL != "" {
+			var err error
+			downloadURL, err = url.ParseRequestURI(cfg.Notifier.DownloadURL)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse Download URL, %v", err)
+			}
+		}
+		return blobstore.NewLocal(cfg.Processor.StorageDir, downloadURL), nil
+	case "s3":
+		s3cfg := cfg.BlobStore.S3
+		s, err := blobstore.NewS3(s3cfg.Endpoint, s3cfg.Region, s3cfg.Bucket, s3cfg.AccessKey, s3cfg.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		if s3cfg.PublicURL != "" {
+			s.PublicURL, err = url.ParseRequestURI(s3cfg.PublicURL)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse S3 public URL, %v", err)
+			}
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("Unknown blobstore type '%s'", cfg.BlobStore.Type)
+	}
+}
+
+// newServedBlobStore returns the store of downloaded files that is selected
+// by cfg, whose URLs are signed if the files are served by the api.
+func newServedBlobStore(cfg config.Config) (blobstore.Store, error) {
+	s, err := newBlobStore(cfg)
+	if err != nil || cfg.API.FilesSecret == "" {
+		return s, err
+	}
+
+	if cfg.Notifier.DownloadURL == "" {
+		return nil, errors.New("The download_url setting is required for serving files from the api")
+	}
+	if cfg.Notifier.DeletionInterval <= 0 {
+		return nil, errors.New("The deletion_interval setting is required for serving files from the api")
+	}
+	downloadURL, err := url.ParseRequestURI(cfg.Notifier.DownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse Download URL, %v", err)
+	}
+	ttl := time.Duration(cfg.Notifier.DeletionInterval) * time.Minute
+	return blobstore.NewSigned(s, downloadURL, cfg.API.FilesSecret, ttl), nil
+}
+
+// configureGC applies the garbage collection settings of the config to p.
+func configureGC(p *processor.Processor) {
+	p.GCInterval = time.Duration(cfg.Processor.GC.Interval) * time.Minute
+	if cfg.Processor.GC.GracePeriod > 0 {
+		p.GCGracePeriod = time.Duration(cfg.Processor.GC.GracePeriod) * time.Minute
+	}
+	if cfg.Processor.GC.Throttle > 0 {
+		p.GCThrottle = time.Duration(cfg.Processor.GC.Throttle) * time.Millisecond
+	}
+}
+
+// newStorage returns the storage of the component with the given name.
+func newStorage(name string) (*storage.Storage, error) {
+	s, err := storage.New(redisClient(name, cfg.Redis.Addr))
+	if err != nil {
+		return nil, err
+	}
+	s.JobTTL = time.Duration(cfg.Redis.JobTTL) * time.Minute
+	return s, nil
+}
+
 func redisClient(name, addr string) *redis.Client {
 	setName := func(c *redis.Conn) error {
 		ok, err := c.ClientSetName(name).Result()
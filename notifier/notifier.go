@@ -16,6 +16,7 @@ import (
 	"github.com/skroutz/downloader/backend"
 	httpbackend "github.com/skroutz/downloader/backend/http_backend"
 	kafkabackend "github.com/skroutz/downloader/backend/kafka_backend"
+	"github.com/skroutz/downloader/blobstore"
 	"github.com/skroutz/downloader/job"
 	"github.com/skroutz/downloader/stats"
 	"github.com/skroutz/downloader/storage"
@@ -33,8 +34,20 @@ const (
 
 	// BackendKafkaID is a known backend implementation
 	BackendKafkaID = "kafka"
+
+	// Prometheus metrics
+	metricsNamespace = "downloader_notifier"
 )
 
+// metricDescs describe the metrics of the notifier, as exported in the
+// Prometheus format
+var metricDescs = map[string]stats.Desc{
+	statsFailedCallbacks:              {Name: "failed_callbacks_total", Kind: stats.Counter, Help: "Number of callbacks that failed after all retries."},
+	statsSuccessfulCallbacks:          {Name: "successful_callbacks_total", Kind: stats.Counter, Help: "Number of delivered callbacks."},
+	statsUndefinedBackendWithCallback: {Name: "undefined_backend_callbacks_total", Kind: stats.Counter, Help: "Number of callbacks of undefined backends."},
+	statsUnknownTopicOrPartition:      {Name: "unknown_topic_or_partition_total", Kind: stats.Counter, Help: "Number of Kafka callbacks to unknown topics or partitions."},
+}
+
 var (
 	// expvar.Publish() panics if a name is already registered, hence
 	// we need to be able to override it in order to test Notifier easily.
@@ -49,23 +62,53 @@ var (
 // and notifying back the respective users by issuing HTTP requests to their
 // provided callback URLs.
 type Notifier struct {
-	Storage     *storage.Storage
-	Log         *log.Logger
-	DownloadURL *url.URL
-	StatsIntvl  time.Duration
+	Storage    *storage.Storage
+	Log        *log.Logger
+	StatsIntvl time.Duration
+
+	// Files is the store of downloaded files, through which the URLs of
+	// the downloaded resources are built. By default, they are served
+	// under the download URL given to New.
+	Files blobstore.Store
 
 	// DeletionIntvl indicates the time after which downloaded files must be
-	// enqueued for deletion.
+	// enqueued for deletion. It can be overridden per aggregation and job.
 	DeletionIntvl time.Duration
 
+	// FailedRetention is the time after which the jobs whose callback
+	// failed are deleted, along with their downloaded files, unless their
+	// callback is retried. Zero means that they are kept until they expire
+	// after the JobTTL of the storage, or indefinitely if it is zero too.
+	FailedRetention time.Duration
+
+	// RetryPolicy is the retry policy of failed callbacks. It can be
+	// overridden per aggregation and per job.
+	RetryPolicy job.RetryPolicy
+
+	// Metrics exposes the metrics of the notifier in the Prometheus format
+	Metrics *stats.Exporter
+
 	// TODO: These should be exported
 	concurrency int
 	client      *http.Client
 	cbChan      chan job.Job
 	stats       *stats.Stats
 
+	callbackLatency *stats.Histogram
+
 	// registered backends
 	backends map[string]backend.Backend
+
+	// inflight contains the ids of the jobs whose callback is being
+	// performed
+	inflight *inflightCallbacks
+}
+
+// inflightCallbacks tracks the jobs whose callback is being performed by a
+// Notifier, so that their deadline is extended until they are released.
+type inflightCallbacks struct {
+	sync.Mutex
+	ids map[string]bool
 }
 
 func init() {
@@ -92,8 +135,14 @@ func New(s *storage.Storage, concurrency int, logger *log.Logger, dwnlURL string
 		StatsIntvl:  5 * time.Second,
 		concurrency: concurrency,
 		cbChan:      make(chan job.Job),
-		DownloadURL: url,
+		Files:       blobstore.NewLocal("", url),
 		backends:    make(map[string]backend.Backend),
+		inflight:    &inflightCallbacks{ids: make(map[string]bool)},
+		RetryPolicy: job.RetryPolicy{
+			MaxAttempts: maxCallbackRetries,
+			BaseDelay:   RetryBackoffDuration,
+			Multiplier:  2,
+		},
 	}
 
 	n.stats = stats.New(statsID, n.StatsIntvl, func(m *expvar.Map) {
@@ -103,10 +152,37 @@ func New(s *storage.Storage, concurrency int, logger *log.Logger, dwnlURL string
 			n.Log.Println("Could not report stats", err)
 		}
 	})
+	n.initMetrics()
 
 	return n, nil
 }
 
+// initMetrics initializes the Prometheus metrics of n.
+func (n *Notifier) initMetrics() {
+	n.Metrics = stats.NewExporter(statsID, metricsNamespace)
+	for key, d := range metricDescs {
+		n.Metrics.Describe(key, d)
+	}
+
+	n.callbackLatency = n.Metrics.Histogram(stats.Desc{
+		Name:  "callback_duration_seconds",
+		Help:  "Duration of callback requests by backend.",
+		Label: "backend",
+	}, []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
+
+	s := n.Storage
+	n.Metrics.GaugeFunc(stats.Desc{
+		Name: "queue_depth",
+		Help: "Number of queued callbacks.",
+	}, func() (map[string]float64, error) {
+		depth, err := s.Redis.ZCard(storage.CallbackQueue).Result()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]float64{"": float64(depth)}, nil
+	})
+}
+
 // Start starts the Notifier loop and instruments the worker goroutines that
 // perform the actual notify requests.
 func (n *Notifier) Start(closeChan chan struct{}, backendCfg map[string]map[string]interface{}) {
@@ -155,10 +231,11 @@ func (n *Notifier) Start(closeChan chan struct{}, backendCfg map[string]map[stri
 		}()
 	}
 
-	// Check Redis for jobs left in InProgress state
-	n.collectRogueCallbacks()
+	// Check Redis for callbacks left in flight by dead notifiers
+	n.requeueExpired()
 
 	go n.stats.Run(ctx)
+	go n.heartbeat(ctx)
 
 	// Start monitoring delivery reports for each backend
 	var deliveriesWg sync.WaitGroup
@@ -201,55 +278,83 @@ func (n *Notifier) Start(closeChan chan struct{}, backendCfg map[string]map[stri
 				time.Sleep(time.Second)
 				continue
 			}
+			n.inflight.add(job.ID)
 			n.cbChan <- job
 		}
 	}
 }
 
-// collectRogueCallbacks Scans Redis for jobs that have InProgress CallbackState.
-// This indicates they are leftover from an interrupted previous run and should get requeued.
-func (n *Notifier) collectRogueCallbacks() {
-	var cursor uint64
-	var rogueCount uint64
+// heartbeat periodically extends the deadline of the callbacks performed by
+// n, so that they are not requeued while being performed. It also requeues
+// the in-flight callbacks of all notifiers whose deadline expired, e.g.
+// because their notifier died.
+func (n *Notifier) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(storage.VisibilityTimeout / 6)
+	defer ticker.Stop()
 
 	for {
-		var keys []string
-		var err error
-		keys, cursor, err = n.Storage.Redis.Scan(cursor, storage.JobKeyPrefix+"*", 50).Result()
-		if err != nil {
-			n.Log.Println(err)
-			break
-		}
-
-		for _, jobID := range keys {
-			strCmd := n.Storage.Redis.HGet(jobID, "CallbackState")
-			if strCmd.Err() != nil {
-				n.Log.Println(strCmd.Err())
-				continue
-			}
-			if job.State(strCmd.Val()) == job.StateInProgress {
-				jb, err := n.Storage.GetJob(strings.TrimPrefix(jobID, storage.JobKeyPrefix))
-				if err != nil {
-					n.Log.Printf("Could not get job for Redis: %v", err)
-					continue
-				}
-				err = n.Storage.QueuePendingCallback(&jb, 0)
-				if err != nil {
-					n.Log.Printf("Could not queue job for download: %v", err)
-					continue
-				}
-				rogueCount++
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := n.Storage.RenewCallbacks(n.inflight.list())
+			if err != nil {
+				n.Log.Println("Error renewing in-flight callbacks:", err)
 			}
+			n.requeueExpired()
 		}
+	}
+}
 
-		if cursor == 0 {
-			break
-		}
+// requeueExpired requeues the in-flight callbacks whose deadline expired.
+func (n *Notifier) requeueExpired() {
+	count, err := n.Storage.RequeueExpiredCallbacks()
+	if err != nil {
+		n.Log.Println("Error requeueing expired callbacks:", err)
+	} else if count > 0 {
+		n.Log.Printf("Requeued %d expired callbacks", count)
+	}
+}
+
+// release marks the callback of the job with the given id as no longer in
+// flight, unless it was requeued in the meantime. Requeued callbacks are
+// released by storage.QueuePendingCallback, since they may be popped again
+// right away.
+func (n *Notifier) release(id string) {
+	if !n.inflight.remove(id) {
+		return
 	}
+	if err := n.Storage.ReleaseCallback(id); err != nil {
+		n.Log.Printf("Error releasing callback of job %s: %s", id, err)
+	}
+}
+
+// add registers the job with the given id.
+func (f *inflightCallbacks) add(id string) {
+	f.Lock()
+	defer f.Unlock()
+	f.ids[id] = true
+}
 
-	if rogueCount > 0 {
-		n.Log.Printf("Queued %d rogue callbacks", rogueCount)
+// remove unregisters the job with the given id and reports whether it was
+// registered.
+func (f *inflightCallbacks) remove(id string) bool {
+	f.Lock()
+	defer f.Unlock()
+	ok := f.ids[id]
+	delete(f.ids, id)
+	return ok
+}
+
+// list returns the ids of the registered jobs.
+func (f *inflightCallbacks) list() []string {
+	f.Lock()
+	defer f.Unlock()
+	ids := make([]string, 0, len(f.ids))
+	for id := range f.ids {
+		ids = append(ids, id)
 	}
+	return ids
 }
 
 // monitorDeliveries consumes callback objects from the running backends
@@ -278,6 +383,8 @@ func (n *Notifier) monitorDeliveries(ctx context.Context, backendID string) {
 // stats counters and remove the job from storage.
 // Otherwise we mark the callback as failed.
 func (n *Notifier) handleCallbackInfo(cbInfo job.Callback) error {
+	defer n.release(cbInfo.JobID)
+
 	j, err := n.Storage.GetJob(cbInfo.JobID)
 	if err != nil {
 		return fmt.Errorf("\nError: Could not get job %s. Operation returned error: %s", cbInfo.JobID, err)
@@ -291,7 +398,7 @@ func (n *Notifier) handleCallbackInfo(cbInfo job.Callback) error {
 			return fmt.Errorf("Could not remove job %s. Operation returned error: %s", cbInfo.JobID, err)
 		}
 
-		err = n.Storage.QueueJobForDeletion(cbInfo.JobID, n.DeletionIntvl)
+		err = n.Storage.QueueJobForDeletion(&j, n.retention(&j))
 		if err != nil {
 			return fmt.Errorf("Error: Could not queue job for deletion %s", err)
 		}
@@ -325,11 +432,19 @@ func (n *Notifier) PreNotify(j *job.Job) (job.Callback, error) {
 		return job.Callback{}, err
 	}
 
-	cbInfo, err := j.CallbackInfo(*n.DownloadURL)
+	cbInfo, err := j.CallbackInfo(n.files(j))
 	if err != nil {
+		defer n.release(j.ID)
 		return job.Callback{}, n.markCbFailed(j, err.Error())
 	}
 
+	if j.IncludeAttempts {
+		cbInfo.Attempts, err = n.Storage.GetAttempts(j.ID)
+		if err != nil {
+			n.Log.Printf("Error fetching download attempts of %s: %s", j, err)
+		}
+	}
+
 	return cbInfo, nil
 }
 
@@ -347,7 +462,9 @@ func (n *Notifier) Notify(j *job.Job, cbInfo job.Callback) error {
 		return n.retryOrFail(j, err)
 	}
 
+	startedAt := time.Now()
 	err := b.Notify(cbDst, cbInfo)
+	n.callbackLatency.Observe(cbType, time.Since(startedAt).Seconds())
 	if err != nil {
 		return n.retryOrFail(j, err.Error())
 	}
@@ -355,16 +472,19 @@ func (n *Notifier) Notify(j *job.Job, cbInfo job.Callback) error {
 	return nil
 }
 
-// retryOrFail checks the callback count of the current download
-// and retries the callback if its Retry Counts < maxRetries else it marks
-// it as failed
+// retryOrFail checks the callback count of the current download against
+// the callback retry policy of j and retries the callback if the policy
+// allows it, else it marks it as failed
 func (n *Notifier) retryOrFail(j *job.Job, err string) error {
-	if j.CallbackCount >= maxCallbackRetries {
+	policy := n.RetryPolicy.Override(j.CallbackRetry)
+	if policy.Exhausted(j.CallbackCount) {
+		defer n.release(j.ID)
 		return n.markCbFailed(j, err)
 	}
 
 	n.Log.Printf("Warn: Callback try no:%d failed for job:%s with: %s", j.CallbackCount, j, err)
-	return n.Storage.QueuePendingCallback(j, time.Duration(j.CallbackCount)*RetryBackoffDuration)
+	n.inflight.remove(j.ID)
+	return n.Storage.QueuePendingCallback(j, policy.Delay(j.CallbackCount))
 }
 
 func (n *Notifier) markCbInProgress(j *job.Job) error {
@@ -380,7 +500,41 @@ func (n *Notifier) markCbFailed(j *job.Job, meta ...string) error {
 
 	//Report stats
 	n.stats.Add(statsFailedCallbacks, 1)
-	return n.Storage.SaveJob(j)
+	err := n.Storage.SaveJob(j)
+	if err != nil {
+		return err
+	}
+
+	// Jobs that expire must still be deleted, so that their files, and
+	// the references to their blobs, are released
+	retention := n.FailedRetention
+	if retention <= 0 {
+		retention = n.Storage.JobTTL
+	}
+	if retention <= 0 {
+		return nil
+	}
+	return n.Storage.QueueJobForDeletion(j, retention)
+}
+
+// retention returns the time after which the downloaded file of j is
+// deleted, once its callback is delivered. The retention of j, which
+// defaults to the retention of its aggregation when j is enqueued,
+// overrides n.DeletionIntvl.
+func (n *Notifier) retention(j *job.Job) time.Duration {
+	if j.Retention > 0 {
+		return time.Duration(j.Retention) * time.Minute
+	}
+	return n.DeletionIntvl
+}
+
+// files returns the store through which the URL of the downloaded file of j
+// is built. Signed URLs expire along with the file.
+func (n *Notifier) files(j *job.Job) job.URLBuilder {
+	if s, ok := n.Files.(*blobstore.Signed); ok {
+		return s.WithTTL(n.retention(j))
+	}
+	return n.Files
 }
 
 // getCallbackTypeAndDst returns callback type and destination from either
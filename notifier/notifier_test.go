@@ -181,7 +181,7 @@ func TestNotifyJobDeletion(t *testing.T) {
 	<-ch
 }
 
-func TestRogueCollection(t *testing.T) {
+func TestExpiredCallbacks(t *testing.T) {
 	statsID = "rogue"
 	notifier, err := New(store, 10, logger, "http://blah.com/")
 	if err != nil {
@@ -213,6 +213,12 @@ func TestRogueCollection(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+
+		// Their notifier died while performing them
+		err = store.Redis.ZAdd(storage.InFlightCallbacks, redis.Z{Member: tc.Job.ID, Score: 1}).Err()
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	//start and close Notifier
@@ -232,3 +238,158 @@ func TestRogueCollection(t *testing.T) {
 		}
 	}
 }
+
+func TestRetention(t *testing.T) {
+	statsID = "retention"
+	notifier, err := New(store, 10, logger, "http://blah.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier.DeletionIntvl = time.Hour
+	notifier.FailedRetention = 24 * time.Hour
+
+	aggr := &job.Aggregation{ID: "retentionaggr", Limit: 1, Retention: 5}
+	err = store.SaveAggregation(aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		j         job.Job
+		retention time.Duration
+	}{
+		{job.Job{ID: "defaultretention", AggrID: "noretentionaggr"}, time.Hour},
+		{job.Job{ID: "aggrretention", AggrID: "retentionaggr"}, 5 * time.Minute},
+		{job.Job{ID: "jobretention", AggrID: "retentionaggr", Retention: 10}, 10 * time.Minute},
+	}
+	for i := range testcases {
+		if testcases[i].j.AggrID == aggr.ID {
+			testcases[i].j.Inherit(aggr)
+		}
+	}
+
+	// The aggregation is removed once its worker pool drains, which
+	// usually happens before the callbacks of its jobs are delivered
+	err = store.RemoveAggregation(aggr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range testcases {
+		if r := notifier.retention(&tc.j); r != tc.retention {
+			t.Errorf("Expected retention of %s to be %s, got %s", tc.j.ID, tc.retention, r)
+		}
+	}
+
+	j := job.Job{ID: "failedretention", AggrID: "retentionaggr", DownloadState: job.StateSuccess}
+	before := time.Now()
+	err = notifier.markCbFailed(&j, "failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	score, err := store.Redis.ZScore(storage.RIPQueue, j.ID).Result()
+	if err != nil {
+		t.Fatalf("Expected job whose callback failed to be queued for deletion: %s", err)
+	}
+	if deletion := time.Unix(int64(score), 0); deletion.Before(before.Add(23 * time.Hour)) {
+		t.Errorf("Expected job to be deleted after FailedRetention, got %s", deletion)
+	}
+}
+
+func TestFailedJobTTL(t *testing.T) {
+	statsID = "failedjobttl"
+	notifier, err := New(store, 10, logger, "http://blah.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.JobTTL = time.Hour
+	defer func() { store.JobTTL = 0 }()
+
+	_, err = store.AcquireBlob("failedjobttlblob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := job.Job{ID: "failedjobttl", AggrID: "failedjobttlaggr", DownloadState: job.StateSuccess, Blob: "failedjobttlblob"}
+	before := time.Now()
+	err = notifier.markCbFailed(&j, "failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	score, err := store.Redis.ZScore(storage.RIPQueue, j.ID).Result()
+	if err != nil {
+		t.Fatalf("Expected job whose callback failed to be queued for deletion: %s", err)
+	}
+	if deletion := time.Unix(int64(score), 0); deletion.Before(before.Add(59 * time.Minute)) {
+		t.Errorf("Expected job to be deleted after JobTTL, got %s", deletion)
+	}
+
+	// The job expires before it is popped for deletion
+	err = store.Redis.Del(storage.JobKeyPrefix + j.ID).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Redis.ZAdd(storage.RIPQueue, redis.Z{Member: j.ID, Score: 0}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	popped, err := store.PopRip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if popped.Blob != j.Blob {
+		t.Fatalf("Expected the blob of the expired job to be released, got %q", popped.Blob)
+	}
+	n, err := store.ReleaseBlob(popped.Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("Expected the blob to have no references left, got %d", n)
+	}
+}
+
+func TestCallbackRetry(t *testing.T) {
+	statsID = "callbackretry"
+	notifier, err := New(store, 10, logger, "http://blah.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier.RetryPolicy = job.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Minute}
+
+	aggr := &job.Aggregation{ID: "callbackretryaggr", Limit: 1,
+		CallbackRetry: job.RetryPolicy{MaxAttempts: 3}}
+
+	testcases := []struct {
+		j        job.Job
+		attempts int
+		state    job.State
+	}{
+		{job.Job{ID: "aggrcallbackretry"}, 2, job.StatePending},
+		{job.Job{ID: "aggrcallbackretryexhausted"}, 3, job.StateFailed},
+		{job.Job{ID: "jobcallbackretry", CallbackRetry: job.RetryPolicy{MaxAttempts: 2}}, 2, job.StateFailed},
+	}
+
+	for _, tc := range testcases {
+		tc.j.AggrID = aggr.ID
+		tc.j.DownloadState = job.StateSuccess
+		tc.j.CallbackCount = tc.attempts
+		tc.j.Inherit(aggr)
+
+		err = notifier.retryOrFail(&tc.j, "failed")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		j, err := store.GetJob(tc.j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.CallbackState != tc.state {
+			t.Errorf("Expected callback state of %s to be %s after %d attempts, got %s",
+				j.ID, tc.state, tc.attempts, j.CallbackState)
+		}
+	}
+}
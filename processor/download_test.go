@@ -1,17 +1,30 @@
 package processor
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/skroutz/downloader/blobstore"
 	"github.com/skroutz/downloader/job"
 	"github.com/skroutz/downloader/processor/mimetype"
+	"github.com/skroutz/downloader/storage"
 )
 
 func TestPerformUserAgent(t *testing.T) {
@@ -259,6 +272,18 @@ func TestPerformDownloadSuccess(t *testing.T) {
 	if j.DownloadState != job.StateSuccess {
 		t.Fatalf("Download should have been marked successful for job %s", j)
 	}
+
+	rec := httptest.NewRecorder()
+	defaultProcessor.Metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, m := range []string{
+		"downloader_processor_download_duration_seconds_count{aggregation=\"" + j.AggrID + "\"}",
+		"downloader_processor_download_size_bytes_count{aggregation=\"" + j.AggrID + "\"}",
+		"# TYPE downloader_processor_queue_depth gauge",
+	} {
+		if !strings.Contains(rec.Body.String(), m) {
+			t.Errorf("Expected metrics to contain %s, got:\n%s", m, rec.Body)
+		}
+	}
 }
 
 func TestPerformDownloadFail(t *testing.T) {
@@ -303,4 +328,691 @@ func TestPerformDownloadRequeue(t *testing.T) {
 	if j.DownloadCount != 1 {
 		t.Fatalf("Download count should have been bumped, found DownloadCount: %d", j.DownloadCount)
 	}
+
+	attempts, err := store.GetAttempts(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(attempts) != 1 {
+		t.Fatalf("Expected 1 download attempt to have been recorded, found %d", len(attempts))
+	}
+
+	if a := attempts[0]; a.ResponseCode != http.StatusInternalServerError || !a.Retriable || a.Phase == "" {
+		t.Fatalf("Unexpected download attempt %#v", a)
+	}
+}
+
+func TestPerformDownloadRetryPolicy(t *testing.T) {
+	var err error
+	j := getTestJob(t)
+	j.DownloadRetry = job.RetryPolicy{MaxAttempts: 1}
+	store.QueuePendingDownload(&j, 0)
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	})
+	defaultWP.perform(context.TODO(), &j, nil)
+
+	j, err = store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.DownloadState != job.StateFailed {
+		t.Fatalf("Download should have been marked as Failed by the retry policy of job %s", j)
+	}
+}
+
+func TestPerformDownloadRetryAfter(t *testing.T) {
+	wp, err := defaultProcessor.newWorkerPool(*defaultAggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The aggregation is throttled for all worker pools
+	defer Redis.Del(storage.ThrottleKeyPrefix + defaultAggr.ID)
+
+	j := getTestJob(t)
+	store.QueuePendingDownload(&j, 0)
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+	})
+	wp.perform(context.TODO(), &j, nil)
+
+	j, err = store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.DownloadState != job.StatePending {
+		t.Fatalf("Download should have been Requeued for job %s", j)
+	}
+
+	score, err := Redis.ZScore(storage.JobsKeyPrefix+j.AggrID, j.ID).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delay := time.Until(time.Unix(int64(score), 0)); delay < 100*time.Second {
+		t.Errorf("Expected job to have been requeued after Retry-After, found delay %s", delay)
+	}
+
+	d, err := store.AggregationThrottled(j.AggrID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d < 100*time.Second {
+		t.Errorf("Expected aggregation to have been throttled after Retry-After, found %s", d)
+	}
+
+	if j.DownloadCount != 0 || j.ThrottleCount != 1 {
+		t.Errorf("Expected throttled attempt to not count as a download attempt, got %d download and %d throttled attempts",
+			j.DownloadCount, j.ThrottleCount)
+	}
+}
+
+func TestPerformDownloadThrottled(t *testing.T) {
+	wp, err := defaultProcessor.newWorkerPool(*defaultAggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(n int) { defaultProcessor.MaxThrottles = n }(defaultProcessor.MaxThrottles)
+	defaultProcessor.MaxThrottles = 2
+
+	j := getTestJob(t)
+	j.DownloadRetry = job.RetryPolicy{MaxAttempts: 1}
+	store.QueuePendingDownload(&j, 0)
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+	})
+
+	for _, expected := range []job.State{job.StatePending, job.StateFailed} {
+		wp.perform(context.TODO(), &j, nil)
+
+		j, err = store.GetJob(j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.DownloadState != expected {
+			t.Fatalf("Expected job to be %s after %d throttled attempts, found %s", expected, j.ThrottleCount, j.DownloadState)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2019, 4, 10, 12, 0, 0, 0, time.UTC)
+
+	tc := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"-5", 0, false},
+		{"soon", 0, false},
+		{"Wed, 10 Apr 2019 12:05:00 GMT", 5 * time.Minute, true},
+		{"Wed, 10 Apr 2019 11:55:00 GMT", 0, true},
+		{"99999999999999999", maxRetryAfter, true},
+		{"Fri, 10 Apr 2099 12:00:00 GMT", maxRetryAfter, true},
+	}
+
+	for _, c := range tc {
+		d, ok := parseRetryAfter(c.value, now)
+		if d != c.expected || ok != c.ok {
+			t.Errorf("Expected parseRetryAfter(%q) to be (%s, %t), got (%s, %t)", c.value, c.expected, c.ok, d, ok)
+		}
+	}
+}
+
+func TestPerformCancelled(t *testing.T) {
+	j := getTestJob(t)
+	store.QueuePendingDownload(&j, 0)
+
+	reqs := make(chan struct{}, 1)
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		reqs <- struct{}{}
+		http.ServeFile(w, r, "../testdata/tiny.png")
+	})
+
+	err := store.RequestCancellation(j.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultWP.perform(context.TODO(), &j, nil)
+
+	select {
+	case <-reqs:
+		t.Fatal("Expected cancelled job not to have been downloaded")
+	default:
+	}
+
+	j, err = store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.DownloadState != job.StateCancelled {
+		t.Fatalf("Download should have been marked as Cancelled for job %s", j)
+	}
+
+	if j.CallbackState != job.StatePending {
+		t.Fatalf("Cancellation callback should have been queued for job %s", j)
+	}
+}
+
+func TestPerformCancelledInProgress(t *testing.T) {
+	j := getTestJob(t)
+	store.QueuePendingDownload(&j, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go defaultProcessor.watchCancellations(ctx)
+
+	reqs := make(chan struct{})
+	cancelled := make(chan struct{})
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		close(reqs)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	go func() {
+		<-reqs
+		store.RequestCancellation(j.ID, false)
+	}()
+	defaultWP.perform(context.TODO(), &j, nil)
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the in-progress download to have been cancelled")
+	}
+
+	j, err := store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.DownloadState != job.StateCancelled {
+		t.Fatalf("Download should have been marked as Cancelled for job %s", j)
+	}
+}
+
+func TestPerformCancelledAfterDownload(t *testing.T) {
+	j := getTestJob(t)
+	store.QueuePendingDownload(&j, 0)
+
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		// The cancellation is requested while the response is sent,
+		// too late to interrupt the download
+		store.RequestCancellation(j.ID, false)
+		http.ServeFile(w, r, "../testdata/tiny.png")
+	})
+	defaultWP.perform(context.TODO(), &j, nil)
+
+	j, err := store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.DownloadState != job.StateCancelled {
+		t.Fatalf("Download should have been marked as Cancelled for job %s", j)
+	}
+
+	requested, _, err := store.CancellationRequested(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested {
+		t.Error("Expected cancellation request to have been cleared")
+	}
+}
+
+func TestPerformExpired(t *testing.T) {
+	j := getTestJob(t)
+	j.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	store.QueuePendingDownload(&j, 0)
+
+	reqs := make(chan struct{}, 1)
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		reqs <- struct{}{}
+		http.ServeFile(w, r, "../testdata/tiny.png")
+	})
+
+	defaultWP.perform(context.TODO(), &j, nil)
+
+	select {
+	case <-reqs:
+		t.Fatal("Expected expired job not to have been downloaded")
+	default:
+	}
+
+	j, err := store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.DownloadState != job.StateFailed {
+		t.Fatalf("Download should have been marked as Failed for job %s", j)
+	}
+
+	if !strings.HasPrefix(j.DownloadMeta, "Job expired") {
+		t.Errorf("Expected download meta to report the expiration, got %q", j.DownloadMeta)
+	}
+
+	if j.CallbackState != job.StatePending {
+		t.Fatalf("Callback should have been queued for job %s", j)
+	}
+}
+
+func TestPerformNotModified(t *testing.T) {
+	var downloads int
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		http.ServeFile(w, r, "../testdata/tiny.png")
+	})
+
+	first := getTestJob(t)
+	first.ID = t.Name() + "First"
+	second := getTestJob(t)
+	second.ID = t.Name() + "Second"
+	client := getTestJob(t)
+	client.ID = t.Name() + "Client"
+	client.IfNoneMatch = `"v1"`
+
+	for _, j := range []*job.Job{&first, &second, &client} {
+		store.QueuePendingDownload(j, 0)
+		defaultWP.perform(context.TODO(), j, nil)
+	}
+
+	if downloads != 1 {
+		t.Errorf("Expected resource to be downloaded once, got %d", downloads)
+	}
+
+	for _, j := range []job.Job{first, second, client} {
+		j, err := store.GetJob(j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.DownloadState != job.StateSuccess {
+			t.Fatalf("Download should have been marked successful for job %s", j)
+		}
+		if j.NotModified != (j.ID != first.ID) {
+			t.Errorf("Expected NotModified of %s to be %v", j.ID, j.ID != first.ID)
+		}
+	}
+
+	// Jobs that are not modified since the downloader's own copy link to it
+	if _, err := os.Stat(defaultProcessor.storagePath(&second)); err != nil {
+		t.Errorf("Expected file of unmodified job to exist: %s", err)
+	}
+	if _, err := os.Stat(defaultProcessor.storagePath(&client)); !os.IsNotExist(err) {
+		t.Errorf("Expected no file for job not modified since the client's copy, got %v", err)
+	}
+
+	v, err := store.GetValidators(first.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ETag != `"v1"` || v.JobID != second.ID {
+		t.Errorf("Expected validators of %s to point to %s, got %#v", first.URL, second.ID, v)
+	}
+}
+
+func TestPerformResume(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/sample-1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := len(data) / 2
+
+	var ranges []string
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			// Interrupt the first download half-way
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data[:half])
+			return
+		}
+		http.ServeContent(w, r, "sample-1.jpg", time.Time{}, bytes.NewReader(data))
+	})
+
+	j := getTestJob(t)
+	j.MimeType = "image/jpeg"
+	store.QueuePendingDownload(&j, 0)
+
+	v, err := mimetype.New()
+	if err != nil {
+		t.Fatal("Could not create a new validator", err)
+	}
+
+	defaultWP.perform(context.TODO(), &j, v)
+	if j.DownloadState != job.StatePending {
+		t.Fatalf("Expected interrupted download to be requeued, got %s", j.DownloadState)
+	}
+	fi, err := os.Stat(defaultProcessor.tmpStoragePath(&j))
+	if err != nil {
+		t.Fatalf("Expected partial download to be kept: %s", err)
+	}
+	if fi.Size() != int64(half) {
+		t.Fatalf("Expected partial download of %d bytes, got %d", half, fi.Size())
+	}
+
+	defaultWP.perform(context.TODO(), &j, v)
+
+	j, err = store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.DownloadState != job.StateSuccess {
+		t.Fatalf("Download should have been marked successful for job %s: %s", j, j.DownloadMeta)
+	}
+
+	expected := []string{"", fmt.Sprintf("bytes=%d-", half)}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("Expected Range headers %q, got %q", expected, ranges)
+	}
+
+	downloaded, err := ioutil.ReadFile(defaultProcessor.storagePath(&j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Error("Expected resumed download to be equal to the resource")
+	}
+}
+
+func TestPerformResumeUnsupported(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/sample-1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// The server ignores ranges, so the download starts over
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if requests == 1 {
+			w.Write(data[:len(data)/2])
+			return
+		}
+		w.Write(data)
+	})
+
+	j := getTestJob(t)
+	store.QueuePendingDownload(&j, 0)
+	defaultWP.perform(context.TODO(), &j, nil)
+	defaultWP.perform(context.TODO(), &j, nil)
+
+	if j.DownloadState != job.StateSuccess {
+		t.Fatalf("Download should have been marked successful for job %s: %s", j, j.DownloadMeta)
+	}
+	downloaded, err := ioutil.ReadFile(defaultProcessor.storagePath(&j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Error("Expected download to be equal to the resource")
+	}
+}
+
+func TestPerformSegmented(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/sample-1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(size int64) { minSegmentSize = size }(minSegmentSize)
+	minSegmentSize = 1024
+
+	var mu sync.Mutex
+	var ranges int
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			mu.Lock()
+			ranges++
+			mu.Unlock()
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "sample-1.jpg", time.Time{}, bytes.NewReader(data))
+	})
+
+	aggr, err := job.NewAggregation(t.Name(), 3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp, err := defaultProcessor.newWorkerPool(*aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := getTestJob(t)
+	j.AggrID = aggr.ID
+	j.Segments = 4
+	store.QueuePendingDownload(&j, 0)
+
+	// The job occupies one of the slots, leaving two for its segments
+	j, err = store.PopJob(aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp.perform(context.TODO(), &j, nil)
+
+	j, err = store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.DownloadState != job.StateSuccess {
+		t.Fatalf("Download should have been marked successful for job %s: %s", j, j.DownloadMeta)
+	}
+	if ranges != 2 {
+		t.Errorf("Expected 2 ranged requests, got %d", ranges)
+	}
+
+	downloaded, err := ioutil.ReadFile(defaultProcessor.storagePath(&j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, data) {
+		t.Error("Expected segmented download to be equal to the resource")
+	}
+
+	sum := sha256.Sum256(data)
+	if j.Checksums.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected the checksum of the whole resource, got %s", j.Checksums.SHA256)
+	}
+
+	n, err := Redis.ZCard(storage.SlotsKeyPrefix + aggr.ID).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The slot of the job itself is released by its worker
+	if n != 1 {
+		t.Errorf("Expected the slots of the segments to be freed, got %d occupied", n)
+	}
+}
+
+func TestPerformChecksum(t *testing.T) {
+	data, err := ioutil.ReadFile("../testdata/tiny.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha := sha256.Sum256(data)
+	md := md5.Sum(data)
+
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "../testdata/tiny.png")
+	})
+
+	j := getTestJob(t)
+	j.ChecksumAlgorithms = "md5"
+	j.ExpectedChecksum = "sha256:" + hex.EncodeToString(sha[:])
+	store.QueuePendingDownload(&j, 0)
+	defaultWP.perform(context.TODO(), &j, nil)
+
+	j, err = store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.DownloadState != job.StateSuccess {
+		t.Fatalf("Download should have been marked successful for job %s: %s", j, j.DownloadMeta)
+	}
+
+	expected := job.Checksums{SHA256: hex.EncodeToString(sha[:]), MD5: hex.EncodeToString(md[:])}
+	if j.Checksums != expected {
+		t.Errorf("Expected checksums %#v, got %#v", expected, j.Checksums)
+	}
+
+	mismatch := getTestJob(t)
+	mismatch.ID = t.Name() + "Mismatch"
+	mismatch.ExpectedChecksum = "md5:" + strings.Repeat("0", 32)
+	store.QueuePendingDownload(&mismatch, 0)
+	defaultWP.perform(context.TODO(), &mismatch, nil)
+
+	mismatch, err = store.GetJob(mismatch.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mismatch.DownloadState != job.StateFailed {
+		t.Fatalf("Download should have been marked as Failed for job %s", mismatch)
+	}
+	if !strings.Contains(mismatch.DownloadMeta, "checksum") {
+		t.Errorf("Expected download meta to report the checksum mismatch, got %q", mismatch.DownloadMeta)
+	}
+	if _, err := os.Stat(defaultProcessor.tmpStoragePath(&mismatch)); !os.IsNotExist(err) {
+		t.Error("Expected the tmp file of the failed download to be removed")
+	}
+}
+
+func TestPerformMetadata(t *testing.T) {
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/"+t.Name()+"Final", http.StatusFound)
+	})
+	addHandler(t.Name()+"Final", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="tiny.png"`)
+		http.ServeFile(w, r, "../testdata/tiny.png")
+	})
+
+	fi, err := os.Stat("../testdata/tiny.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := mimetype.New()
+	if err != nil {
+		t.Fatal("Could not create a new validator", err)
+	}
+	defer v.Close()
+
+	j := getTestJob(t)
+	j.IncludeMetadata = true
+	store.QueuePendingDownload(&j, 0)
+	defaultWP.perform(context.TODO(), &j, v)
+
+	j, err = store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.DownloadState != job.StateSuccess {
+		t.Fatalf("Download should have been marked successful for job %s: %s", j, j.DownloadMeta)
+	}
+
+	m := j.Metadata
+	if m.Size != fi.Size() {
+		t.Errorf("Expected size %d, got %d", fi.Size(), m.Size)
+	}
+	if m.MimeType != "image/png" {
+		t.Errorf("Expected detected mime type image/png, got %s", m.MimeType)
+	}
+	if m.ContentType != "application/octet-stream" {
+		t.Errorf("Expected content type application/octet-stream, got %s", m.ContentType)
+	}
+	if m.FinalURL != j.URL+"Final" {
+		t.Errorf("Expected final URL %s, got %s", j.URL+"Final", m.FinalURL)
+	}
+	if m.Headers.ContentDisposition != `attachment; filename="tiny.png"` || m.Headers.LastModified == "" {
+		t.Errorf("Expected the selected response headers, got %#v", m.Headers)
+	}
+
+	cb, err := j.CallbackInfo(blobstore.NewLocal("", &url.URL{Scheme: "http", Host: "example.com"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cb.Metadata == nil || cb.Metadata.DownloadCount != 1 {
+		t.Errorf("Expected the callback to contain the metadata, got %#v", cb.Metadata)
+	}
+	if cb.Checksums == nil || cb.Checksums.SHA256 == "" {
+		t.Errorf("Expected the callback to contain the checksums, got %#v", cb.Checksums)
+	}
+}
+
+func TestPerformContentAddressable(t *testing.T) {
+	defaultProcessor.ContentAddressable = true
+	defer func() { defaultProcessor.ContentAddressable = false }()
+
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "../testdata/tiny.png")
+	})
+
+	first := getTestJob(t)
+	first.ID = t.Name() + "First"
+	second := getTestJob(t)
+	second.ID = t.Name() + "Second"
+
+	for _, j := range []*job.Job{&first, &second} {
+		store.QueuePendingDownload(j, 0)
+		defaultWP.perform(context.TODO(), j, nil)
+
+		dl, err := store.GetJob(j.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dl.DownloadState != job.StateSuccess {
+			t.Fatalf("Download should have been marked successful for job %s: %s", dl, dl.DownloadMeta)
+		}
+		if dl.Blob == "" || dl.Blob != dl.Checksums.SHA256 {
+			t.Fatalf("Expected job %s to reference the blob of its checksum, got %q", dl, dl.Blob)
+		}
+		*j = dl
+	}
+
+	if first.Blob != second.Blob {
+		t.Fatalf("Expected both jobs to reference the same blob, got %s and %s", first.Blob, second.Blob)
+	}
+	if _, err := os.Stat(path.Join(storageDir, (&job.Job{ID: first.ID}).Path())); !os.IsNotExist(err) {
+		t.Error("Expected no file to be stored under the path of the job")
+	}
+
+	downloadURL := first.DownloadURL(blobstore.NewLocal("", &url.URL{Scheme: "http", Host: "example.com"}))
+	if !strings.HasSuffix(downloadURL, "/"+job.BlobPath(first.Blob)) {
+		t.Errorf("Expected the download URL to point to the blob, got %s", downloadURL)
+	}
+
+	blobPath := path.Join(storageDir, job.BlobPath(first.Blob))
+	if err := defaultProcessor.releaseBlob(first.Blob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blobPath); err != nil {
+		t.Fatal("Expected the blob to be kept while it is referenced")
+	}
+
+	if err := defaultProcessor.releaseBlob(second.Blob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+		t.Error("Expected the blob to be deleted along with its last reference")
+	}
 }
@@ -3,12 +3,18 @@
 // internal.
 package errors
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // DownloadError is the interface that encapsulate the bahaviour that must be met by any download error.
 type DownloadError interface {
 	IsRetriable() bool
 	IsInternal() bool
+	IsThrottled() bool
+	Phase() string
+	RetryAfter() time.Duration
 	Err() error
 	Error() string
 }
@@ -21,6 +27,11 @@ type downloadError struct {
 	phase     string
 	retriable bool
 	internal  bool
+	throttled bool
+
+	// retryAfter is the minimum time to wait before retrying, as
+	// requested by the origin server
+	retryAfter time.Duration
 }
 
 // Error returns a string created from the downloadError's attributes.
@@ -50,6 +61,32 @@ func (e downloadError) Internal() downloadError {
 	return e
 }
 
+// IsThrottled exposes the current downloadError's throttled attribute.
+func (e downloadError) IsThrottled() bool {
+	return e.throttled
+}
+
+// Throttled returns a retriable copy of the current downloadError, denoting
+// that the origin server throttled the download, that should not be retried
+// before d has passed.
+func (e downloadError) Throttled(d time.Duration) downloadError {
+	e.retriable = true
+	e.throttled = true
+	e.retryAfter = d
+	return e
+}
+
+// RetryAfter returns the minimum time to wait before retrying, or 0 if the
+// current downloadError may be retried at any time.
+func (e downloadError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// Phase returns the download phase in which the current downloadError occured.
+func (e downloadError) Phase() string {
+	return e.phase
+}
+
 // Err returns the raw error wrapped by the current downloadError.
 func (e downloadError) Err() error {
 	return e.err
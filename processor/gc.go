@@ -0,0 +1,260 @@
+package processor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/skroutz/downloader/job"
+)
+
+// gcBatchSize is the number of files whose jobs are looked up in Redis at
+// once by the garbage collector
+const gcBatchSize = 100
+
+// GCResult holds the counts of a garbage collection of the storage
+// directory.
+type GCResult struct {
+	// Number of scanned files
+	Scanned int
+
+	// Number of deleted temporary files of downloads
+	TmpFiles int
+
+	// Number of deleted files without a job and blobs without references
+	Orphans int
+
+	// Number of deleted empty directories
+	Dirs int
+
+	// Size of the deleted files in bytes
+	Bytes int64
+
+	// Number of files and directories that could not be deleted
+	Failures int
+}
+
+// gcFile is a file that is deleted by the garbage collector, unless it is
+// in use.
+type gcFile struct {
+	path string
+	size int64
+
+	// id is the id of the job of the file, or the checksum of the blob
+	id   string
+	blob bool
+}
+
+// CollectGarbage deletes the files in StorageDir that are not needed any
+// more and were last modified before GCGracePeriod:
+//
+// - temporary files of downloads, which are left by crashed processors
+// - files of jobs that neither exist nor are queued for deletion
+// - blobs that are not referenced by any job
+// - empty directories
+//
+// Redis is queried for batches of files, with a pause of GCThrottle after
+// each one. If dryRun is true, the files are only logged and counted.
+func (p *Processor) CollectGarbage(ctx context.Context, dryRun bool) (GCResult, error) {
+	var res GCResult
+	var dirs []string
+	var batch []gcFile
+	deadline := time.Now().Add(-p.GCGracePeriod)
+
+	remove := func(path string, size int64, counter *int) {
+		if dryRun {
+			p.Log.Printf("gc: Would delete [%s]", path)
+		} else if err := os.Remove(path); err != nil {
+			p.Log.Printf("gc: Error deleting [%s]: %s", path, err)
+			res.Failures++
+			return
+		}
+		*counter++
+		res.Bytes += size
+	}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := p.collectBatch(batch, dryRun, &res, remove)
+		batch = batch[:0]
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.GCThrottle):
+			return nil
+		}
+	}
+
+	err := filepath.Walk(p.StorageDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Deleted by the reaper in the meantime
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		rel, err := filepath.Rel(p.StorageDir, path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if rel != "." {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		res.Scanned++
+		if fi.ModTime().After(deadline) {
+			return nil
+		}
+
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		switch {
+		case len(parts) == 1 && strings.HasSuffix(parts[0], tmpFileExt):
+			remove(path, fi.Size(), &res.TmpFiles)
+			return nil
+		case len(parts) == 2 && len(parts[0]) == 3:
+			batch = append(batch, gcFile{path: path, size: fi.Size(), id: parts[1]})
+		case len(parts) == 3 && parts[0] == job.BlobDir:
+			batch = append(batch, gcFile{path: path, size: fi.Size(), id: parts[2], blob: true})
+		default:
+			return nil
+		}
+
+		if len(batch) < gcBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return res, err
+	}
+
+	// Directories are removed after their subdirectories. Files that are
+	// stored concurrently in a removed directory are retried by the local
+	// store.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		f, err := os.Open(dirs[i])
+		if err != nil {
+			continue
+		}
+		_, err = f.Readdirnames(1)
+		f.Close()
+		if err == nil {
+			// The directory is not empty
+			continue
+		}
+		remove(dirs[i], 0, &res.Dirs)
+	}
+
+	return res, nil
+}
+
+// collectBatch removes the files of batch that are not in use, using
+// remove.
+func (p *Processor) collectBatch(batch []gcFile, dryRun bool, res *GCResult, remove func(string, int64, *int)) error {
+	var ids, sums []string
+	for _, f := range batch {
+		if f.blob {
+			sums = append(sums, f.id)
+		} else {
+			ids = append(ids, f.id)
+		}
+	}
+
+	var filesInUse, blobsInUse []bool
+	var err error
+	if len(ids) > 0 {
+		filesInUse, err = p.Storage.FilesInUse(ids)
+		if err != nil {
+			return err
+		}
+	}
+	if len(sums) > 0 {
+		blobsInUse, err = p.Storage.BlobsInUse(sums)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range batch {
+		if !f.blob {
+			inUse := filesInUse[0]
+			filesInUse = filesInUse[1:]
+			if !inUse {
+				remove(f.path, f.size, &res.Orphans)
+			}
+			continue
+		}
+
+		inUse := blobsInUse[0]
+		blobsInUse = blobsInUse[1:]
+		if inUse {
+			continue
+		}
+		if dryRun {
+			remove(f.path, f.size, &res.Orphans)
+			continue
+		}
+
+		// The blob must not be referenced while it is being deleted
+		claimed, err := p.Storage.ClaimBlob(f.id)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		remove(f.path, f.size, &res.Orphans)
+		if err = p.Storage.RemoveBlob(f.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gc collects garbage every GCInterval, until ctx is cancelled.
+func (p *Processor) gc(ctx context.Context) {
+	ticker := time.NewTicker(p.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := p.CollectGarbage(ctx, false)
+			if err != nil && err != context.Canceled {
+				p.Log.Println("gc: Error collecting garbage:", err)
+			}
+			p.stats.Add(statsGCScannedFiles, int64(res.Scanned))
+			p.stats.Add(statsGCTmpFiles, int64(res.TmpFiles))
+			p.stats.Add(statsGCOrphanFiles, int64(res.Orphans))
+			p.stats.Add(statsGCEmptyDirs, int64(res.Dirs))
+			p.stats.Add(statsGCFailures, int64(res.Failures))
+			if res.TmpFiles+res.Orphans+res.Dirs > 0 {
+				p.Log.Printf("gc: Deleted %d temporary files, %d orphan files (%d bytes) and %d empty directories",
+					res.TmpFiles, res.Orphans, res.Bytes, res.Dirs)
+			}
+		}
+	}
+}
@@ -21,6 +21,9 @@ type Validator struct {
 
 	// holds all checks to be done against the bytes written to the buffer
 	checks []Check
+
+	// the mime type detected by the last check
+	mime string
 }
 
 // ErrMimeTypeMismatch is a custom error exposing info on the given failed check.
@@ -62,6 +65,9 @@ func (v *Validator) extractListsFromString(checks string) {
 	v.checks = nil
 	for _, c := range strings.Split(checks, ",") {
 		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
 		if strings.HasPrefix(c, "!") {
 			v.checks = append(v.checks, Check{check: c[1:], negate: true})
 			continue
@@ -90,9 +96,16 @@ func ValidateMimeTypePattern(pattern string) error {
 }
 
 // Reset resets the current validatorby reinitializing all checks based on the given pattern.
+// An empty pattern only detects the mime type, see MimeType().
 func (v *Validator) Reset(expectedMimePattern string) {
 	v.extractListsFromString(expectedMimePattern)
 	v.buffer.Reset()
+	v.mime = ""
+}
+
+// MimeType returns the mime type detected by the last check, if any.
+func (v *Validator) MimeType() string {
+	return v.mime
 }
 
 // Read takes an io.Reader as an argument, tries to read MimeTypeValidationThreshold of input
@@ -122,6 +135,7 @@ func (v *Validator) CheckBuffer(p []byte) error {
 	} else {
 		mime = "application/x-empty"
 	}
+	v.mime = mime
 
 	for _, check := range v.checks {
 		if !check.IsValid(mime) {
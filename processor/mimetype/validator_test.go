@@ -47,6 +47,23 @@ func TestBlacklistOnly(t *testing.T) {
 	}
 }
 
+func TestDetectOnly(t *testing.T) {
+	validator.Reset("")
+
+	in, err := os.Open("../../testdata/load-test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	if err = validator.Read(in); err != nil {
+		t.Fatal(err)
+	}
+	if mime := validator.MimeType(); mime != "image/jpeg" {
+		t.Fatalf("Expected detected mime type to be image/jpeg, found %s", mime)
+	}
+}
+
 func TestMultipleWrites(t *testing.T) {
 	validator.Reset("image/jpeg")
 
@@ -4,8 +4,10 @@
 //
 // Each WorkerPool processes jobs belonging to a single aggregation and is in
 // charge of imposing the corresponding rate-limit rules. Job routing for each
-// Aggregation is performed through a redis list which is popped periodically
-// by each WorkerPool. Popped jobs are then published to the WorkerPool's job
+// Aggregation is performed through a redis list which is popped by each
+// WorkerPool. Worker pools are spawned when jobs are queued for their
+// aggregation, as announced through Redis Pub/Sub, and close once their
+// queue is drained. Popped jobs are then published to the WorkerPool's job
 // channel. worker pools spawn worker goroutines (up to a max concurrency limit
 // set for each aggregation) that consume from the aforementioned job channel
 // and perform the actual download.
@@ -31,10 +33,15 @@ package processor
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"expvar"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
@@ -43,12 +50,13 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/skroutz/downloader/blobstore"
 	"github.com/skroutz/downloader/job"
 	"github.com/skroutz/downloader/processor/diskcheck"
 	derrors "github.com/skroutz/downloader/processor/errors"
@@ -66,8 +74,15 @@ var (
 // TODO: these should all be configuration options provided by the caller
 const (
 	workerMaxInactivity = 5 * time.Second
+	aggrRefreshInterval = 5 * time.Second
 	backoffDuration     = 1 * time.Second
 	maxDownloadRetries  = 3
+	maxThrottles        = 10
+
+	// maxRetryAfter bounds the time for which a Retry-After header may
+	// delay a job and throttle its worker pool, regardless of the retry
+	// policy of the job
+	maxRetryAfter = time.Hour
 
 	//Metric Identifiers
 	statsMaxWorkers                = "maxWorkers"                //Gauge
@@ -81,6 +96,21 @@ const (
 	statsReaperFailures            = "reaperFailures"            //Counter
 	statsReaperSuccessfulDeletions = "reaperSuccessfulDeletions" //Counter
 	statsInvalidProxies            = "invalidProxies"            //Counter
+	statsThrottles                 = "throttles"                 //Counter
+	statsExpiredJobs               = "expiredJobs"               //Counter
+	statsDeduplicatedFiles         = "deduplicatedFiles"         //Counter
+	statsGCScannedFiles            = "gcScannedFiles"            //Counter
+	statsGCTmpFiles                = "gcTmpFiles"                //Counter
+	statsGCOrphanFiles             = "gcOrphanFiles"             //Counter
+	statsGCEmptyDirs               = "gcEmptyDirs"               //Counter
+	statsGCFailures                = "gcFailures"                //Counter
+
+	// Prometheus metrics
+	metricsNamespace = "downloader_processor"
+
+	// maxAggrSeries bounds the number of series of the metrics labelled by
+	// aggregation, since the number of aggregations is unbounded
+	maxAggrSeries = 100
 
 	// diskChecker settings
 	diskHigh     = 95
@@ -88,6 +118,30 @@ const (
 	diskInterval = 1 * time.Minute
 )
 
+// metricDescs describe the metrics of the processor, as exported in the
+// Prometheus format
+var metricDescs = map[string]stats.Desc{
+	statsMaxWorkers:                {Name: "max_workers", Kind: stats.Gauge, Help: "Maximum number of concurrently active workers."},
+	statsMaxWorkerPools:            {Name: "max_worker_pools", Kind: stats.Gauge, Help: "Maximum number of concurrently active worker pools."},
+	statsWorkers:                   {Name: "workers", Kind: stats.Gauge, Help: "Number of active workers."},
+	statsWorkerPools:               {Name: "worker_pools", Kind: stats.Gauge, Help: "Number of active worker pools."},
+	statsSpawnedWorkerPools:        {Name: "spawned_worker_pools_total", Kind: stats.Counter, Help: "Number of spawned worker pools."},
+	statsSpawnedWorkers:            {Name: "spawned_workers_total", Kind: stats.Counter, Help: "Number of spawned workers."},
+	statsFailures:                  {Name: "internal_failures_total", Kind: stats.Counter, Help: "Number of downloads that failed due to internal errors."},
+	statsResponseCodePrefix:        {Name: "download_responses_total", Kind: stats.Counter, Help: "Number of download responses by status code.", Label: "code"},
+	statsReaperFailures:            {Name: "reaper_failures_total", Kind: stats.Counter, Help: "Number of files that could not be deleted."},
+	statsReaperSuccessfulDeletions: {Name: "reaper_deletions_total", Kind: stats.Counter, Help: "Number of deleted files."},
+	statsInvalidProxies:            {Name: "invalid_proxies_total", Kind: stats.Counter, Help: "Number of aggregations with an invalid proxy."},
+	statsThrottles:                 {Name: "throttles_total", Kind: stats.Counter, Help: "Number of times a worker pool was throttled by the origin server."},
+	statsExpiredJobs:               {Name: "expired_jobs_total", Kind: stats.Counter, Help: "Number of jobs that expired before being downloaded."},
+	statsDeduplicatedFiles:         {Name: "deduplicated_files_total", Kind: stats.Counter, Help: "Number of downloaded files whose content was already stored."},
+	statsGCScannedFiles:            {Name: "gc_scanned_files_total", Kind: stats.Counter, Help: "Number of files scanned by the garbage collector."},
+	statsGCTmpFiles:                {Name: "gc_tmp_files_total", Kind: stats.Counter, Help: "Number of stale temporary files deleted by the garbage collector."},
+	statsGCOrphanFiles:             {Name: "gc_orphan_files_total", Kind: stats.Counter, Help: "Number of files without a job deleted by the garbage collector."},
+	statsGCEmptyDirs:               {Name: "gc_empty_dirs_total", Kind: stats.Counter, Help: "Number of empty directories deleted by the garbage collector."},
+	statsGCFailures:                {Name: "gc_failures_total", Kind: stats.Counter, Help: "Number of files that the garbage collector could not delete."},
+}
+
 // Processor is the main entity of the downloader.
 // For more info of its architecture see package level doc.
 type Processor struct {
@@ -101,12 +155,43 @@ type Processor struct {
 	// will be saved.
 	StorageDir string
 
+	// Files is the store in which downloaded files are kept. By default,
+	// they are kept in StorageDir.
+	Files blobstore.Store
+
+	// ContentAddressable denotes whether downloaded files are stored once
+	// per content, as blobs named after their SHA-256 checksum that are
+	// shared by the jobs referencing them. Otherwise, each job has its own
+	// file.
+	ContentAddressable bool
+
+	// GCInterval is the interval between the garbage collections of
+	// StorageDir (see CollectGarbage). Zero disables garbage collection.
+	GCInterval time.Duration
+
+	// GCGracePeriod is the time since their last modification after
+	// which files may be garbage collected
+	GCGracePeriod time.Duration
+
+	// GCThrottle is the pause of the garbage collector after each batch of
+	// files
+	GCThrottle time.Duration
+
 	// The client that will be used for the download requests
 	Client *http.Client
 
 	// The User-Agent to set in download requests
 	UserAgent string
 
+	// RetryPolicy is the retry policy of failed downloads. It can be
+	// overridden per aggregation and per job.
+	RetryPolicy job.RetryPolicy
+
+	// MaxThrottles is the number of times a download may be throttled by
+	// the origin server, with 429 or 503 responses, before its job fails.
+	// Throttled downloads do not count against the retry policy.
+	MaxThrottles int
+
 	Log *log.Logger
 
 	// Interval between each stats flush
@@ -115,22 +200,62 @@ type Processor struct {
 	// pools contain the existing worker pools
 	pools map[string]*workerPool
 
+	// inflight contains the jobs currently being performed
+	inflight *inflightJobs
+
+	// popped contains the jobs that were popped and are not complete yet
+	popped *poppedJobs
+
 	stats *stats.Stats
+
+	// Metrics exposes the metrics of the processor in the Prometheus
+	// format
+	Metrics *stats.Exporter
+
+	downloadDuration *stats.Histogram
+	downloadSize     *stats.Histogram
+}
+
+// inflightJobs tracks the jobs that are currently being performed by the
+// worker pools of a Processor, along with the functions that cancel them.
+type inflightJobs struct {
+	sync.Mutex
+	jobs map[string]context.CancelFunc
+}
+
+// poppedJobs tracks the jobs popped by the worker pools of a Processor that
+// are not complete yet. They occupy aggregation slots and are in flight, so
+// their leases are renewed until they are released.
+type poppedJobs struct {
+	sync.Mutex
+	jobs map[string]job.Job
 }
 
 // workerPool corresponds to an Aggregation. It spawns and instruments the
 // workers that perform the actual downloads and enforces the rate-limit rules
 // of the corresponding Aggregation.
 type workerPool struct {
-	aggr             job.Aggregation
 	p                *Processor
 	numActiveWorkers int32
 	log              *log.Logger
-	client           *http.Client
+
+	// mu guards aggr, client and updated, which are updated when the
+	// aggregation's settings change
+	mu     sync.RWMutex
+	aggr   job.Aggregation
+	client *http.Client
+
+	// updated is closed and replaced whenever the aggregation's settings
+	// change, so that idle workers retire if the limit was decreased
+	updated chan struct{}
 
 	// jobChan is the channel that distributes jobs to the respective
 	// workers
 	jobChan chan job.Job
+
+	// wake signals that jobs were queued or a worker exited, while wp
+	// was waiting
+	wake chan struct{}
 }
 
 func init() {
@@ -167,23 +292,86 @@ func New(storage *storage.Storage, scanInterval int, storageDir string, logger *
 		return Processor{}, errors.New("Error verifying storage directory is writable: " + err.Error())
 	}
 
-	return Processor{
-		Storage:      storage,
-		StorageDir:   storageDir,
-		ScanInterval: scanInterval,
-		StatsIntvl:   5 * time.Second,
-		Log:          logger,
-		pools:        make(map[string]*workerPool),
-		stats:        stats.New("Processor", time.Second, func(m *expvar.Map) {}),
-	}, nil
+	p := Processor{
+		Storage:       storage,
+		StorageDir:    storageDir,
+		Files:         blobstore.NewLocal(storageDir, nil),
+		ScanInterval:  scanInterval,
+		StatsIntvl:    5 * time.Second,
+		GCGracePeriod: 24 * time.Hour,
+		GCThrottle:    100 * time.Millisecond,
+		Log:           logger,
+		pools:         make(map[string]*workerPool),
+		inflight:      &inflightJobs{jobs: make(map[string]context.CancelFunc)},
+		popped:        &poppedJobs{jobs: make(map[string]job.Job)},
+		stats:         stats.New("Processor", time.Second, func(m *expvar.Map) {}),
+		MaxThrottles:  maxThrottles,
+		RetryPolicy: job.RetryPolicy{
+			MaxAttempts: maxDownloadRetries,
+			BaseDelay:   RetryBackoffDuration,
+			Multiplier:  2,
+		},
+	}
+	p.initMetrics()
+
+	return p, nil
+}
+
+// initMetrics initializes the Prometheus metrics of p.
+func (p *Processor) initMetrics() {
+	p.Metrics = stats.NewExporter("Processor", metricsNamespace)
+	for key, d := range metricDescs {
+		p.Metrics.Describe(key, d)
+	}
+
+	p.downloadDuration = p.Metrics.Histogram(stats.Desc{
+		Name:      "download_duration_seconds",
+		Help:      "Duration of download attempts by aggregation.",
+		Label:     "aggregation",
+		MaxSeries: maxAggrSeries,
+	}, []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300})
+
+	p.downloadSize = p.Metrics.Histogram(stats.Desc{
+		Name:      "download_size_bytes",
+		Help:      "Size of successfully downloaded files by aggregation.",
+		Label:     "aggregation",
+		MaxSeries: maxAggrSeries,
+	}, []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30})
+
+	s := p.Storage
+	p.Metrics.GaugeFunc(stats.Desc{
+		Name:      "queue_depth",
+		Help:      "Number of queued jobs by aggregation.",
+		Label:     "aggregation",
+		MaxSeries: maxAggrSeries,
+	}, func() (map[string]float64, error) {
+		depths, err := s.QueueDepths()
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]float64, len(depths))
+		for aggr, n := range depths {
+			values[aggr] = float64(n)
+		}
+		return values, nil
+	})
 }
 
 // Start starts p.
 //
-// It spawns helpers goroutines & starts spawning worker pools by scanning Redis for new Aggregations
+// It spawns helpers goroutines & starts spawning worker pools for the
+// aggregations that have queued jobs
 func (p *Processor) Start(closeCh chan struct{}) {
 	p.Log.Println("Starting...")
-	p.collectRogueDownloads()
+
+	// Check Redis for downloads left in flight by dead processors
+	p.requeueExpired()
+
+	if n, err := p.Storage.IndexActiveAggregations(); err != nil {
+		p.Log.Println("Error indexing active aggregations:", err)
+	} else if n > 0 {
+		p.Log.Printf("Indexed %d active aggregations", n)
+	}
 
 	ctx, cancel := context.WithCancel(context.TODO())
 
@@ -194,6 +382,26 @@ func (p *Processor) Start(closeCh chan struct{}) {
 		p.reaper(ctx)
 	}()
 
+	processorWg.Add(1)
+	go func() {
+		defer processorWg.Done()
+		p.watchCancellations(ctx)
+	}()
+
+	processorWg.Add(1)
+	go func() {
+		defer processorWg.Done()
+		p.heartbeat(ctx)
+	}()
+
+	if p.GCInterval > 0 {
+		processorWg.Add(1)
+		go func() {
+			defer processorWg.Done()
+			p.gc(ctx)
+		}()
+	}
+
 	p.stats = stats.New("Processor", p.StatsIntvl,
 		func(m *expvar.Map) {
 			err := p.Storage.SetStats("processor", m.String(), 2*p.StatsIntvl) // Autoremove stats after 2 times the interval
@@ -254,14 +462,80 @@ PROCESSOR_LOOP:
 
 // spawnPools spawns & monitors worker pools. When ctx is done, it forcibly stops all workers,
 // cleanups the pools map & waits for all goroutines to finish.
+//
+// Worker pools are spawned as soon as jobs are queued for their aggregation,
+// as announced on storage.JobsChannel. The set of active aggregations is
+// also checked every ScanInterval seconds, in case an announcement was
+// missed (e.g. while reconnecting to Redis).
 func (p *Processor) spawnPools(ctx context.Context) {
 	workerClose := make(chan string)
 	var poolWg sync.WaitGroup
 	scanTicker := time.NewTicker(time.Duration(p.ScanInterval) * time.Second)
 	defer scanTicker.Stop()
 
+	// Subscribe before checking the active aggregations, so that no
+	// announcement is lost in between
+	pubsub := p.Storage.Redis.Subscribe(storage.JobsChannel)
+	defer pubsub.Close()
+	announcements := pubsub.Channel()
+
 	maxWorkerPools := new(expvar.Int)
 
+	spawn := func(aggrID string) {
+		aggr, err := p.Storage.GetAggregation(aggrID)
+		if err != nil {
+			p.Log.Printf("Error fetching aggregation with id '%s': %s",
+				aggrID, err)
+			if err != storage.ErrNotFound {
+				return
+			}
+			p.Log.Printf("Using aggregation with id '%s', and limit: %d",
+				aggr.ID, aggr.Limit)
+		}
+		if aggr.Paused {
+			return
+		}
+		wp, err := p.newWorkerPool(*aggr)
+		if err != nil {
+			p.Log.Printf("Error fetching aggregation with proxy '%s': %s", aggrID, err)
+			p.stats.Add(statsInvalidProxies, 1)
+			return
+		}
+		p.pools[aggrID] = &wp
+
+		//Report Metrics
+		p.stats.Add(statsWorkerPools, 1)
+		p.stats.Add(statsSpawnedWorkerPools, 1)
+		if pools := int64(len(p.pools)); maxWorkerPools.Value() < pools {
+			maxWorkerPools.Set(pools)
+			p.stats.Set(statsMaxWorkerPools, maxWorkerPools)
+		}
+
+		poolWg.Add(1)
+		go func() {
+			defer poolWg.Done()
+			wp.start(ctx, p.StorageDir)
+			// The processor only needs to be informed about non-forced close ( without context-cancel )
+			if ctx.Err() == nil {
+				workerClose <- aggrID
+			}
+		}()
+	}
+
+	scan := func() {
+		ids, err := p.Storage.GetActiveAggregations()
+		if err != nil {
+			p.Log.Println("Error fetching active aggregations:", err)
+			return
+		}
+		for _, aggrID := range ids {
+			if _, ok := p.pools[aggrID]; !ok {
+				spawn(aggrID)
+			}
+		}
+	}
+	scan()
+
 POOLS_LOOP:
 	for {
 		select {
@@ -269,68 +543,33 @@ POOLS_LOOP:
 		case aggrID := <-workerClose:
 			delete(p.pools, aggrID)
 			p.stats.Add(statsWorkerPools, -1)
+
+			// Jobs may have been queued while the pool was closing, in
+			// which case the aggregation is still active
+			active, err := p.Storage.IsActiveAggregation(aggrID)
+			if err != nil {
+				p.Log.Printf("Error checking aggregation with id '%s': %s", aggrID, err)
+			} else if active {
+				spawn(aggrID)
+			}
 		// Close signal from upper layer
 		//
 		// Note that we don't have to explicitly cancel the spawned worker pools
 		// since they share the same context.
 		case <-ctx.Done():
 			break POOLS_LOOP
-		case <-scanTicker.C:
-			var cursor uint64
-			for {
-				var keys []string
-				var err error
-				keys, cursor, err = p.Storage.Redis.Scan(cursor, storage.JobsKeyPrefix+"*", 50).Result()
-				if err != nil {
-					p.Log.Println(fmt.Errorf("Error scanning keys: %v", err))
-					break
-				}
-
-				for _, ag := range keys {
-					aggrID := strings.TrimPrefix(ag, storage.JobsKeyPrefix)
-					if _, ok := p.pools[aggrID]; !ok {
-						aggr, err := p.Storage.GetAggregation(aggrID)
-						if err != nil {
-							p.Log.Printf("Error fetching aggregation with id '%s': %s",
-								aggrID, err)
-							if err != storage.ErrNotFound {
-								continue
-							}
-							p.Log.Printf("Using aggregation with id '%s', and limit: %d",
-								aggr.ID, aggr.Limit)
-						}
-						wp, err := p.newWorkerPool(*aggr)
-						if err != nil {
-							p.Log.Printf("Error fetching aggregation with proxy '%s': %s", aggrID, err)
-							p.stats.Add(statsInvalidProxies, 1)
-							continue
-						}
-						p.pools[aggrID] = &wp
-
-						//Report Metrics
-						p.stats.Add(statsWorkerPools, 1)
-						p.stats.Add(statsSpawnedWorkerPools, 1)
-						if pools := int64(len(p.pools)); maxWorkerPools.Value() < pools {
-							maxWorkerPools.Set(pools)
-							p.stats.Set(statsMaxWorkerPools, maxWorkerPools)
-						}
-
-						poolWg.Add(1)
-						go func() {
-							defer poolWg.Done()
-							wp.start(ctx, p.StorageDir)
-							// The processor only needs to be informed about non-forced close ( without context-cancel )
-							if ctx.Err() == nil {
-								workerClose <- wp.aggr.ID
-							}
-						}()
-					}
-				}
-
-				if cursor == 0 {
-					break
-				}
+		case msg, ok := <-announcements:
+			if !ok {
+				announcements = nil
+				continue
+			}
+			if wp, ok := p.pools[msg.Payload]; ok {
+				wp.notify()
+			} else {
+				spawn(msg.Payload)
 			}
+		case <-scanTicker.C:
+			scan()
 		}
 	}
 
@@ -345,57 +584,164 @@ func (p *Processor) storagePath(j *job.Job) string {
 	return path.Join(p.StorageDir, j.Path())
 }
 
+// minSegmentSize is the minimum size of each segment of a segmented download
+var minSegmentSize int64 = 4 << 20
+
 const tmpFileExt = ".tmp"
 
 func (p *Processor) tmpStoragePath(j *job.Job) string {
 	return path.Join(p.StorageDir, j.ID+tmpFileExt)
 }
 
-// collectRogueDownloads Scans Redis for jobs that have InProgress DownloadState.
-// This indicates they are leftover from an interrupted previous run and should get requeued.
-func (p *Processor) collectRogueDownloads() {
-	var cursor uint64
-	var rogueCount uint64
+// watchCancellations listens for job cancellation requests and cancels the
+// corresponding downloads, if they are currently performed by p.
+func (p *Processor) watchCancellations(ctx context.Context) {
+	pubsub := p.Storage.Redis.Subscribe(storage.CancellationChannel)
+	defer pubsub.Close()
 
-	for {
-		var keys []string
-		var err error
-		keys, cursor, err = p.Storage.Redis.Scan(cursor, storage.JobKeyPrefix+"*", 50).Result()
-		if err != nil {
-			p.Log.Println("Error scanning Redis for rogue downloads:", err)
-			break
-		}
+	// Cancellations requested before the subscription is active are not
+	// received, so they are polled once it is
+	if _, err := pubsub.Receive(); err != nil {
+		p.Log.Println("Error subscribing to cancellations:", err)
+	}
+	p.pollCancellations()
 
-		for _, jobID := range keys {
-			strCmd := p.Storage.Redis.HGet(jobID, "DownloadState")
-			if strCmd.Err() != nil {
-				p.Log.Println(strCmd.Err())
-				continue
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
 			}
-			if job.State(strCmd.Val()) == job.StateInProgress {
-				jb, err := p.Storage.GetJob(strings.TrimPrefix(jobID, storage.JobKeyPrefix))
-				if err != nil {
-					p.Log.Printf("Error fetching job with id '%s' from Redis: %s", jobID, err)
-					continue
-				}
-				err = p.Storage.QueuePendingDownload(&jb, 0)
-				if err != nil {
-					p.Log.Printf("Error queueing job with id '%s' for download: %s", jb.ID, err)
-					continue
-				}
-				rogueCount++
+			if p.inflight.cancel(msg.Payload) {
+				p.Log.Printf("Cancelling in-progress download of job %s", msg.Payload)
 			}
 		}
+	}
+}
 
-		if cursor == 0 {
-			break
+// pollCancellations cancels the in-progress downloads of p whose
+// cancellation was requested. Cancellations are normally received by
+// watchCancellations, but messages published while p is not subscribed,
+// e.g. while it reconnects to Redis, are lost.
+func (p *Processor) pollCancellations() {
+	ids := p.inflight.ids()
+	if len(ids) == 0 {
+		return
+	}
+
+	requested, err := p.Storage.CancellationsRequested(ids)
+	if err != nil {
+		p.Log.Println("Error polling cancellations:", err)
+		return
+	}
+	for i, id := range ids {
+		if requested[i] && p.inflight.cancel(id) {
+			p.Log.Printf("Cancelling in-progress download of job %s", id)
 		}
 	}
+}
+
+// heartbeat periodically renews the leases of the jobs popped by p, so that
+// their aggregation slots are not freed and they are not requeued while
+// being performed. It also requeues the in-flight downloads of all
+// processors whose deadline expired, e.g. because their processor died,
+// and cancels the in-progress downloads whose cancellation message was lost.
+// Popped jobs that are not yet in progress are checked when performed.
+func (p *Processor) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(storage.SlotTTL / 3)
+	defer ticker.Stop()
 
-	if rogueCount > 0 {
-		p.Log.Printf("Queued %d rogue downloads", rogueCount)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := p.Storage.RenewDownloads(p.popped.list())
+			if err != nil {
+				p.Log.Println("Error renewing popped jobs:", err)
+			}
+			p.requeueExpired()
+			p.pollCancellations()
+		}
 	}
+}
 
+// requeueExpired requeues the in-flight downloads whose deadline expired.
+func (p *Processor) requeueExpired() {
+	n, err := p.Storage.RequeueExpiredDownloads()
+	if err != nil {
+		p.Log.Println("Error requeueing expired downloads:", err)
+	} else if n > 0 {
+		p.Log.Printf("Requeued %d expired downloads", n)
+	}
+}
+
+// add registers j as popped.
+func (h *poppedJobs) add(j *job.Job) {
+	h.Lock()
+	defer h.Unlock()
+	h.jobs[j.ID] = job.Job{ID: j.ID, AggrID: j.AggrID}
+}
+
+// remove unregisters j and reports whether it was registered.
+func (h *poppedJobs) remove(j *job.Job) bool {
+	h.Lock()
+	defer h.Unlock()
+	_, ok := h.jobs[j.ID]
+	delete(h.jobs, j.ID)
+	return ok
+}
+
+// list returns the popped jobs.
+func (h *poppedJobs) list() []*job.Job {
+	h.Lock()
+	defer h.Unlock()
+	jobs := make([]*job.Job, 0, len(h.jobs))
+	for _, j := range h.jobs {
+		j := j
+		jobs = append(jobs, &j)
+	}
+	return jobs
+}
+
+// add registers the job with the given id along with the function that
+// cancels it.
+func (f *inflightJobs) add(id string, cancel context.CancelFunc) {
+	f.Lock()
+	defer f.Unlock()
+	f.jobs[id] = cancel
+}
+
+// remove unregisters the job with the given id.
+func (f *inflightJobs) remove(id string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.jobs, id)
+}
+
+// ids returns the ids of the registered jobs.
+func (f *inflightJobs) ids() []string {
+	f.Lock()
+	defer f.Unlock()
+	ids := make([]string, 0, len(f.jobs))
+	for id := range f.jobs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// cancel cancels the job with the given id and reports whether it was found.
+func (f *inflightJobs) cancel(id string) bool {
+	f.Lock()
+	defer f.Unlock()
+	cancel, ok := f.jobs[id]
+	if ok {
+		cancel()
+	}
+	return ok
 }
 
 // newWorkerPool initializes and returns a WorkerPool for aggr.
@@ -408,13 +754,24 @@ func (p *Processor) newWorkerPool(aggr job.Aggregation) (workerPool, error) {
 	}
 	return workerPool{
 		aggr:    aggr,
+		updated: make(chan struct{}),
 		jobChan: make(chan job.Job),
+		wake:    make(chan struct{}, 1),
 		p:       p,
 		log:     log.New(os.Stderr, logPrefix, log.Ldate|log.Ltime),
 		client:  client,
 	}, nil
 }
 
+// notify wakes wp up, if it is waiting for jobs to be queued or for its
+// workers to exit. It never blocks.
+func (wp *workerPool) notify() {
+	select {
+	case wp.wake <- struct{}{}:
+	default:
+	}
+}
+
 // increaseWorkers atomically increases the activeWorkers counter of wp by 1
 func (wp *workerPool) increaseWorkers() {
 	atomic.AddInt32(&wp.numActiveWorkers, 1)
@@ -446,13 +803,131 @@ func (wp *workerPool) decreaseWorkers() {
 	atomic.AddInt32(&wp.numActiveWorkers, -1)
 }
 
+// throttle stops the jobs of the aggregation of wp from being popped by any
+// processor for d, unless it is already throttled for longer.
+func (wp *workerPool) throttle(d time.Duration) {
+	ok, err := wp.p.Storage.ThrottleAggregation(wp.aggregation().ID, d)
+	if err != nil {
+		wp.log.Println("Error throttling aggregation:", err)
+		return
+	}
+	if ok {
+		wp.log.Printf("Throttling for %s...", d)
+		wp.p.stats.Add(statsThrottles, 1)
+	}
+}
+
+// waitForToken blocks until a token is taken from the rate limit of the
+// aggregation of wp, or ctx is cancelled. It reports whether a token was
+// taken. If the aggregation has no rate limit, it returns immediately.
+func (wp *workerPool) waitForToken(ctx context.Context) bool {
+	for {
+		aggr := wp.aggregation()
+		if aggr.Rate <= 0 {
+			return true
+		}
+
+		wait, err := wp.p.Storage.TakeToken(&aggr)
+		if err != nil {
+			wp.log.Println("Error taking rate limit token:", err)
+			wait = backoffDuration
+		} else if wait == 0 {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+	}
+}
+
+// retire atomically decreases the activeWorkers counter of wp by 1, if it
+// exceeds the limit of the aggregation. It reports whether the counter was
+// decreased, in which case the calling worker must exit.
+func (wp *workerPool) retire() bool {
+	limit := int32(wp.aggregation().Limit)
+	for {
+		n := atomic.LoadInt32(&wp.numActiveWorkers)
+		if n <= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&wp.numActiveWorkers, n, n-1) {
+			wp.p.stats.Add(statsWorkers, -1)
+			return true
+		}
+	}
+}
+
+// aggregation returns the current settings of the aggregation of wp.
+func (wp *workerPool) aggregation() job.Aggregation {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	return wp.aggr
+}
+
+// updates returns a channel that is closed when the aggregation's settings
+// change.
+func (wp *workerPool) updates() <-chan struct{} {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	return wp.updated
+}
+
+// httpClient returns the client that performs the download requests of wp.
+func (wp *workerPool) httpClient() *http.Client {
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	return wp.client
+}
+
+// refresh fetches the settings of the aggregation of wp from Redis and
+// applies them. The HTTP client of wp is rebuilt if the proxy has changed.
+// If the settings cannot be fetched, the current ones are kept.
+func (wp *workerPool) refresh() {
+	cur := wp.aggregation()
+
+	aggr, err := wp.p.Storage.GetAggregation(cur.ID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			wp.log.Println("Error refreshing aggregation:", err)
+		}
+		return
+	}
+	if *aggr == cur {
+		return
+	}
+
+	client := wp.httpClient()
+	if aggr.Proxy != cur.Proxy {
+		client, err = getClient(aggr.Proxy)
+		if err != nil {
+			wp.log.Printf("Error updating aggregation with proxy '%s': %s", aggr.Proxy, err)
+			wp.p.stats.Add(statsInvalidProxies, 1)
+			aggr.Proxy = cur.Proxy
+			client = wp.httpClient()
+		}
+	}
+
+	wp.log.Printf("Aggregation updated (limit:%d, proxy:%s, rate:%g)", aggr.Limit, aggr.Proxy, aggr.Rate)
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.aggr = *aggr
+	wp.client = client
+	close(wp.updated)
+	wp.updated = make(chan struct{})
+}
+
 // activeWorkers return the number of existing active workers in wp.
 func (wp *workerPool) activeWorkers() int {
 	return int(atomic.LoadInt32(&wp.numActiveWorkers))
 }
 
 // start starts wp. It is the core WorkerPool work loop. It can be stopped by
-// using ctx.
+// using ctx. It also stops when the aggregation of wp is paused, after the
+// jobs that are being performed are complete.
 //
 // All worker instrumentation, job popping from Redis and shutdown logic is
 // performed in start.
@@ -463,6 +938,20 @@ func (wp *workerPool) start(ctx context.Context, storageDir string) {
 	downloads := 0
 
 	var wg sync.WaitGroup
+	spawnWorker := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wp.increaseWorkers()
+			if !wp.work(ctx, storageDir) {
+				wp.decreaseWorkers()
+			}
+			wp.notify()
+		}()
+	}
+
+	refreshTicker := time.NewTicker(aggrRefreshInterval)
+	defer refreshTicker.Stop()
 
 WORKERPOOL_LOOP:
 	for {
@@ -470,8 +959,16 @@ WORKERPOOL_LOOP:
 		case <-ctx.Done():
 			wp.log.Printf("Received shutdown signal...")
 			break WORKERPOOL_LOOP
+		case <-refreshTicker.C:
+			wp.refresh()
 		default:
-			job, err := wp.p.Storage.PopJob(&wp.aggr)
+			if wp.aggregation().Paused {
+				wp.log.Println("Closing since the aggregation was paused...")
+				break WORKERPOOL_LOOP
+			}
+
+			aggr := wp.aggregation()
+			job, err := wp.p.Storage.PopJob(&aggr)
 			if err != nil {
 				switch err {
 				case storage.ErrEmptyQueue:
@@ -482,31 +979,71 @@ WORKERPOOL_LOOP:
 						wp.log.Println("Closing due to inactivity...")
 						break WORKERPOOL_LOOP
 					}
-				case storage.ErrRetryLater:
+				case storage.ErrThrottled:
+					// The origin server requested that no
+					// downloads are performed for a while
+					d, err := wp.p.Storage.AggregationThrottled(aggr.ID)
+					if err != nil {
+						wp.log.Println("Error fetching throttle from Redis:", err)
+						d = backoffDuration
+					}
+					select {
+					case <-ctx.Done():
+					case <-time.After(d):
+					}
+					continue
+				case storage.ErrRetryLater, storage.ErrNoSlot:
 					// noop
 				default:
 					wp.log.Println("Error popping job from Redis:", err)
 				}
 
-				// backoff & wait for workers to finish or a job to be queued
-				time.Sleep(backoffDuration)
+				// backoff & wait for workers to finish, a job to be
+				// queued or a slot to be freed
+				select {
+				case <-ctx.Done():
+				case <-wp.wake:
+				case <-time.After(backoffDuration):
+				}
 				continue
 			}
-			if wp.activeWorkers() < wp.aggr.Limit {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					defer wp.decreaseWorkers()
-					wp.increaseWorkers()
-					wp.work(ctx, storageDir)
-				}()
+
+			wp.p.popped.add(&job)
+
+			if !wp.waitForToken(ctx) {
+				// We are shutting down, put the job back in the queue
+				wp.p.popped.remove(&job)
+				if err = wp.p.Storage.QueuePendingDownload(&job, 0); err != nil {
+					wp.log.Printf("Error requeueing %s: %s", job, err)
+				}
+				wp.notify()
+				continue
+			}
+
+			if wp.activeWorkers() < wp.aggregation().Limit {
+				spawnWorker()
+			}
+
+			// Keep picking up changes of the aggregation's settings while
+			// all workers are busy, so that an increased limit takes
+			// effect immediately
+		DISPATCH_LOOP:
+			for {
+				select {
+				case wp.jobChan <- job:
+					break DISPATCH_LOOP
+				case <-refreshTicker.C:
+					wp.refresh()
+					if wp.activeWorkers() < wp.aggregation().Limit {
+						spawnWorker()
+					}
+				}
 			}
-			wp.jobChan <- job
 			downloads++
 		}
 	}
 
-	err := wp.p.Storage.RemoveAggregation(wp.aggr.ID)
+	err := wp.p.Storage.RemoveAggregation(wp.aggregation().ID)
 	if err != nil {
 		wp.log.Printf("Error removing aggregation: %s", err)
 	}
@@ -518,37 +1055,113 @@ WORKERPOOL_LOOP:
 	wp.log.Printf("Bye! (lifetime:%s,downloads:%d)", lifetime, downloads)
 }
 
-// work consumes Jobs from wp and performs them.
-func (wp *workerPool) work(ctx context.Context, saveDir string) {
-	lastActive := time.Now()
+// work consumes Jobs from wp and performs them. It reports whether the
+// worker retired because wp exceeded the limit of its aggregation, in which
+// case the worker is no longer counted as active.
+func (wp *workerPool) work(ctx context.Context, saveDir string) bool {
+	inactivity := time.NewTimer(workerMaxInactivity)
+	defer inactivity.Stop()
 
 	//initialize a validator to be used by the current worker
 	validator, err := mimetype.New()
 	if err != nil {
 		wp.log.Println("Error: Could not create new validator", err)
-		return
+		return false
 	}
 
 	defer validator.Close()
 
 	for {
+		if wp.retire() {
+			return true
+		}
+
 		select {
 		case job, ok := <-wp.jobChan:
 			if !ok {
-				return
+				return false
 			}
 
 			wp.perform(ctx, &job, validator)
-			lastActive = time.Now()
-		default:
-			if time.Since(lastActive) > workerMaxInactivity {
-				return
+			wp.release(&job)
+
+			if !inactivity.Stop() {
+				<-inactivity.C
 			}
+			inactivity.Reset(workerMaxInactivity)
+		case <-wp.updates():
+			// The limit may have been decreased
+		case <-inactivity.C:
+			return false
+		}
+	}
+}
+
+// release frees the aggregation slot occupied by j and marks it as no
+// longer in flight, unless j was requeued in the meantime. Requeued jobs
+// are released by storage.QueuePendingDownload, since they may be popped
+// again right away.
+func (wp *workerPool) release(j *job.Job) {
+	if !wp.p.popped.remove(j) {
+		return
+	}
+	if err := wp.p.Storage.ReleaseDownload(j); err != nil {
+		wp.log.Printf("Error releasing %s: %s", j, err)
+	}
+	wp.notify()
+}
+
+// retryAfter returns the time to wait before retrying j, according to the
+// Retry-After header of resp. If the header is missing, 429 responses are
+// retried after the base delay of the retry policy of j. The returned
+// duration never exceeds the maximum delay of the policy, if any, nor
+// maxRetryAfter.
+func (wp *workerPool) retryAfter(j *job.Job, resp *http.Response) time.Duration {
+	policy := wp.retryPolicy(j)
+
+	d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok && resp.StatusCode == http.StatusTooManyRequests {
+		d = policy.BaseDelay
+	}
+	if policy.MaxDelay > 0 && d > policy.MaxDelay {
+		d = policy.MaxDelay
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP-date, relative to now, bounded by
+// maxRetryAfter. It reports whether v was valid.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
 
-			// No job found, backing off
-			time.Sleep(backoffDuration)
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
 		}
+		if secs > int64(maxRetryAfter/time.Second) {
+			return maxRetryAfter, true
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
 	}
+	d := t.Sub(now)
+	if d > maxRetryAfter {
+		return maxRetryAfter, true
+	} else if d > 0 {
+		return d, true
+	}
+	return 0, true
 }
 
 func (wp *workerPool) download(ctx context.Context, j *job.Job, validator *mimetype.Validator) derrors.DownloadError {
@@ -558,10 +1171,22 @@ func (wp *workerPool) download(ctx context.Context, j *job.Job, validator *mimet
 		return derrors.E("creating request", err)
 	}
 
-	if j.UserAgent != "" {
-		req.Header.Set("User-Agent", j.UserAgent)
-	} else if wp.p.UserAgent != "" {
-		req.Header.Set("User-Agent", wp.p.UserAgent)
+	wp.setUserAgent(req, j)
+
+	j.NotModified = false
+	j.Checksums = job.Checksums{}
+	j.Metadata = job.Metadata{}
+	var cached job.Validators
+	var conditional bool
+	offset := wp.resumeOffset(j)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", j.ResumeValidator)
+	} else {
+		cached, conditional, err = wp.setConditionalHeaders(ctx, req, j)
+		if err != nil {
+			return derrors.E("fetching cache validators", err).Internal().Retriable()
+		}
 	}
 
 	// DownloadTimeout might be different than zero in case Job has been initalized
@@ -573,7 +1198,7 @@ func (wp *workerPool) download(ctx context.Context, j *job.Job, validator *mimet
 		defer cancel()
 	}
 
-	resp, err := wp.client.Do(req.WithContext(ctx))
+	resp, err := wp.httpClient().Do(req.WithContext(ctx))
 	if err != nil {
 		if strings.Contains(err.Error(), "x509") || strings.Contains(err.Error(), "tls") {
 			wp.p.stats.Add(fmt.Sprintf("%s%s", statsResponseCodePrefix, "tls"), 1)
@@ -584,27 +1209,87 @@ func (wp *workerPool) download(ctx context.Context, j *job.Job, validator *mimet
 	defer resp.Body.Close()
 
 	j.ResponseCode = resp.StatusCode
+	j.Metadata.ContentType = resp.Header.Get("Content-Type")
+	j.Metadata.FinalURL = resp.Request.URL.String()
+	j.Metadata.Headers = job.NewResponseHeaders(resp.Header)
 	wp.p.stats.Add(fmt.Sprintf("%s%d", statsResponseCodePrefix, resp.StatusCode), 1)
 
-	if resp.StatusCode >= http.StatusInternalServerError {
+	if resp.StatusCode == http.StatusNotModified && conditional {
+		return wp.reuseUnmodified(ctx, j, cached, resp)
+	}
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 {
+		// The partial download cannot be resumed, so the next attempt
+		// should start over
+		j.ResumeValidator = ""
+		wp.removeTmpFile(j)
+		return derrors.Errorf("resuming download", "Received status code %s", resp.Status).Internal().Retriable()
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		return derrors.Errorf("processing response", "Received status code %s", resp.Status).
+			Throttled(wp.retryAfter(j, resp))
+	} else if resp.StatusCode >= http.StatusInternalServerError {
 		return derrors.Errorf("processing response", "Received status code %s", resp.Status).Retriable()
 	} else if resp.StatusCode >= http.StatusBadRequest {
 		return derrors.Errorf("processing response", "Received status code %s", resp.Status)
 	}
 
-	out, err := os.Create(wp.p.tmpStoragePath(j))
+	// Servers that do not support ranges, or whose resource changed since
+	// the partial download, respond with the whole resource instead
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 && resp.StatusCode == http.StatusPartialContent {
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			j.ResumeValidator = ""
+			wp.removeTmpFile(j)
+			return derrors.Errorf("resuming download", "Unexpected Content-Range '%s' for offset %d",
+				resp.Header.Get("Content-Range"), offset).Internal().Retriable()
+		}
+		flags = os.O_WRONLY | os.O_APPEND
+	} else {
+		offset = 0
+	}
+	j.ResumeValidator = resumeValidator(resp)
+
+	out, err := os.OpenFile(wp.p.tmpStoragePath(j), flags, 0666)
 	if err != nil {
 		return derrors.E("creating tmp file", err).Internal().Retriable()
 	}
 	defer out.Close()
 
-	if j.MimeType != "" {
+	// The checksums are computed while the body is written to disk
+	sums := newChecksummer(j.HashAlgorithms())
+	w := io.MultiWriter(out, sums)
+
+	// The head of a resumed download was already written by the previous
+	// attempts
+	var partial io.Reader
+	if offset > 0 {
+		f, err := os.Open(out.Name())
+		if err != nil {
+			return derrors.E("reading tmp file", err).Internal().Retriable()
+		}
+		defer f.Close()
+		if _, err = io.Copy(sums, io.NewSectionReader(f, 0, offset)); err != nil {
+			return derrors.E("reading tmp file", err).Internal().Retriable()
+		}
+		partial = io.NewSectionReader(f, 0, offset)
+	}
+
+	if j.MimeType != "" || j.IncludeMetadata {
 		if validator == nil {
 			panic("No available mime type validator")
 		}
 
+		var head io.Reader = io.TeeReader(resp.Body, w)
+		if partial != nil {
+			head = io.MultiReader(partial, head)
+		}
+
 		validator.Reset(j.MimeType)
-		if err = validator.Read(io.TeeReader(resp.Body, out)); err != nil {
+		err = validator.Read(head)
+		j.Metadata.MimeType = validator.MimeType()
+		if err != nil {
 			if _, ok := err.(mimetype.ErrMimeTypeMismatch); ok {
 				wp.p.stats.Add(fmt.Sprintf("%s%s", statsResponseCodePrefix, "mime"), 1)
 				return derrors.E("validating mime type", err)
@@ -614,7 +1299,14 @@ func (wp *workerPool) download(ctx context.Context, j *job.Job, validator *mimet
 		}
 	}
 
-	if _, err = io.Copy(out, resp.Body); err != nil {
+	segmented := false
+	if n := wp.segments(j); n > 1 && offset == 0 && resp.StatusCode == http.StatusOK {
+		segmented = true
+		if de := wp.downloadSegments(ctx, j, resp, out, n); de != nil {
+			wp.p.stats.Add(fmt.Sprintf("%s%s", statsResponseCodePrefix, "body"), 1)
+			return de
+		}
+	} else if _, err = io.Copy(w, resp.Body); err != nil {
 		wp.p.stats.Add(fmt.Sprintf("%s%s", statsResponseCodePrefix, "body"), 1)
 		return derrors.E("downloading file", err).Retriable()
 	}
@@ -623,22 +1315,525 @@ func (wp *workerPool) download(ctx context.Context, j *job.Job, validator *mimet
 		return derrors.E("syncing to disk", err).Internal().Retriable()
 	}
 
-	path := wp.p.storagePath(j)
-	if err = os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
-		return derrors.E("creating download directory", err).Internal().Retriable()
+	if segmented {
+		// The segments were written out of order, so the checksums are
+		// computed from the whole file
+		f, err := os.Open(out.Name())
+		if err != nil {
+			return derrors.E("reading tmp file", err).Internal().Retriable()
+		}
+		defer f.Close()
+		if de := wp.checkFile(j, f); de != nil {
+			return de
+		}
+	} else {
+		fi, err := out.Stat()
+		if err != nil {
+			return derrors.E("reading tmp file", err).Internal().Retriable()
+		}
+		j.Metadata.Size = fi.Size()
+		j.Checksums = sums.checksums()
+		if de := wp.verifyChecksum(j); de != nil {
+			return de
+		}
+	}
+
+	if wp.p.ContentAddressable {
+		if de := wp.storeBlob(ctx, j, out.Name()); de != nil {
+			return de
+		}
+	} else if err = blobstore.PutFile(ctx, wp.p.Files, j.Path(), out.Name()); err != nil {
+		return derrors.E("moving file to perm location", err).Internal().Retriable()
+	}
+	j.ResumeValidator = ""
+
+	wp.saveValidators(j, job.Validators{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		JobID:        j.ID,
+		Blob:         j.Blob,
+	})
+	return nil
+}
+
+// storeBlob makes j reference the blob with the contents of the downloaded
+// file at tmpPath, which is put into the store as the blob, unless the blob
+// is already stored.
+func (wp *workerPool) storeBlob(ctx context.Context, j *job.Job, tmpPath string) derrors.DownloadError {
+	sum := j.Checksums.SHA256
+	if _, err := wp.p.Storage.AcquireBlob(sum); err != nil {
+		// A blob that is being deleted is stored again by the next attempt
+		return derrors.E("referencing blob", err).Internal().Retriable()
+	}
+
+	_, err := wp.p.Files.Stat(ctx, job.BlobPath(sum))
+	if err == nil {
+		wp.p.stats.Add(statsDeduplicatedFiles, 1)
+		if err = os.Remove(tmpPath); err != nil {
+			wp.log.Printf("download: Error deleting temp file %s, %s, %s", tmpPath, j, err)
+		}
+		j.Blob = sum
+		return nil
 	}
 
-	if err = os.Rename(out.Name(), path); err != nil {
+	if err == blobstore.ErrNotExist {
+		err = blobstore.PutFile(ctx, wp.p.Files, job.BlobPath(sum), tmpPath)
+	}
+	if err != nil {
+		if rerr := wp.p.releaseBlob(sum); rerr != nil {
+			wp.log.Printf("download: Error releasing blob %s of %s: %s", sum, j, rerr)
+		}
 		return derrors.E("moving file to perm location", err).Internal().Retriable()
 	}
+	j.Blob = sum
+	return nil
+}
+
+// setUserAgent sets the User-Agent header of req, a download request of j.
+func (wp *workerPool) setUserAgent(req *http.Request, j *job.Job) {
+	if j.UserAgent != "" {
+		req.Header.Set("User-Agent", j.UserAgent)
+	} else if wp.p.UserAgent != "" {
+		req.Header.Set("User-Agent", wp.p.UserAgent)
+	}
+}
+
+// segments returns the number of segments in which the download of j is
+// split, which is set by j or its aggregation.
+func (wp *workerPool) segments(j *job.Job) int {
+	if j.Segments > 0 {
+		return j.Segments
+	}
+	if aggr := wp.aggregation(); aggr.Segments > 0 {
+		return aggr.Segments
+	}
+	return 1
+}
+
+// downloadSegments downloads the rest of the resource of j, whose response
+// resp has been partially written to out, in up to n segments of at least
+// minSegmentSize. The first segment is read from resp, while the rest are
+// requested concurrently with ranged requests. Each one of them occupies
+// another slot of the aggregation and, if the aggregation is rate limited,
+// takes a token. The resource is downloaded in fewer segments if there are
+// not enough free slots or tokens, or the server does not support ranges.
+func (wp *workerPool) downloadSegments(ctx context.Context, j *job.Job, resp *http.Response, out *os.File, n int) derrors.DownloadError {
+	written, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return derrors.E("downloading file", err).Internal().Retriable()
+	}
+
+	if max := (resp.ContentLength - written) / minSegmentSize; int64(n) > max {
+		n = int(max)
+	}
+	var members []string
+	if n > 1 && j.ResumeValidator != "" && resp.Header.Get("Accept-Ranges") == "bytes" {
+		members = wp.takeSegmentSlots(j, n-1)
+	}
+	if len(members) == 0 {
+		if _, err = io.Copy(out, resp.Body); err != nil {
+			return derrors.E("downloading file", err).Retriable()
+		}
+		return nil
+	}
+
+	aggrID := wp.aggregation().ID
+	defer func() {
+		if err := wp.p.Storage.ReleaseSlots(aggrID, members); err != nil {
+			wp.log.Printf("download: Error releasing segment slots of %s: %s", j, err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(storage.SlotTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := wp.p.Storage.RenewSlots(aggrID, members); err != nil {
+					wp.log.Printf("download: Error renewing segment slots of %s: %s", j, err)
+				}
+			}
+		}
+	}()
+
+	count := int64(len(members) + 1)
+	size := (resp.ContentLength - written) / count
+	errs := make(chan error, count)
+	for i := int64(0); i < count; i++ {
+		start := written + i*size
+		end := start + size - 1
+		if i == count-1 {
+			end = resp.ContentLength - 1
+		}
+
+		go func(i, start, end int64) {
+			if i == 0 {
+				_, err := io.CopyN(&offsetWriter{out, start}, resp.Body, end-start+1)
+				errs <- err
+				return
+			}
+			errs <- wp.downloadRange(ctx, j, out, start, end)
+		}(i, start, end)
+	}
 
+	var first error
+	for i := int64(0); i < count; i++ {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+			cancel()
+		}
+	}
+	if first != nil {
+		// The file has gaps, so the download cannot be resumed
+		j.ResumeValidator = ""
+		return derrors.E("downloading segment", first).Retriable()
+	}
 	return nil
 }
 
+// takeSegmentSlots occupies up to n free slots of the aggregation of wp for
+// the segments of j, taking a rate limit token for each one of them. The
+// members of the occupied slots are returned.
+func (wp *workerPool) takeSegmentSlots(j *job.Job, n int) []string {
+	aggr := wp.aggregation()
+	members, err := wp.p.Storage.TakeSlots(&aggr, j, n)
+	if err != nil {
+		wp.log.Printf("download: Error taking segment slots of %s: %s", j, err)
+		return nil
+	}
+	if aggr.Rate <= 0 {
+		return members
+	}
+
+	for i := range members {
+		wait, err := wp.p.Storage.TakeToken(&aggr)
+		if err == nil && wait == 0 {
+			continue
+		}
+
+		if err := wp.p.Storage.ReleaseSlots(aggr.ID, members[i:]); err != nil {
+			wp.log.Printf("download: Error releasing segment slots of %s: %s", j, err)
+		}
+		return members[:i]
+	}
+	return members
+}
+
+// downloadRange downloads the bytes of the resource of j from start to end,
+// inclusive, and writes them to out at the same offset. The range request is
+// validated by the resume validator of j.
+func (wp *workerPool) downloadRange(ctx context.Context, j *job.Job, out *os.File, start, end int64) error {
+	req, err := http.NewRequest("GET", j.URL, nil)
+	if err != nil {
+		return err
+	}
+	wp.setUserAgent(req, j)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	req.Header.Set("If-Range", j.ResumeValidator)
+
+	resp, err := wp.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Received status code %s for range %d-%d", resp.Status, start, end)
+	}
+	if rs, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || rs != start {
+		return fmt.Errorf("Unexpected Content-Range '%s' for range %d-%d", resp.Header.Get("Content-Range"), start, end)
+	}
+
+	_, err = io.CopyN(&offsetWriter{out, start}, resp.Body, end-start+1)
+	return err
+}
+
+// offsetWriter writes to a file sequentially, starting at an offset.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// resumeOffset returns the size of the partial download of j that was kept
+// by its previous attempts, or 0 if there is no download to resume.
+func (wp *workerPool) resumeOffset(j *job.Job) int64 {
+	if j.ResumeValidator == "" {
+		return 0
+	}
+
+	fi, err := os.Stat(wp.p.tmpStoragePath(j))
+	if err != nil {
+		// The previous attempt was performed by another processor
+		return 0
+	}
+	return fi.Size()
+}
+
+// resumeValidator returns the validator of resp to be sent in the If-Range
+// header of a request resuming its download, or an empty string if the
+// download cannot be resumed safely. Weak ETags cannot be used for ranges.
+func resumeValidator(resp *http.Response) string {
+	if resp.Header.Get("Accept-Ranges") == "none" {
+		return ""
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// contentRangeStart returns the first byte position of the Content-Range
+// header h, e.g. 100 for "bytes 100-199/200".
+func contentRangeStart(h string) (int64, bool) {
+	if !strings.HasPrefix(h, "bytes ") {
+		return 0, false
+	}
+	h = strings.TrimPrefix(h, "bytes ")
+	i := strings.Index(h, "-")
+	if i < 0 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(h[:i], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return start, true
+}
+
+// setConditionalHeaders makes req conditional on the cache validators
+// provided with j or, if there are none, on the validators of the most recent
+// download of its URL, as long as its file still exists. It returns the
+// validators of the downloader's own copy, if they were used, and reports
+// whether req is conditional.
+func (wp *workerPool) setConditionalHeaders(ctx context.Context, req *http.Request, j *job.Job) (job.Validators, bool, error) {
+	if j.HasValidators() {
+		if j.IfNoneMatch != "" {
+			req.Header.Set("If-None-Match", j.IfNoneMatch)
+		}
+		if j.IfModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", j.IfModifiedSince)
+		}
+		return job.Validators{}, true, nil
+	}
+
+	cached, err := wp.p.Storage.GetValidators(j.URL)
+	if err != nil || cached.Empty() {
+		return job.Validators{}, false, err
+	}
+	if _, err := wp.p.Files.Stat(ctx, (&job.Job{ID: cached.JobID, Blob: cached.Blob}).Path()); err != nil {
+		if err != blobstore.ErrNotExist {
+			return job.Validators{}, false, err
+		}
+		// The file was already deleted by the reaper
+		return job.Validators{}, false, nil
+	}
+
+	if cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	if cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+	return cached, true, nil
+}
+
+// reuseUnmodified completes the download of j, whose resource was not
+// modified since the download of the job with the validators cached. The
+// file of that job is copied to the path of j, or its blob is referenced by
+// j, unless the validators were provided by the client, in which case there
+// is no file to reuse.
+func (wp *workerPool) reuseUnmodified(ctx context.Context, j *job.Job, cached job.Validators, resp *http.Response) derrors.DownloadError {
+	j.NotModified = true
+	if cached.JobID == "" || cached.JobID == j.ID {
+		return nil
+	}
+
+	var de derrors.DownloadError
+	var deleted bool
+	if cached.Blob != "" {
+		de, deleted = wp.reuseBlob(ctx, j, cached)
+	} else {
+		de, deleted = wp.reuseFile(ctx, j, cached)
+	}
+	if de != nil {
+		j.NotModified = false
+		if deleted {
+			// The file was deleted in the meantime, so the next
+			// attempt should not be conditional
+			if err := wp.p.Storage.RemoveValidators(j.URL); err != nil {
+				wp.log.Printf("download: Error removing cache validators of %s: %s", j, err)
+			}
+		}
+		return de
+	}
+
+	// The validators may be updated by a 304 response
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		cached.ETag = etag
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		cached.LastModified = lastModified
+	}
+	cached.JobID = j.ID
+	wp.saveValidators(j, cached)
+	return nil
+}
+
+// reuseFile copies the file of the job with the validators cached to the
+// path of j. It also reports whether the file was deleted in the meantime.
+func (wp *workerPool) reuseFile(ctx context.Context, j *job.Job, cached job.Validators) (derrors.DownloadError, bool) {
+	err := blobstore.Copy(ctx, wp.p.Files, (&job.Job{ID: cached.JobID}).Path(), j.Path())
+	if err != nil {
+		return derrors.E("copying unmodified file", err).Internal().Retriable(), err == blobstore.ErrNotExist
+	}
+
+	if de := wp.checkStoredFile(ctx, j); de != nil {
+		if err := wp.p.Files.Delete(ctx, j.Path()); err != nil {
+			wp.log.Printf("download: Error removing unmodified file of %s: %s", j, err)
+		}
+		return de, false
+	}
+	return nil, false
+}
+
+// reuseBlob references the blob of the job with the validators cached by j.
+// It also reports whether the blob was deleted in the meantime.
+func (wp *workerPool) reuseBlob(ctx context.Context, j *job.Job, cached job.Validators) (derrors.DownloadError, bool) {
+	if _, err := wp.p.Storage.AcquireBlob(cached.Blob); err != nil {
+		return derrors.E("referencing blob", err).Internal().Retriable(), false
+	}
+	j.Blob = cached.Blob
+
+	de := wp.checkStoredFile(ctx, j)
+	if de != nil {
+		if err := wp.p.releaseBlob(j.Blob); err != nil {
+			wp.log.Printf("download: Error releasing blob %s of %s: %s", j.Blob, j, err)
+		}
+		j.Blob = ""
+		return de, de.IsInternal()
+	}
+	return nil, false
+}
+
+// checkStoredFile checks the file of j in the store, as checkFile does.
+func (wp *workerPool) checkStoredFile(ctx context.Context, j *job.Job) derrors.DownloadError {
+	r, err := wp.p.Files.Get(ctx, j.Path())
+	if err != nil {
+		return derrors.E("computing checksums", err).Internal().Retriable()
+	}
+	defer r.Close()
+	return wp.checkFile(j, r)
+}
+
+// checkFile computes the size and the checksums of the downloaded file of j,
+// read from r, and verifies its expected checksum.
+func (wp *workerPool) checkFile(j *job.Job, r io.Reader) derrors.DownloadError {
+	sums := newChecksummer(j.HashAlgorithms())
+	size, err := io.Copy(sums, r)
+	j.Metadata.Size = size
+	if err != nil {
+		return derrors.E("computing checksums", err).Internal().Retriable()
+	}
+	j.Checksums = sums.checksums()
+	return wp.verifyChecksum(j)
+}
+
+// verifyChecksum verifies that the downloaded file of j has the checksum
+// that j expects, if any.
+func (wp *workerPool) verifyChecksum(j *job.Job) derrors.DownloadError {
+	algorithm, expected := j.ExpectedSum()
+	if expected == "" {
+		return nil
+	}
+	if sum := j.Checksums.Get(algorithm); sum != expected {
+		wp.p.stats.Add(fmt.Sprintf("%s%s", statsResponseCodePrefix, "checksum"), 1)
+		return derrors.Errorf("verifying checksum", "Expected %s checksum %s, found %s", algorithm, expected, sum)
+	}
+	return nil
+}
+
+// checksummer computes the checksums of the data written to it, with each
+// one of its algorithms.
+type checksummer map[string]hash.Hash
+
+func newChecksummer(algorithms []string) checksummer {
+	c := make(checksummer)
+	for _, a := range algorithms {
+		switch a {
+		case job.ChecksumSHA256:
+			c[a] = sha256.New()
+		case "sha1":
+			c[a] = sha1.New()
+		case "md5":
+			c[a] = md5.New()
+		}
+	}
+	return c
+}
+
+func (c checksummer) Write(p []byte) (int, error) {
+	for _, h := range c {
+		// Writes to a hash.Hash never return an error
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// checksums returns the hex-encoded checksums of the data written to c.
+func (c checksummer) checksums() job.Checksums {
+	var sums job.Checksums
+	for a, h := range c {
+		sums.Set(a, hex.EncodeToString(h.Sum(nil)))
+	}
+	return sums
+}
+
+// saveValidators saves v as the cache validators of the URL of j.
+func (wp *workerPool) saveValidators(j *job.Job, v job.Validators) {
+	if err := wp.p.Storage.SaveValidators(j.URL, v); err != nil {
+		wp.log.Printf("download: Error saving cache validators of %s: %s", j, err)
+	}
+}
+
 // perform downloads the resource denoted by j.URL and updates its state in
 // Redis accordingly. It may retry downloading on certain errors.
+//
+// The download is cancelled if its cancellation is requested while
+// performing it, or before it is marked as successful.
 func (wp *workerPool) perform(ctx context.Context, j *job.Job, validator *mimetype.Validator) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wp.p.inflight.add(j.ID, cancel)
+	defer wp.p.inflight.remove(j.ID)
+
+	// The cancellation may have been requested before j was registered
+	if wp.cancelIfRequested(j) {
+		return
+	}
+
 	var err error
+	if j.Expired(time.Now()) {
+		wp.log.Println("perform: Job expired", j)
+		wp.removeTmpFile(j)
+		wp.p.stats.Add(statsExpiredJobs, 1)
+		err = wp.markJobFailed(j, "Job expired at "+time.Unix(j.ExpiresAt, 0).UTC().Format(time.RFC3339))
+		if err != nil {
+			wp.log.Printf("perform: Error marking %s Failed: %s", j, err)
+		}
+		return
+	}
+
 	if err = wp.markJobInProgress(j); err != nil {
 		wp.log.Printf("perform: Error marking %s as in-progress: %s", j, err)
 		return
@@ -646,12 +1841,23 @@ func (wp *workerPool) perform(ctx context.Context, j *job.Job, validator *mimety
 	j.DownloadCount++
 	wp.log.Println("perform: Starting download for", j, "...")
 
-	if de := wp.download(ctx, j, validator); de != nil {
+	startedAt := time.Now()
+	de := wp.download(ctx, j, validator)
+	j.Metadata.Duration = int64(time.Since(startedAt) / time.Millisecond)
+	wp.recordAttempt(j, startedAt, de)
+
+	if de != nil {
 		wp.log.Println("perform: Download Failed for", j, de)
 
+		if ctx.Err() != nil && wp.cancelIfRequested(j) {
+			wp.removeTmpFile(j)
+			return
+		}
+
 		// Do not mark this as a download try if the error is on our side,
-		// or the request context was cancelled
-		if de.Err() == context.Canceled || de.IsInternal() {
+		// the request context was cancelled or the origin server throttled
+		// the download
+		if de.Err() == context.Canceled || de.IsInternal() || de.IsThrottled() {
 			j.DownloadCount--
 		}
 
@@ -659,8 +1865,16 @@ func (wp *workerPool) perform(ctx context.Context, j *job.Job, validator *mimety
 			wp.p.stats.Add(statsFailures, 1)
 		}
 
-		if de.IsRetriable() {
-			if err = wp.requeueOrFail(j, de.Error()); err != nil {
+		if d := de.RetryAfter(); d > 0 {
+			wp.throttle(d)
+		}
+
+		if de.IsThrottled() {
+			if err = wp.requeueThrottled(j, de.Error(), de.RetryAfter()); err != nil {
+				wp.log.Printf("perform: Error requeing %s : %s", j, err)
+			}
+		} else if de.IsRetriable() {
+			if err = wp.requeueOrFail(j, de.Error(), de.RetryAfter()); err != nil {
 				wp.log.Printf("perform: Error requeing %s : %s", j, err)
 			}
 		} else {
@@ -669,26 +1883,125 @@ func (wp *workerPool) perform(ctx context.Context, j *job.Job, validator *mimety
 			}
 		}
 
-		if err := os.Remove(wp.p.tmpStoragePath(j)); err != nil && !os.IsNotExist(err) {
-			wp.log.Printf("perform: Error deleting temp file %s, %s, %s", wp.p.tmpStoragePath(j), j, err)
+		// The partial download of a requeued job is resumed by its
+		// next attempt
+		if j.DownloadState != job.StatePending || j.ResumeValidator == "" {
+			wp.removeTmpFile(j)
 		}
 		return
 	}
 	wp.log.Println("perform: Successfully completed download for", j)
 
+	// The cancellation may have been requested after the download was
+	// completed, in which case its file is deleted along with j
+	if wp.cancelIfRequested(j) {
+		return
+	}
+
 	if err = wp.markJobSuccess(j); err != nil {
 		wp.log.Printf("perform: Error marking %s successful: %s", j, err)
 	}
 }
 
-// requeueOrFail checks the retry count of the current download
-// and retries the job if its RetryCount < maxRetries else it marks
-// it as failed
-func (wp *workerPool) requeueOrFail(j *job.Job, err string) error {
-	if j.DownloadCount >= maxDownloadRetries {
+// recordAttempt appends the download attempt of j that started at startedAt
+// and resulted in de, to its download attempts.
+func (wp *workerPool) recordAttempt(j *job.Job, startedAt time.Time, de derrors.DownloadError) {
+	a := job.Attempt{
+		StartedAt:    startedAt,
+		Duration:     int64(time.Since(startedAt) / time.Millisecond),
+		ResponseCode: j.ResponseCode,
+		Proxy:        wp.aggregation().Proxy,
+	}
+
+	if de != nil {
+		a.Error = de.Error()
+		a.Phase = de.Phase()
+		a.Retriable = de.IsRetriable()
+		a.Internal = de.IsInternal()
+		if fi, err := os.Stat(wp.p.tmpStoragePath(j)); err == nil {
+			a.Bytes = fi.Size()
+		}
+	} else {
+		a.Bytes = j.Metadata.Size
+	}
+
+	wp.p.downloadDuration.Observe(j.AggrID, time.Since(startedAt).Seconds())
+	if de == nil {
+		wp.p.downloadSize.Observe(j.AggrID, float64(a.Bytes))
+	}
+
+	if err := wp.p.Storage.AddAttempt(j.ID, a); err != nil {
+		wp.log.Printf("perform: Error recording download attempt of %s: %s", j, err)
+	}
+}
+
+// cancelIfRequested marks j as cancelled if its cancellation was requested
+// and reports whether it did so.
+func (wp *workerPool) cancelIfRequested(j *job.Job) bool {
+	requested, callback, err := wp.p.Storage.CancellationRequested(j.ID)
+	if err != nil {
+		wp.log.Printf("perform: Error checking cancellation of %s: %s", j, err)
+		return false
+	}
+	if !requested {
+		return false
+	}
+
+	wp.log.Println("perform: Cancelling", j)
+	wp.removeTmpFile(j)
+	if err = wp.p.Storage.QueueCancelledJob(j, callback); err != nil {
+		wp.log.Printf("perform: Error marking %s cancelled: %s", j, err)
+	}
+	return true
+}
+
+func (wp *workerPool) removeTmpFile(j *job.Job) {
+	if err := os.Remove(wp.p.tmpStoragePath(j)); err != nil && !os.IsNotExist(err) {
+		wp.log.Printf("perform: Error deleting temp file %s, %s, %s", wp.p.tmpStoragePath(j), j, err)
+	}
+}
+
+// requeueOrFail checks the retry count of the current download against
+// the retry policy of j and retries the job if the policy allows it, else it
+// marks it as failed. The job is retried after retryAfter has passed, if it is
+// longer than the delay of the policy.
+func (wp *workerPool) requeueOrFail(j *job.Job, err string, retryAfter time.Duration) error {
+	policy := wp.retryPolicy(j)
+	if policy.Exhausted(j.DownloadCount) {
 		return wp.markJobFailed(j, err)
 	}
-	return wp.p.Storage.QueuePendingDownload(j, time.Duration(j.DownloadCount)*RetryBackoffDuration)
+
+	delay := policy.Delay(j.DownloadCount)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	wp.p.popped.remove(j)
+	return wp.p.Storage.QueuePendingDownload(j, delay)
+}
+
+// requeueThrottled retries j, whose download was throttled by the origin
+// server, unless it was throttled MaxThrottles times already, in which case
+// it marks it as failed. The job is retried after retryAfter has passed, if
+// it is longer than the delay of its retry policy for as many attempts as
+// its throttled ones.
+func (wp *workerPool) requeueThrottled(j *job.Job, err string, retryAfter time.Duration) error {
+	j.ThrottleCount++
+	if wp.p.MaxThrottles > 0 && j.ThrottleCount >= wp.p.MaxThrottles {
+		return wp.markJobFailed(j, err)
+	}
+
+	delay := wp.retryPolicy(j).Delay(j.ThrottleCount)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	wp.p.popped.remove(j)
+	return wp.p.Storage.QueuePendingDownload(j, delay)
+}
+
+// retryPolicy returns the retry policy of j, which is the processor's policy
+// overridden by the policies of the aggregation and the job itself.
+func (wp *workerPool) retryPolicy(j *job.Job) job.RetryPolicy {
+	return wp.p.RetryPolicy.Override(wp.aggregation().Retry).Override(j.DownloadRetry)
 }
 
 func (wp *workerPool) markJobInProgress(j *job.Job) error {
@@ -736,16 +2049,27 @@ func (p *Processor) reaper(ctx context.Context) {
 				continue
 			}
 
-			filePath := path.Join(p.StorageDir, j.Path())
-			err = os.Remove(filePath)
-			if err != nil && !os.IsNotExist(err) {
-				p.Log.Printf("Error: Could not delete [%s] for job: %s, %s", filePath, j, err.Error())
-				p.stats.Add(statsReaperFailures, 1)
-				continue
+			// Jobs may have been removed while their partial download was
+			// kept for resuming
+			if err := os.Remove(p.tmpStoragePath(&j)); err != nil && !os.IsNotExist(err) {
+				p.Log.Printf("Error: Could not delete temp file for job: %s, %s", j, err)
 			}
 
-			if err == nil {
-				p.Log.Printf("reaper: Deleted file [%s] for job %s", filePath, j)
+			if j.Blob != "" {
+				// The blob is deleted along with its last reference
+				if err = p.releaseBlob(j.Blob); err != nil {
+					p.Log.Printf("Error: Could not release blob %s for job: %s, %s", j.Blob, j, err)
+					p.stats.Add(statsReaperFailures, 1)
+					continue
+				}
+			} else {
+				err = p.Files.Delete(context.TODO(), j.Path())
+				if err != nil {
+					p.Log.Printf("Error: Could not delete [%s] for job: %s, %s", j.Path(), j, err.Error())
+					p.stats.Add(statsReaperFailures, 1)
+					continue
+				}
+				p.Log.Printf("reaper: Deleted file [%s] for job %s", j.Path(), j)
 			}
 
 			err = p.Storage.RemoveJob(j.ID)
@@ -760,6 +2084,21 @@ func (p *Processor) reaper(ctx context.Context) {
 	}
 }
 
+// releaseBlob removes a reference to the blob with the given SHA-256
+// checksum, deleting its file if it was the last one.
+func (p *Processor) releaseBlob(sum string) error {
+	n, err := p.Storage.ReleaseBlob(sum)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	if err = p.Files.Delete(context.TODO(), job.BlobPath(sum)); err != nil {
+		return err
+	}
+	p.Log.Printf("reaper: Deleted blob [%s]", job.BlobPath(sum))
+	return p.Storage.RemoveBlob(sum)
+}
+
 func httpTransport(proxy *url.URL) *http.Transport {
 	proxyfunc := http.ProxyFromEnvironment
 	if proxy != nil {
@@ -180,7 +180,7 @@ func TestReaper(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		err = store.QueueJobForDeletion(tc.Job.ID, tc.Delay)
+		err = store.QueueJobForDeletion(&tc.Job, tc.Delay)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -206,7 +206,7 @@ func TestReaper(t *testing.T) {
 	}
 }
 
-func TestRogueCollection(t *testing.T) {
+func TestExpiredDownloads(t *testing.T) {
 	err := Redis.FlushDB().Err()
 	if err != nil {
 		t.Fatal(err)
@@ -239,9 +239,15 @@ func TestRogueCollection(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+
+		// Their processor died while performing them
+		err = Redis.ZAdd(storage.InFlightDownloads, redis.Z{Member: testcase.Job.ID, Score: 1}).Err()
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	defaultProcessor.collectRogueDownloads()
+	defaultProcessor.requeueExpired()
 
 	for _, testcase := range testcases {
 		j, err := store.GetJob(testcase.Job.ID)
@@ -250,9 +256,13 @@ func TestRogueCollection(t *testing.T) {
 		}
 
 		if j.DownloadState != testcase.expectedState {
-			t.Fatalf("Expected job state Pending, found %s", j.DownloadState)
+			t.Fatalf("Expected job state %s, found %s", testcase.expectedState, j.DownloadState)
 		}
 	}
+
+	if n, _ := Redis.ZCard(storage.InFlightDownloads).Result(); n != 0 {
+		t.Errorf("Expected no in-flight downloads, got %d", n)
+	}
 }
 
 func TestChecker(t *testing.T) {
@@ -365,3 +375,342 @@ func TestJobWithNoAggregation(t *testing.T) {
 	closeChan <- struct{}{}
 	<-closeChan
 }
+
+func TestWorkerPoolRefresh(t *testing.T) {
+	p, err := New(store, 1, storageDir, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aggr, err := job.NewAggregation("refreshfoo", 4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SaveAggregation(aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wp, err := p.newWorkerPool(*aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := wp.httpClient()
+
+	aggr.Limit = 2
+	aggr.Proxy = "http://proxy.example.com"
+	err = store.SaveAggregation(aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wp.refresh()
+
+	if wp.aggregation() != *aggr {
+		t.Errorf("Expected aggregation to be %#v, got %#v", *aggr, wp.aggregation())
+	}
+	if wp.httpClient() == client {
+		t.Error("Expected client to have been rebuilt after the proxy changed")
+	}
+
+	// An invalid proxy keeps the current one
+	aggr.Proxy = "invalid"
+	err = store.SaveAggregation(aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wp.refresh()
+
+	if proxy := wp.aggregation().Proxy; proxy != "http://proxy.example.com" {
+		t.Errorf("Expected proxy to be kept, got %s", proxy)
+	}
+
+	// Workers exceeding the new limit retire
+	wp.numActiveWorkers = 4
+	retired := 0
+	for wp.retire() {
+		retired++
+	}
+	if retired != 2 || wp.activeWorkers() != 2 {
+		t.Errorf("Expected 2 workers to retire, %d retired and %d are active", retired, wp.activeWorkers())
+	}
+}
+
+func TestWorkerPoolPaused(t *testing.T) {
+	p, err := New(store, 1, storageDir, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aggr, err := job.NewAggregation("pausedfoo", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SaveAggregation(aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetAggregationPaused(aggr.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := job.Job{ID: "PausedJob", URL: "http://example.com", AggrID: aggr.ID}
+	err = store.QueuePendingDownload(&j, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wp, err := p.newWorkerPool(*aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wp.refresh()
+
+	done := make(chan struct{})
+	go func() {
+		wp.start(context.TODO(), storageDir)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected worker pool of paused aggregation to stop")
+	}
+
+	j, err = store.GetJob(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.DownloadState != job.StatePending || j.DownloadCount != 0 {
+		t.Errorf("Expected job of paused aggregation not to have been performed, got %s", j)
+	}
+}
+
+func TestSpawnPoolsOnQueue(t *testing.T) {
+	if err := Redis.FlushDB().Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A long scan interval ensures that the pool is spawned because of the
+	// announcement of the queued job
+	p, err := New(store, 3600, storageDir, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := make(chan struct{}, 1)
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		reqs <- struct{}{}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	closeChan := make(chan struct{})
+	go p.Start(closeChan)
+	time.Sleep(100 * time.Millisecond)
+
+	testJob := getTestJob(t)
+	err = store.QueuePendingDownload(&testJob, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-reqs:
+	case <-time.After(time.Second):
+		t.Fatal("Expected job to have been processed immediately")
+	}
+
+	closeChan <- struct{}{}
+	<-closeChan
+}
+
+func TestSlotsAcrossProcessors(t *testing.T) {
+	if err := Redis.FlushDB().Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	aggr, err := job.NewAggregation("slotsfoo", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SaveAggregation(aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var active, maxActive, served int
+	addHandler(t.Name(), func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+
+		time.Sleep(100 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		served++
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var jobs []*job.Job
+	for i := 0; i < 4; i++ {
+		j := getTestJob(t)
+		j.ID = fmt.Sprintf("%s%d", t.Name(), i)
+		j.AggrID = aggr.ID
+		jobs = append(jobs, &j)
+	}
+	err = store.QueuePendingDownloads(jobs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two processors share the limit of the aggregation
+	var closeChans []chan struct{}
+	for i := 0; i < 2; i++ {
+		p, err := New(store, 1, storageDir, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		closeChan := make(chan struct{})
+		closeChans = append(closeChans, closeChan)
+		go p.Start(closeChan)
+	}
+
+	for i := 0; i < 50; i++ {
+		mu.Lock()
+		done := served == len(jobs)
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, closeChan := range closeChans {
+		closeChan <- struct{}{}
+		<-closeChan
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if served != len(jobs) {
+		t.Fatalf("Expected %d jobs to have been performed, got %d", len(jobs), served)
+	}
+	if maxActive != 1 {
+		t.Errorf("Expected at most 1 concurrent download, got %d", maxActive)
+	}
+	if n, _ := Redis.ZCard(storage.InFlightDownloads).Result(); n != 0 {
+		t.Errorf("Expected completed downloads not to be in flight, got %d", n)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	if err := Redis.FlushDB().Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "downloader-gc-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := New(store, 3, dir, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.GCGracePeriod = time.Hour
+	p.GCThrottle = 0
+
+	referenced := strings.Repeat("a", 64)
+	orphan := strings.Repeat("b", 64)
+	if _, err = store.AcquireBlob(referenced); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SaveJob(&job.Job{ID: "gcExisting"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.QueueJobForDeletion(&job.Job{ID: "gcDeleted"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	files := []struct {
+		path    string
+		old     bool
+		deleted bool
+	}{
+		{"gcStale" + tmpFileExt, true, true},
+		{"gcFresh" + tmpFileExt, false, false},
+		{(&job.Job{ID: "gcExisting"}).Path(), true, false},
+		{(&job.Job{ID: "gcDeleted"}).Path(), true, false},
+		{(&job.Job{ID: "gcOrphan"}).Path(), true, true},
+		{(&job.Job{ID: "gcRecent"}).Path(), false, false},
+		{job.BlobPath(referenced), true, false},
+		{job.BlobPath(orphan), true, true},
+	}
+	for _, f := range files {
+		fpath := path.Join(dir, f.path)
+		if err = os.MkdirAll(path.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(fpath, []byte("foo"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if f.old {
+			if err = os.Chtimes(fpath, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = os.Mkdir(path.Join(dir, "zzz"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := GCResult{Scanned: len(files), TmpFiles: 1, Orphans: 2, Dirs: 1, Bytes: 9}
+	res, err := p.CollectGarbage(context.TODO(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != expected {
+		t.Errorf("Expected dry run result %#v, got %#v", expected, res)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(path.Join(dir, f.path)); err != nil {
+			t.Errorf("Expected %s not to be deleted by a dry run: %s", f.path, err)
+		}
+	}
+
+	res, err = p.CollectGarbage(context.TODO(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directories of the deleted orphans are also empty
+	expected.Dirs = 3
+	if res != expected {
+		t.Errorf("Expected result %#v, got %#v", expected, res)
+	}
+	for _, f := range files {
+		_, err := os.Stat(path.Join(dir, f.path))
+		if f.deleted && !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be deleted", f.path)
+		}
+		if !f.deleted && err != nil {
+			t.Errorf("Expected %s not to be deleted: %s", f.path, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(dir, "zzz")); !os.IsNotExist(err) {
+		t.Error("Expected empty directory to be deleted")
+	}
+	if exists, _ := store.Redis.Exists(storage.BlobKeyPrefix + orphan).Result(); exists > 0 {
+		t.Error("Expected the claim of the deleted blob to be removed")
+	}
+}
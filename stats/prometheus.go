@@ -0,0 +1,367 @@
+package stats
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The Prometheus types of the exported metrics.
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	histogram = "histogram"
+	untyped   = "untyped"
+)
+
+// OtherSeries is the label value under which the values of the series in
+// excess of the MaxSeries of a metric are accumulated.
+const OtherSeries = "_other"
+
+// Desc describes a metric exported in the Prometheus text format.
+type Desc struct {
+	// Name of the metric, without the exporter's namespace
+	Name string
+
+	// Kind is the Prometheus type of the metric, Counter or Gauge
+	Kind string
+
+	Help string
+
+	// Label is the name of the label that distinguishes the series of a
+	// metric family. For metrics of a Stats map, the series are the
+	// entries whose key starts with the described key, and the value of
+	// the label is the remaining part of the key.
+	Label string
+
+	// MaxSeries, if positive, bounds the number of series of a labelled
+	// histogram or gauge. Histograms accumulate the observations of any
+	// further label values under OtherSeries, while gauges keep their
+	// MaxSeries largest values and sum the rest under OtherSeries.
+	MaxSeries int
+}
+
+// Exporter exposes the metrics of a Stats map, along with histograms and
+// gauges computed on demand, in the Prometheus text format.
+//
+// Exporter reads the map on every request, so it keeps working when the
+// map is re-initialized by New.
+type Exporter struct {
+	id        string
+	namespace string
+
+	mu         sync.Mutex
+	descs      map[string]Desc
+	histograms []*Histogram
+	gauges     []gaugeFunc
+}
+
+type gaugeFunc struct {
+	desc Desc
+	f    func() (map[string]float64, error)
+}
+
+// Histogram counts observations in configurable buckets. It is safe for
+// concurrent use.
+type Histogram struct {
+	desc    Desc
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+// NewExporter returns an Exporter for the Stats map with the given id. The
+// names of all exported metrics are prefixed with namespace.
+func NewExporter(id, namespace string) *Exporter {
+	return &Exporter{id: id, namespace: namespace, descs: make(map[string]Desc)}
+}
+
+// Describe sets the description of the metric stored under key in the Stats
+// map. If d has a Label, key is the common prefix of the keys of the metric
+// family. Metrics that are not described are exported as untyped.
+func (e *Exporter) Describe(key string, d Desc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.descs[key] = d
+}
+
+// Histogram creates and registers a histogram with the given upper bounds of
+// its buckets, in increasing order.
+func (e *Exporter) Histogram(d Desc, buckets []float64) *Histogram {
+	d.Kind = histogram
+	h := &Histogram{desc: d, buckets: buckets, series: make(map[string]*histogramSeries)}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.histograms = append(e.histograms, h)
+	return h
+}
+
+// GaugeFunc registers a gauge whose values are computed by f on every
+// request. f returns the values of the gauge, keyed by the value of d.Label,
+// or a single value under the empty key if d has no Label.
+func (e *Exporter) GaugeFunc(d Desc, f func() (map[string]float64, error)) {
+	d.Kind = Gauge
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.gauges = append(e.gauges, gaugeFunc{d, f})
+}
+
+// Observe adds the observation v to the series of h with the given label
+// value. The label value is ignored if h has no label.
+func (h *Histogram) Observe(label string, v float64) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.desc.Label == "" {
+		label = ""
+	}
+	s, ok := h.series[label]
+	if !ok && h.desc.MaxSeries > 0 && len(h.series) >= h.desc.MaxSeries {
+		label = OtherSeries
+		s, ok = h.series[label]
+	}
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[label] = s
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// ServeHTTP writes the metrics of e in the Prometheus text format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	e.write(bw)
+	bw.Flush()
+}
+
+func (e *Exporter) write(w *bufio.Writer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	descs := make(map[string]Desc)
+	samples := make(map[string][]sample)
+
+	if m, ok := expvar.Get(e.id).(*expvar.Map); ok {
+		m.Do(func(kv expvar.KeyValue) {
+			var v float64
+			switch val := kv.Value.(type) {
+			case *expvar.Int:
+				v = float64(val.Value())
+			case *expvar.Float:
+				v = val.Value()
+			default:
+				return
+			}
+
+			d, labels := e.describe(kv.Key)
+			descs[d.Name] = d
+			samples[d.Name] = append(samples[d.Name], sample{labels, v})
+		})
+	}
+
+	for _, g := range e.gauges {
+		values, err := g.f()
+		if err != nil {
+			fmt.Fprintf(w, "# Error computing %s: %s\n", g.desc.Name, strings.Replace(err.Error(), "\n", " ", -1))
+			continue
+		}
+		descs[g.desc.Name] = g.desc
+		for l, v := range limitSeries(values, g.desc.MaxSeries) {
+			samples[g.desc.Name] = append(samples[g.desc.Name], sample{labelPair(g.desc.Label, l), v})
+		}
+	}
+
+	names := make([]string, 0, len(descs))
+	for name := range descs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		d := descs[name]
+		e.writeHeader(w, d)
+
+		s := samples[name]
+		sort.Slice(s, func(i, j int) bool { return s[i].labels < s[j].labels })
+		for _, smpl := range s {
+			e.writeSample(w, name, smpl.labels, smpl.value)
+		}
+	}
+
+	for _, h := range e.histograms {
+		e.writeHistogram(w, h)
+	}
+}
+
+// limitSeries returns the values of a gauge with at most max series, plus
+// one under OtherSeries holding the sum of the smallest values that did not
+// fit. values are returned as-is if max is not positive.
+func limitSeries(values map[string]float64, max int) map[string]float64 {
+	if max <= 0 || len(values) <= max {
+		return values
+	}
+
+	labels := make([]string, 0, len(values))
+	for l := range values {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if values[labels[i]] != values[labels[j]] {
+			return values[labels[i]] > values[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+
+	limited := make(map[string]float64, max+1)
+	for i, l := range labels {
+		if i < max {
+			limited[l] = values[l]
+		} else {
+			limited[OtherSeries] += values[l]
+		}
+	}
+	return limited
+}
+
+// describe returns the description of the Stats map entry with the given
+// key, along with the labels of its series.
+func (e *Exporter) describe(key string) (Desc, string) {
+	if d, ok := e.descs[key]; ok && d.Label == "" {
+		return d, ""
+	}
+
+	for prefix, d := range e.descs {
+		if d.Label != "" && strings.HasPrefix(key, prefix) {
+			return d, labelPair(d.Label, strings.TrimPrefix(key, prefix))
+		}
+	}
+
+	return Desc{Name: snakeCase(key), Kind: untyped}, ""
+}
+
+func (e *Exporter) writeHistogram(w *bufio.Writer, h *Histogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e.writeHeader(w, h.desc)
+
+	labels := make([]string, 0, len(h.series))
+	for l := range h.series {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	for _, l := range labels {
+		s := h.series[l]
+		pair := labelPair(h.desc.Label, l)
+		sep := ""
+		if pair != "" {
+			sep = ","
+		}
+
+		for i, b := range h.buckets {
+			e.writeSample(w, h.desc.Name+"_bucket", pair+sep+labelPair("le", formatFloat(b)), float64(s.counts[i]))
+		}
+		e.writeSample(w, h.desc.Name+"_bucket", pair+sep+`le="+Inf"`, float64(s.count))
+		e.writeSample(w, h.desc.Name+"_sum", pair, s.sum)
+		e.writeSample(w, h.desc.Name+"_count", pair, float64(s.count))
+	}
+}
+
+func (e *Exporter) writeHeader(w *bufio.Writer, d Desc) {
+	name := e.namespace + "_" + d.Name
+	if d.Help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, escape(d.Help, false))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, d.Kind)
+}
+
+func (e *Exporter) writeSample(w *bufio.Writer, name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_%s%s %s\n", e.namespace, name, labels, formatFloat(v))
+}
+
+// labelPair returns the Prometheus representation of the label with the
+// given name and value, or an empty string if name is empty.
+func labelPair(name, value string) string {
+	if name == "" {
+		return ""
+	}
+	return name + `="` + escape(value, true) + `"`
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// snakeCase converts a camel case key of a Stats map (e.g. "spawnedWorkers")
+// to a valid Prometheus metric name (e.g. "spawned_workers").
+func snakeCase(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		switch {
+		case unicode.IsUpper(r):
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,114 @@
+package stats
+
+import (
+	"errors"
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExporter(t *testing.T) {
+	s := New("ExporterTest", time.Second, func(m *expvar.Map) {})
+	s.Add("spawnedWorkers", 3)
+	s.Add("workers", 2)
+	s.Add("download.response.200", 5)
+	s.Add("download.response.tls", 1)
+
+	e := NewExporter("ExporterTest", "test")
+	e.Describe("spawnedWorkers", Desc{Name: "spawned_workers_total", Kind: Counter, Help: "Spawned workers."})
+	e.Describe("download.response.", Desc{Name: "responses_total", Kind: Counter, Label: "code"})
+
+	h := e.Histogram(Desc{Name: "duration_seconds", Label: "backend"}, []float64{1, 5})
+	h.Observe("http", 0.5)
+	h.Observe("http", 3)
+	h.Observe("http", 10)
+
+	e.GaugeFunc(Desc{Name: "queue_depth", Label: "aggregation"}, func() (map[string]float64, error) {
+		return map[string]float64{`foo"bar`: 4}, nil
+	})
+	e.GaugeFunc(Desc{Name: "broken"}, func() (map[string]float64, error) {
+		return nil, errors.New("boom")
+	})
+
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+
+	expected := []string{
+		"# HELP test_spawned_workers_total Spawned workers.\n# TYPE test_spawned_workers_total counter\ntest_spawned_workers_total 3\n",
+		"# TYPE test_workers untyped\ntest_workers 2\n",
+		"# TYPE test_alive untyped\ntest_alive 1\n",
+		"# TYPE test_responses_total counter\ntest_responses_total{code=\"200\"} 5\ntest_responses_total{code=\"tls\"} 1\n",
+		"# TYPE test_queue_depth gauge\ntest_queue_depth{aggregation=\"foo\\\"bar\"} 4\n",
+		"# TYPE test_duration_seconds histogram\n" +
+			"test_duration_seconds_bucket{backend=\"http\",le=\"1\"} 1\n" +
+			"test_duration_seconds_bucket{backend=\"http\",le=\"5\"} 2\n" +
+			"test_duration_seconds_bucket{backend=\"http\",le=\"+Inf\"} 3\n" +
+			"test_duration_seconds_sum{backend=\"http\"} 13.5\n" +
+			"test_duration_seconds_count{backend=\"http\"} 3\n",
+		"# Error computing broken: boom\n",
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("Expected metrics to contain:\n%s\ngot:\n%s", e, body)
+		}
+	}
+}
+
+func TestMaxSeries(t *testing.T) {
+	e := NewExporter("MaxSeriesTest", "test")
+
+	h := e.Histogram(Desc{Name: "duration_seconds", Label: "aggregation", MaxSeries: 2}, []float64{1})
+	h.Observe("foo", 0.5)
+	h.Observe("bar", 0.5)
+	h.Observe("baz", 2)
+	h.Observe("qux", 3)
+	h.Observe("foo", 4)
+
+	e.GaugeFunc(Desc{Name: "queue_depth", Label: "aggregation", MaxSeries: 2}, func() (map[string]float64, error) {
+		return map[string]float64{"foo": 1, "bar": 5, "baz": 3, "qux": 2}, nil
+	})
+
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	body := rr.Body.String()
+
+	expected := []string{
+		"test_duration_seconds_count{aggregation=\"foo\"} 2\n",
+		"test_duration_seconds_count{aggregation=\"bar\"} 1\n",
+		"test_duration_seconds_sum{aggregation=\"_other\"} 5\n",
+		"test_duration_seconds_count{aggregation=\"_other\"} 2\n",
+		"test_queue_depth{aggregation=\"bar\"} 5\n",
+		"test_queue_depth{aggregation=\"baz\"} 3\n",
+		"test_queue_depth{aggregation=\"_other\"} 3\n",
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("Expected metrics to contain:\n%s\ngot:\n%s", e, body)
+		}
+	}
+
+	for _, l := range []string{"baz", "qux"} {
+		if strings.Contains(body, "test_duration_seconds_count{aggregation=\""+l+"\"}") {
+			t.Errorf("Expected histogram series of %s to be accumulated under %s, got:\n%s", l, OtherSeries, body)
+		}
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	tc := map[string]string{
+		"workers":                   "workers",
+		"reaperSuccessfulDeletions": "reaper_successful_deletions",
+		"download.response.200":     "download_response_200",
+	}
+
+	for key, expected := range tc {
+		if actual := snakeCase(key); actual != expected {
+			t.Errorf("Expected %s to be converted to %s, got %s", key, expected, actual)
+		}
+	}
+}
@@ -2,6 +2,7 @@
 package storage
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
@@ -28,6 +29,27 @@ const (
 	// "<JobKeyPrefix><job-id>"
 	JobKeyPrefix = "job:"
 
+	// The rate limit token bucket of each aggregation is kept in a Redis
+	// Hash named in the form "<RateLimitKeyPrefix><aggregation-id>"
+	RateLimitKeyPrefix = "ratelimit:"
+
+	// Each aggregation whose origin server requested that no downloads are
+	// performed for a while (e.g. with a Retry-After header) has a Redis
+	// key named in the form "<ThrottleKeyPrefix><aggregation-id>", which
+	// expires when downloads may be performed again
+	ThrottleKeyPrefix = "throttle:"
+
+	// The download attempts of each Job are kept in a Redis List named in
+	// the form "<HistoryKeyPrefix><job-id>"
+	HistoryKeyPrefix = "history:"
+
+	// The slots of each aggregation, which bound the number of its jobs
+	// that are performed concurrently by all processors, are kept in a
+	// Redis ZSET named in the form "<SlotsKeyPrefix><aggregation-id>".
+	// Its members are the IDs of the jobs occupying the slots, scored by
+	// the time their lease expires.
+	SlotsKeyPrefix = "slots:"
+
 	// CallbackQueue contains IDs of jobs that are completed
 	// and their callback is to be executed
 	// TODO: this introduces coupling with the notifier. See how we can
@@ -37,11 +59,99 @@ const (
 	// RIPQueue contains ids of jobs to be deleted
 	RIPQueue = "JobDeletionQueue"
 
+	// RIPBlobs is a Redis Hash containing the blobs referenced by the jobs
+	// in RIPQueue, keyed by job id, so that they are released even if the
+	// jobs expire before they are deleted
+	RIPBlobs = "JobDeletionBlobs"
+
+	// InFlightDownloads contains the ids of popped jobs whose download is
+	// not complete yet, scored by the time until which they are considered
+	// to be processed. The deadline is extended by the processor that
+	// popped the job, as long as it is processing it. Jobs whose deadline
+	// expires are requeued.
+	InFlightDownloads = "InFlightDownloads"
+
+	// InFlightCallbacks is the equivalent of InFlightDownloads for the
+	// callbacks that are being performed.
+	InFlightCallbacks = "InFlightCallbacks"
+
+	// Each job whose cancellation was requested while it was being
+	// processed has a corresponding Redis key named in the form
+	// "<CancelKeyPrefix><job-id>". Its value denotes whether a callback
+	// should be performed after the job is cancelled.
+	CancelKeyPrefix = "cancel:"
+
+	// CancellationChannel is the Redis Pub/Sub channel on which the IDs of
+	// jobs to be cancelled are published.
+	CancellationChannel = "JobCancellations"
+
+	// ActiveAggregations is a Redis Set containing the IDs of the
+	// aggregations that have queued jobs. An aggregation is added to it
+	// whenever a job is queued and removed along with the aggregation.
+	ActiveAggregations = "ActiveAggregations"
+
+	// JobsChannel is the Redis Pub/Sub channel on which the IDs of
+	// aggregations are published whenever jobs are queued for them.
+	JobsChannel = "JobsQueued"
+
+	// Each schedule has a corresponding Redis Hash named in the form
+	// "<ScheduleKeyPrefix><schedule-id>"
+	ScheduleKeyPrefix = "schedule:"
+
+	// Schedules is a Redis ZSET containing the IDs of all schedules,
+	// scored by the time of their next run. Due schedules are claimed by
+	// a scheduler by extending their score by ScheduleLease, until they
+	// are rescheduled.
+	Schedules = "Schedules"
+
+	// ScheduleLease is the time after which a claimed schedule that was
+	// not rescheduled, e.g. because its scheduler died, is due again.
+	ScheduleLease = time.Minute
+
+	// The cache validators of each downloaded URL are kept in a Redis Hash
+	// named in the form "<ValidatorsKeyPrefix><url>"
+	ValidatorsKeyPrefix = "validators:"
+
+	// The time after which the cache validators of a URL that is not
+	// downloaded again expire
+	validatorsTTL = 30 * 24 * time.Hour
+
+	// The number of jobs referencing each blob of the content-addressable
+	// layout is kept in a Redis key named in the form
+	// "<BlobKeyPrefix><sha256>". While the blob is being deleted, its
+	// count is -1.
+	BlobKeyPrefix = "blob:"
+
+	// The time after which a blob that was not deleted, e.g. because its
+	// reaper died, can be referenced again
+	blobDeletionTTL = time.Minute
+
+	// The time after which a pending cancellation request expires
+	cancellationTTL = 24 * time.Hour
+
 	// Prefix for stats related entries
 	statsPrefix = "stats"
 
 	// The default aggregation limit
 	aggrDefaultLimit = 4
+
+	// The maximum number of download attempts kept for each job
+	maxHistoryLength = 20
+
+	// SlotTTL is the duration of the lease of an aggregation slot. Slots
+	// that are not renewed in time, e.g. because their processor died,
+	// are freed.
+	SlotTTL = 30 * time.Second
+
+	// VisibilityTimeout is the time after which in-flight jobs are
+	// requeued, unless their deadline is extended.
+	VisibilityTimeout = time.Minute
+
+	// The jobs of each priority occupy a separate band of scores in the
+	// queue of their aggregation. The score of a job is the Unix time at
+	// which it is ready to be downloaded, shifted by its priority times
+	// priorityBand, which exceeds any such time.
+	priorityBand = 1 << 33
 )
 
 var (
@@ -61,8 +171,12 @@ var (
 	//
 	// Both operations are 0(1) since we operate on the
 	// left side of an ordered list.
+	//
+	// If an in-flight set is given, the popped job is added to it with the
+	// given deadline.
 	zpop = redis.NewScript(`
 		local key = KEYS[1]
+		local inflightKey = KEYS[2]
 		local max_score = ARGV[1]
 
 		-- Get the Job with the smallest score
@@ -83,14 +197,164 @@ var (
 
 		-- We have a Job!
 		redis.call("zremrangebyrank", key, 0, 0)
+		if inflightKey then
+			redis.call("zadd", inflightKey, ARGV[2], job)
+		end
+		return job
+		`)
+
+	// Atomically pop a job from the queue of an aggregation, occupying one
+	// of its slots
+	//
+	// Expired slot leases are freed first. If all slots are occupied, no
+	// job is popped and NOSLOT is returned. Otherwise, the popped job
+	// occupies a slot until the lease expires, unless it is renewed or
+	// released earlier. It is also added to the in-flight set with the
+	// given deadline.
+	//
+	// The ready job with the highest priority is popped, by looking up the
+	// band of each priority in turn (see priorityBand). Among jobs of the
+	// same priority, the one that has been ready for the longest is
+	// popped.
+	//
+	// If the aggregation is throttled, no job is popped and THROTTLED is
+	// returned.
+	//
+	// Apart from NOSLOT, THROTTLED and priorities, it behaves like zpop.
+	zpopslot = redis.NewScript(`
+		local key = KEYS[1]
+		local slotsKey = KEYS[2]
+		local inflightKey = KEYS[3]
+		local throttleKey = KEYS[4]
+		local now = tonumber(ARGV[1])
+		local expiry = ARGV[2]
+		local limit = tonumber(ARGV[3])
+		local maxPriority = tonumber(ARGV[6])
+		local band = tonumber(ARGV[7])
+
+		redis.call("zremrangebyscore", slotsKey, "-inf", now)
+
+		local job
+		for p = maxPriority, 0, -1 do
+			local min = -p * band
+			local top = redis.call("zrangebyscore", key, min, min + now, "limit", 0, 1)
+			if #top > 0 then
+				job = top[1]
+				break
+			end
+		end
+
+		if not job then
+			-- Empty ZSET
+			if redis.call("zcard", key) == 0 then
+				return redis.error_reply("EMPTY")
+			end
+
+			-- No job is ready yet
+			return redis.error_reply("RETRYLATER")
+		end
+
+		if redis.call("exists", throttleKey) == 1 then
+			return redis.error_reply("THROTTLED")
+		end
+
+		-- All slots are occupied
+		if redis.call("zcard", slotsKey) >= limit then
+			return redis.error_reply("NOSLOT")
+		end
+
+		redis.call("zrem", key, job)
+		redis.call("zadd", slotsKey, expiry, job)
+		redis.call("pexpire", slotsKey, ARGV[4])
+		redis.call("zadd", inflightKey, ARGV[5], job)
 		return job
 		`)
 
+	// Atomically throttle an aggregation for the given number of
+	// milliseconds, unless it is already throttled for longer
+	//
+	// Returns 1 if the aggregation was throttled, 0 otherwise.
+	throttle = redis.NewScript(`
+		local throttleKey = KEYS[1]
+		local ms = tonumber(ARGV[1])
+
+		if redis.call("pttl", throttleKey) >= ms then
+			return 0
+		end
+		redis.call("set", throttleKey, 1, "px", ms)
+		return 1
+		`)
+
+	// Atomically requeue the in-flight downloads whose deadline expired
+	//
+	// Jobs whose download is already complete (e.g. their processor died
+	// right after completing it) are only removed from the in-flight set.
+	// Requeued jobs free their aggregation slot and their aggregation is
+	// announced, like in QueuePendingDownload.
+	//
+	// Returns the number of requeued jobs.
+	requeueDownloads = redis.NewScript(`
+		local inflightKey = KEYS[1]
+		local activeKey = KEYS[2]
+		local now = ARGV[1]
+		local jobPrefix = ARGV[2]
+		local jobsPrefix = ARGV[3]
+		local slotsPrefix = ARGV[4]
+		local channel = ARGV[5]
+		local band = tonumber(ARGV[6])
+
+		local count = 0
+		for _, id in ipairs(redis.call("zrangebyscore", inflightKey, "-inf", now)) do
+			redis.call("zrem", inflightKey, id)
+
+			local fields = redis.call("hmget", jobPrefix .. id, "AggrID", "DownloadState", "Priority")
+			local aggr = fields[1]
+			local state = fields[2]
+			local priority = tonumber(fields[3]) or 0
+			if aggr and (state == "Pending" or state == "InProgress") then
+				redis.call("hset", jobPrefix .. id, "DownloadState", "Pending")
+				redis.call("zadd", jobsPrefix .. aggr, tostring(math.floor(tonumber(now)) - priority * band), id)
+				redis.call("zrem", slotsPrefix .. aggr, id)
+				redis.call("sadd", activeKey, aggr)
+				redis.call("publish", channel, aggr)
+				count = count + 1
+			end
+		end
+		return count
+		`)
+
+	// Atomically requeue the in-flight callbacks whose deadline expired
+	//
+	// Jobs whose callback is already complete are only removed from the
+	// in-flight set.
+	//
+	// Returns the number of requeued jobs.
+	requeueCallbacks = redis.NewScript(`
+		local inflightKey = KEYS[1]
+		local queueKey = KEYS[2]
+		local now = ARGV[1]
+		local jobPrefix = ARGV[2]
+
+		local count = 0
+		for _, id in ipairs(redis.call("zrangebyscore", inflightKey, "-inf", now)) do
+			redis.call("zrem", inflightKey, id)
+
+			local state = redis.call("hget", jobPrefix .. id, "CallbackState")
+			if state == "Pending" or state == "InProgress" then
+				redis.call("hset", jobPrefix .. id, "CallbackState", "Pending")
+				redis.call("zadd", queueKey, now, id)
+				count = count + 1
+			end
+		end
+		return count
+		`)
+
 	// Atomically delete the aggregation key
 	//
 	// Every aggregation has a corresponding job. Before deleting an
 	// aggregation we want to ensure that there are no related jobs in the
-	// jobs queue.
+	// jobs queue. The aggregation is also removed from the set of active
+	// aggregations.
 	//
 	// The operation has to be executed atomically since a new job may be
 	// added right before we delete the aggregation, leaving the newly added
@@ -98,6 +362,8 @@ var (
 	delaggr = redis.NewScript(`
 			local jobsKey = KEYS[1]
 			local aggrKey = KEYS[2]
+			local activeKey = KEYS[3]
+			local aggrID = ARGV[1]
 
 			-- Get number of jobs in the queue
 			local count = redis.call("zcount", jobsKey, "-inf", "+inf")
@@ -107,23 +373,220 @@ var (
 			  return 0
 			end
 
+			redis.call("srem", activeKey, aggrID)
+
+			-- Paused aggregations keep their settings until resumed, and
+			-- persisted ones until they are replaced
+			local state = redis.call("hmget", aggrKey, "Paused", "Persisted")
+			if state[1] == "1" or state[2] == "1" then
+			  return 0
+			end
+
 			-- Remove aggregation
 			redis.call("del", aggrKey)
 			return 1
 		`)
 
+	// Atomically take a token from the token bucket of an aggregation
+	//
+	// The bucket holds up to burst tokens and is refilled at a constant
+	// rate (tokens per second). Since it is shared among all processors,
+	// the current time is provided by the caller, as a fractional Unix
+	// timestamp.
+	//
+	// Returns 0 if a token was taken, or else the number of milliseconds
+	// after which a token will be available.
+	takeToken = redis.NewScript(`
+		local key = KEYS[1]
+		local rate = tonumber(ARGV[1])
+		local burst = tonumber(ARGV[2])
+		local now = tonumber(ARGV[3])
+
+		local bucket = redis.call("hmget", key, "tokens", "ts")
+		local tokens = tonumber(bucket[1]) or burst
+		local ts = tonumber(bucket[2]) or now
+
+		-- Refill the bucket. Clocks of different processors may be
+		-- slightly skewed, so time never goes backwards.
+		if now > ts then
+			tokens = math.min(burst, tokens + (now - ts) * rate)
+			ts = now
+		end
+
+		local wait = 0
+		if tokens >= 1 then
+			tokens = tokens - 1
+		else
+			wait = math.ceil((1 - tokens) / rate * 1000)
+		end
+
+		-- Lua numbers are truncated to integers when passed to Redis
+		redis.call("hmset", key, "tokens", tostring(tokens), "ts", tostring(ts))
+		redis.call("pexpire", key, math.ceil(burst / rate * 1000) + 1000)
+		return wait
+		`)
+
+	// Atomically pause or resume an aggregation. Missing aggregations are
+	// created as placeholders when paused.
+	//
+	// Returns 0 if the aggregation to be resumed does not exist, 1
+	// otherwise.
+	setpaused = redis.NewScript(`
+		local aggrKey = KEYS[1]
+		local paused = ARGV[1]
+		local id = ARGV[2]
+		local limit = ARGV[3]
+
+		if redis.call("exists", aggrKey) == 0 then
+			if paused ~= "1" then
+				return 0
+			end
+
+			-- Idle aggregations are created with the default settings,
+			-- until a job is enqueued in them
+			redis.call("hmset", aggrKey, "ID", id, "Limit", limit, "Placeholder", "1")
+		end
+
+		redis.call("hset", aggrKey, "Paused", paused)
+		return 1
+		`)
+
+	// Atomically replace the settings of a placeholder aggregation, which
+	// is created by pausing an idle aggregation. ARGV holds the field-value
+	// pairs of the new settings.
+	//
+	// Returns 0 if the aggregation is not a placeholder, 1 otherwise.
+	replaceplaceholder = redis.NewScript(`
+		local aggrKey = KEYS[1]
+
+		if redis.call("hget", aggrKey, "Placeholder") ~= "1" then
+			return 0
+		end
+
+		redis.call("hmset", aggrKey, unpack(ARGV))
+		return 1
+		`)
+
+	// Atomically occupy up to n free slots of an aggregation on behalf of
+	// a job, e.g. for the segments of its download
+	//
+	// Returns the members of the occupied slots.
+	takeSlots = redis.NewScript(`
+		local slotsKey = KEYS[1]
+		local now = ARGV[1]
+		local expiry = ARGV[2]
+		local limit = tonumber(ARGV[3])
+		local ttl = ARGV[4]
+		local owner = ARGV[5]
+		local n = tonumber(ARGV[6])
+
+		redis.call("zremrangebyscore", slotsKey, "-inf", now)
+
+		local free = limit - redis.call("zcard", slotsKey)
+		local members = {}
+		for i = 1, math.min(n, free) do
+			local member = owner .. ":" .. i
+			redis.call("zadd", slotsKey, expiry, member)
+			members[#members + 1] = member
+		end
+		if #members > 0 then
+			redis.call("pexpire", slotsKey, ttl)
+		end
+		return members
+		`)
+
+	// Atomically claim the due schedules by extending their score until
+	// the end of their lease
+	//
+	// Returns the IDs of the claimed schedules.
+	claimSchedules = redis.NewScript(`
+		local key = KEYS[1]
+		local now = ARGV[1]
+		local leaseUntil = ARGV[2]
+
+		local ids = redis.call("zrangebyscore", key, "-inf", now)
+		for _, id in ipairs(ids) do
+			redis.call("zadd", key, leaseUntil, id)
+		end
+		return ids
+		`)
+
+	// Atomically record a run of a schedule and reschedule it, unless it
+	// was removed in the meantime
+	//
+	// Returns 0 if the schedule does not exist, 1 otherwise.
+	rescheduleSchedule = redis.NewScript(`
+		local scheduleKey = KEYS[1]
+		local schedulesKey = KEYS[2]
+		local id = ARGV[1]
+		local lastJobID = ARGV[2]
+		local lastRunAt = ARGV[3]
+		local nextRunAt = ARGV[4]
+
+		if redis.call("exists", scheduleKey) == 0 then
+			return 0
+		end
+
+		redis.call("hmset", scheduleKey, "LastJobID", lastJobID, "LastRunAt", lastRunAt, "NextRunAt", nextRunAt)
+		redis.call("zadd", schedulesKey, nextRunAt, id)
+		return 1
+		`)
+
+	// Atomically add a reference to a blob, unless it is being deleted
+	//
+	// Returns the number of references of the blob.
+	acquireBlob = redis.NewScript(`
+		local blobKey = KEYS[1]
+
+		if tonumber(redis.call("get", blobKey) or 0) < 0 then
+			return redis.error_reply("DELETING")
+		end
+		return redis.call("incr", blobKey)
+		`)
+
+	// Atomically remove a reference to a blob. If it was the last one, the
+	// blob is marked as being deleted, so that it cannot be referenced
+	// until it is removed.
+	//
+	// Returns the number of remaining references of the blob.
+	releaseBlob = redis.NewScript(`
+		local blobKey = KEYS[1]
+		local ttl = ARGV[1]
+
+		local count = tonumber(redis.call("get", blobKey) or 0)
+		if count > 1 then
+			return redis.call("decr", blobKey)
+		end
+		redis.call("set", blobKey, -1, "px", ttl)
+		return 0
+		`)
+
 	// ErrEmptyQueue is returned by ZPOP when there is no job in the queue
 	ErrEmptyQueue = errors.New("Queue is empty")
 	// ErrRetryLater is returned by ZPOP when there are only future jobs in the queue
 	ErrRetryLater = errors.New("Retry again later")
+	// ErrNoSlot is returned by PopJob when all the slots of the
+	// aggregation are occupied
+	ErrNoSlot = errors.New("No free slot")
 	// ErrNotFound is returned by GetJob and GetAggregation when a requested
 	// job, or aggregation respectively is not found in Redis.
 	ErrNotFound = errors.New("Not Found")
+	// ErrThrottled is returned by PopJob when the aggregation is
+	// throttled
+	ErrThrottled = errors.New("Aggregation is throttled")
+	// ErrBlobDeleted is returned by AcquireBlob when the blob is being
+	// deleted
+	ErrBlobDeleted = errors.New("Blob is being deleted")
 )
 
 // Storage wraps a redis.Client instance.
 type Storage struct {
 	Redis *redis.Client
+
+	// JobTTL is the time after which finished jobs, along with their
+	// download attempts, expire since they were last updated. Zero means
+	// that jobs never expire. Jobs that are still queued never expire.
+	JobTTL time.Duration
 }
 
 // New returns a new Storage that can communicate with Redis. If Redis
@@ -146,11 +609,45 @@ func New(r *redis.Client) (*Storage, error) {
 //
 // TODO: should we check that the corresponding aggregation exists in redis?
 func (s *Storage) SaveJob(j *job.Job) error {
+	return s.saveJob(s.Redis, j)
+}
+
+// saveJob updates or creates j using c, which may also be a pipeline.
+func (s *Storage) saveJob(c redis.Cmdable, j *job.Job) error {
 	m, err := structToMap(j)
 	if err != nil {
 		return err
 	}
-	return s.Redis.HMSet(JobKeyPrefix+j.ID, m).Err()
+	if err = c.HMSet(JobKeyPrefix+j.ID, m).Err(); err != nil {
+		return err
+	}
+	if s.JobTTL <= 0 {
+		return nil
+	}
+
+	// Jobs that are queued or in progress must not expire, even if their
+	// callback failed before they were retried
+	for _, key := range []string{JobKeyPrefix + j.ID, HistoryKeyPrefix + j.ID} {
+		if finished(j) {
+			err = c.Expire(key, s.JobTTL).Err()
+		} else {
+			err = c.Persist(key).Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finished reports whether j reached a final state, i.e. its callback was
+// performed or it is not going to be.
+func finished(j *job.Job) bool {
+	switch j.CallbackState {
+	case job.StateSuccess, job.StateFailed, job.StateCancelled:
+		return true
+	}
+	return false
 }
 
 // GetJob fetches the job with the given id from Redis.
@@ -169,9 +666,43 @@ func (s *Storage) GetJob(id string) (job.Job, error) {
 	return jobFromMap(val)
 }
 
-// RemoveJob removes the job key from Redis.
+// RemoveJob removes the job key, along with its download attempts, from Redis.
 func (s *Storage) RemoveJob(id string) error {
-	return s.Redis.Del(JobKeyPrefix + id).Err()
+	return s.Redis.Del(JobKeyPrefix+id, HistoryKeyPrefix+id).Err()
+}
+
+// AddAttempt appends a to the download attempts of the job with the given id.
+// Only the most recent attempts of each job are kept.
+func (s *Storage) AddAttempt(id string, a job.Attempt) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+	pipe.RPush(HistoryKeyPrefix+id, b)
+	pipe.LTrim(HistoryKeyPrefix+id, -maxHistoryLength, -1)
+	_, err = pipe.Exec()
+	return err
+}
+
+// GetAttempts fetches the download attempts of the job with the given id,
+// oldest first.
+func (s *Storage) GetAttempts(id string) ([]job.Attempt, error) {
+	vals, err := s.Redis.LRange(HistoryKeyPrefix+id, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := make([]job.Attempt, len(vals))
+	for i, v := range vals {
+		err = json.Unmarshal([]byte(v), &attempts[i])
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode attempt: %v", err)
+		}
+	}
+	return attempts, nil
 }
 
 // JobExists checks if the given job exists in Redis.
@@ -180,6 +711,84 @@ func (s *Storage) JobExists(j *job.Job) (bool, error) {
 	return s.exists(JobKeyPrefix + j.ID)
 }
 
+// JobsExist is the pipelined version of JobExists for multiple jobs. The
+// returned values correspond to the given jobs, in order.
+// If a non-nil error is returned, the first returned value should be ignored.
+func (s *Storage) JobsExist(jobs []*job.Job) ([]bool, error) {
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+
+	cmds := make([]*redis.IntCmd, len(jobs))
+	for i, j := range jobs {
+		cmds[i] = pipe.Exists(JobKeyPrefix + j.ID)
+	}
+	_, err := pipe.Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	exist := make([]bool, len(jobs))
+	for i, cmd := range cmds {
+		exist[i] = cmd.Val() > 0
+	}
+	return exist, nil
+}
+
+// FilesInUse reports whether the files of the jobs with the given ids are in
+// use, i.e. whether the jobs exist or are queued for deletion. The returned
+// values correspond to the given ids, in order.
+func (s *Storage) FilesInUse(ids []string) ([]bool, error) {
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+
+	exists := make([]*redis.IntCmd, len(ids))
+	queued := make([]*redis.FloatCmd, len(ids))
+	for i, id := range ids {
+		exists[i] = pipe.Exists(JobKeyPrefix + id)
+		queued[i] = pipe.ZScore(RIPQueue, id)
+	}
+	// Jobs that are not queued for deletion result in redis.Nil
+	_, err := pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	inUse := make([]bool, len(ids))
+	for i := range ids {
+		if err := exists[i].Err(); err != nil {
+			return nil, err
+		}
+		if err := queued[i].Err(); err != nil && err != redis.Nil {
+			return nil, err
+		}
+		inUse[i] = exists[i].Val() > 0 || queued[i].Err() == nil
+	}
+	return inUse, nil
+}
+
+// BlobsInUse reports whether the blobs with the given SHA-256 checksums are
+// referenced by any job. The returned values correspond to the given
+// checksums, in order.
+func (s *Storage) BlobsInUse(sums []string) ([]bool, error) {
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+
+	cmds := make([]*redis.IntCmd, len(sums))
+	for i, sum := range sums {
+		cmds[i] = pipe.Exists(BlobKeyPrefix + sum)
+	}
+	_, err := pipe.Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := make([]bool, len(sums))
+	for i, cmd := range cmds {
+		inUse[i] = cmd.Val() > 0
+	}
+	return inUse, nil
+}
+
 // AggregationExists checks if the given aggregation exists in Redis.
 // If a non-nil error is returned, the first returned value should be ignored.
 func (s *Storage) AggregationExists(a *job.Aggregation) (bool, error) {
@@ -192,17 +801,76 @@ func (s *Storage) AggregationExists(a *job.Aggregation) (bool, error) {
 //
 // TODO: should we check that job already exists in redis? maybe do HSET instead?
 func (s *Storage) QueuePendingDownload(j *job.Job, delay time.Duration) error {
-	j.DownloadState = job.StatePending
-	err := s.SaveJob(j)
-	if err != nil {
-		return err
+	return s.QueuePendingDownloads([]*job.Job{j}, delay)
+}
+
+// QueuePendingDownloads is the pipelined version of QueuePendingDownload for
+// multiple jobs.
+func (s *Storage) QueuePendingDownloads(jobs []*job.Job, delay time.Duration) error {
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+
+	aggrs := make(map[string]bool)
+	for _, j := range jobs {
+		j.DownloadState = job.StatePending
+		err := s.saveJob(pipe, j)
+		if err != nil {
+			return err
+		}
+
+		// Queued jobs are no longer in flight
+		pipe.ZRem(SlotsKeyPrefix+j.AggrID, j.ID)
+		pipe.ZRem(InFlightDownloads, j.ID)
+
+		z := redis.Z{
+			Member: j.ID,
+			Score:  queueScore(j, time.Now().Add(delay)),
+		}
+		pipe.ZAdd(JobsKeyPrefix+j.AggrID, z)
+		aggrs[j.AggrID] = true
 	}
 
-	z := redis.Z{
-		Member: j.ID,
-		Score:  float64(time.Now().Add(delay).Unix()),
+	// Register the aggregations as active and notify the processors
+	for id := range aggrs {
+		pipe.SAdd(ActiveAggregations, id)
+		pipe.Publish(JobsChannel, id)
+	}
+
+	_, err := pipe.Exec()
+	return err
+}
+
+// GetActiveAggregations returns the IDs of the aggregations that have
+// queued jobs.
+func (s *Storage) GetActiveAggregations() ([]string, error) {
+	return s.Redis.SMembers(ActiveAggregations).Result()
+}
+
+// IsActiveAggregation reports whether the aggregation with the given id
+// has queued jobs.
+func (s *Storage) IsActiveAggregation(id string) (bool, error) {
+	return s.Redis.SIsMember(ActiveAggregations, id).Result()
+}
+
+// IndexActiveAggregations adds the aggregations that have queued jobs but
+// are missing from the ActiveAggregations set (e.g. their jobs were queued
+// by a previous version) to it. It scans the whole keyspace, so it should
+// only be used on startup.
+func (s *Storage) IndexActiveAggregations() (int, error) {
+	var ids []interface{}
+	iter := s.Redis.Scan(0, JobsKeyPrefix+"*", 50).Iterator()
+	for iter.Next() {
+		ids = append(ids, strings.TrimPrefix(iter.Val(), JobsKeyPrefix))
+	}
+	if err := iter.Err(); err != nil {
+		return 0, fmt.Errorf("Could not scan for aggregation keys: %s", err)
 	}
-	return s.Redis.ZAdd(JobsKeyPrefix+j.AggrID, z).Err()
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	n, err := s.Redis.SAdd(ActiveAggregations, ids...).Result()
+	return int(n), err
 }
 
 // QueuePendingCallback sets the state of a job to "Pending", saves it and adds it to its aggregation queue
@@ -214,70 +882,361 @@ func (s *Storage) QueuePendingCallback(j *job.Job, delay time.Duration) error {
 		return err
 	}
 
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+
+	// Queued callbacks are no longer in flight
+	pipe.ZRem(InFlightCallbacks, j.ID)
+
 	z := redis.Z{
 		Member: j.ID,
 		Score:  float64(time.Now().Add(delay).Unix()),
 	}
-	return s.Redis.ZAdd(CallbackQueue, z).Err()
+	pipe.ZAdd(CallbackQueue, z)
+
+	_, err = pipe.Exec()
+	return err
 }
 
-// QueueJobForDeletion pushes the provided job id to RIPQueue and returns any errors
+// QueueJobForDeletion pushes the id of the provided job to RIPQueue, along
+// with its blob if any, and returns any errors.
 // The job deletion can be delayed by the specified delay minutes.
-func (s *Storage) QueueJobForDeletion(id string, delay time.Duration) error {
+func (s *Storage) QueueJobForDeletion(j *job.Job, delay time.Duration) error {
 	z := redis.Z{
-		Member: id,
+		Member: j.ID,
 		Score:  float64(time.Now().Add(delay).Unix()),
 	}
-	return s.Redis.ZAdd(RIPQueue, z).Err()
+	if j.Blob == "" {
+		return s.Redis.ZAdd(RIPQueue, z).Err()
+	}
+
+	pipe := s.Redis.TxPipeline()
+	defer pipe.Close()
+	pipe.HSet(RIPBlobs, j.ID, j.Blob)
+	pipe.ZAdd(RIPQueue, z)
+	_, err := pipe.Exec()
+	return err
 }
 
-// PopCallback attempts to pop a Job from the callback queue.
-// If it succeeds the job with the popped ID is returned.
-func (s *Storage) PopCallback() (job.Job, error) {
-	return s.pop(CallbackQueue)
+// RemovePendingDownload removes j from its aggregation queue and reports
+// whether j was actually queued.
+func (s *Storage) RemovePendingDownload(j *job.Job) (bool, error) {
+	n, err := s.Redis.ZRem(JobsKeyPrefix+j.AggrID, j.ID).Result()
+	return n > 0, err
 }
 
-// PopJob attempts to pop a Job for that aggregation.
-// If it succeeds the job with the popped ID is returned.
-func (s *Storage) PopJob(a *job.Aggregation) (job.Job, error) {
-	return s.pop(JobsKeyPrefix + a.ID)
+// RemovePendingCallback removes j from the callback queue and reports whether
+// j was actually queued.
+func (s *Storage) RemovePendingCallback(j *job.Job) (bool, error) {
+	n, err := s.Redis.ZRem(CallbackQueue, j.ID).Result()
+	return n > 0, err
 }
 
-// PopRip fetches a job from the RIPQueue ( if any ) and reports any errors.
-// If the queue is empty an ErrEmptyQueue error is returned.
-// Notice: Due to the nature of job deletion, the returned job is not guaranteed to
-// be available in Redis.
-func (s *Storage) PopRip() (job.Job, error) {
-	j, err := s.pop(RIPQueue)
-	if err != nil && err != ErrNotFound {
-		return job.Job{}, err
+// RequestCancellation signals the processors that the download of the job
+// with the given id must be cancelled. If callback is true, the job's callback
+// is to be performed after it is cancelled.
+func (s *Storage) RequestCancellation(id string, callback bool) error {
+	err := s.Redis.Set(CancelKeyPrefix+id, callback, cancellationTTL).Err()
+	if err != nil {
+		return err
 	}
-
-	return j, nil
+	return s.Redis.Publish(CancellationChannel, id).Err()
 }
 
-// GetAggregation fetches from Redis the aggregation denoted by id.
-// In the case of ErrNotFound, the returned aggregation has valid ID and the
-// default limit.
-func (s *Storage) GetAggregation(id string) (*job.Aggregation, error) {
-	val, err := s.Redis.HGetAll(AggrKeyPrefix + id).Result()
+// CancellationRequested reports whether the cancellation of the job with the
+// given id was requested and if so, whether a callback should be performed.
+func (s *Storage) CancellationRequested(id string) (requested bool, callback bool, err error) {
+	val, err := s.Redis.Get(CancelKeyPrefix + id).Result()
 	if err != nil {
-		return nil, err
+		if err == redis.Nil {
+			return false, false, nil
+		}
+		return false, false, err
 	}
+	return true, val == "1", nil
+}
 
-	if v, ok := val["ID"]; !ok || v == "" {
-		aggr, err := job.NewAggregation(id, aggrDefaultLimit, "")
-		if err != nil {
-			return nil, err
-		}
-		return aggr, ErrNotFound
+// CancellationsRequested reports whether the cancellation of each one of the
+// jobs with the given ids was requested.
+func (s *Storage) CancellationsRequested(ids []string) ([]bool, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = CancelKeyPrefix + id
 	}
 
-	aggr, err := AggregationFromMap(val)
-	return &aggr, err
+	vals, err := s.Redis.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	requested := make([]bool, len(ids))
+	for i, v := range vals {
+		requested[i] = v != nil
+	}
+	return requested, nil
 }
 
-// SaveAggregation updates/creates the current aggregation in redis.
+// QueueCancelledJob sets the download state of j to "Cancelled" and saves it.
+// If callback is true, j is added to the callback queue, otherwise it is
+// queued for deletion.
+func (s *Storage) QueueCancelledJob(j *job.Job, callback bool) error {
+	j.DownloadState = job.StateCancelled
+	j.DownloadMeta = "Job was cancelled"
+
+	err := s.Redis.Del(CancelKeyPrefix + j.ID).Err()
+	if err != nil {
+		return err
+	}
+
+	if callback {
+		return s.QueuePendingCallback(j, 0)
+	}
+
+	j.CallbackState = job.StateCancelled
+	err = s.SaveJob(j)
+	if err != nil {
+		return err
+	}
+	return s.QueueJobForDeletion(j, 0)
+}
+
+// PopCallback attempts to pop a Job from the callback queue.
+// If it succeeds the job with the popped ID is returned.
+//
+// The popped job is in flight until it is released by ReleaseCallback. If
+// its deadline is not extended by RenewCallbacks, it is requeued after
+// VisibilityTimeout by RequeueExpiredCallbacks.
+func (s *Storage) PopCallback() (job.Job, error) {
+	return s.pop(CallbackQueue, InFlightCallbacks)
+}
+
+// ReleaseCallback removes the job with the given id from the in-flight
+// callbacks.
+func (s *Storage) ReleaseCallback(id string) error {
+	return s.Redis.ZRem(InFlightCallbacks, id).Err()
+}
+
+// RenewCallbacks extends the deadline of the in-flight callbacks of the jobs
+// with the given ids by VisibilityTimeout.
+func (s *Storage) RenewCallbacks(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	deadline := unixSeconds(time.Now().Add(VisibilityTimeout))
+	members := make([]redis.Z, len(ids))
+	for i, id := range ids {
+		members[i] = redis.Z{Member: id, Score: deadline}
+	}
+	return s.Redis.ZAddXX(InFlightCallbacks, members...).Err()
+}
+
+// RequeueExpiredCallbacks queues again the callbacks whose deadline expired,
+// and returns their number.
+func (s *Storage) RequeueExpiredCallbacks() (int, error) {
+	n, err := requeueCallbacks.Run(s.Redis, []string{InFlightCallbacks, CallbackQueue},
+		unixSeconds(time.Now()), JobKeyPrefix).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("Could not requeueCallbacks: %s", err)
+	}
+	return int(n), nil
+}
+
+// PopJob attempts to pop a Job for that aggregation.
+// If it succeeds the job with the popped ID is returned.
+//
+// The popped job occupies one of the Limit slots of the aggregation, which
+// are shared among all processors, and is in flight until it is released by
+// ReleaseDownload. The slot is freed automatically after SlotTTL and the job
+// is requeued after VisibilityTimeout by RequeueExpiredDownloads, unless
+// they are renewed by RenewDownloads. If all slots are occupied, ErrNoSlot
+// is returned, while if the aggregation is throttled, ErrThrottled is
+// returned.
+func (s *Storage) PopJob(a *job.Aggregation) (job.Job, error) {
+	now := time.Now()
+	val, err := zpopslot.Run(s.Redis,
+		[]string{JobsKeyPrefix + a.ID, SlotsKeyPrefix + a.ID, InFlightDownloads, ThrottleKeyPrefix + a.ID},
+		unixSeconds(now), unixSeconds(now.Add(SlotTTL)), a.Limit,
+		int64(2*SlotTTL/time.Millisecond), unixSeconds(now.Add(VisibilityTimeout)),
+		job.MaxPriority, priorityBand).Result()
+	if err != nil {
+		switch err.Error() {
+		case "EMPTY":
+			return job.Job{}, ErrEmptyQueue
+		case "RETRYLATER":
+			return job.Job{}, ErrRetryLater
+		case "NOSLOT":
+			return job.Job{}, ErrNoSlot
+		case "THROTTLED":
+			return job.Job{}, ErrThrottled
+		default:
+			return job.Job{}, fmt.Errorf("Could not zpopslot: %s", err)
+		}
+	}
+
+	// ZPOPSLOT should always return a string
+	jobID, ok := val.(string)
+	if !ok {
+		panic(fmt.Sprintf("zpopslot replied with '%#v', it should be a string!", val))
+	}
+
+	j, err := s.GetJob(jobID)
+	if err != nil {
+		s.ReleaseDownload(&job.Job{ID: jobID, AggrID: a.ID})
+	}
+	return j, err
+}
+
+// ReleaseDownload frees the aggregation slot occupied by j, if any, and
+// removes it from the in-flight downloads.
+func (s *Storage) ReleaseDownload(j *job.Job) error {
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+
+	pipe.ZRem(SlotsKeyPrefix+j.AggrID, j.ID)
+	pipe.ZRem(InFlightDownloads, j.ID)
+
+	_, err := pipe.Exec()
+	return err
+}
+
+// TakeSlots occupies up to n of the free slots of a on behalf of the job j,
+// in addition to the slot occupied by j itself, and returns their members.
+// The slots must be renewed with RenewSlots and freed with ReleaseSlots.
+func (s *Storage) TakeSlots(a *job.Aggregation, j *job.Job, n int) ([]string, error) {
+	now := time.Now()
+	val, err := takeSlots.Run(s.Redis, []string{SlotsKeyPrefix + a.ID},
+		unixSeconds(now), unixSeconds(now.Add(SlotTTL)), a.Limit,
+		int64(2*SlotTTL/time.Millisecond), j.ID, n).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Could not takeSlots: %s", err)
+	}
+
+	var members []string
+	for _, m := range val.([]interface{}) {
+		members = append(members, m.(string))
+	}
+	return members, nil
+}
+
+// RenewSlots extends the leases of the slots of the aggregation with the
+// given id, which were occupied by TakeSlots, by SlotTTL.
+func (s *Storage) RenewSlots(aggrID string, members []string) error {
+	if len(members) == 0 {
+		return nil
+	}
+
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+
+	expiry := unixSeconds(time.Now().Add(SlotTTL))
+	for _, m := range members {
+		pipe.ZAddXX(SlotsKeyPrefix+aggrID, redis.Z{Member: m, Score: expiry})
+	}
+	pipe.PExpire(SlotsKeyPrefix+aggrID, 2*SlotTTL)
+
+	_, err := pipe.Exec()
+	return err
+}
+
+// ReleaseSlots frees the slots of the aggregation with the given id, which
+// were occupied by TakeSlots.
+func (s *Storage) ReleaseSlots(aggrID string, members []string) error {
+	if len(members) == 0 {
+		return nil
+	}
+
+	ms := make([]interface{}, len(members))
+	for i, m := range members {
+		ms[i] = m
+	}
+	return s.Redis.ZRem(SlotsKeyPrefix+aggrID, ms...).Err()
+}
+
+// RenewDownloads extends the leases of the aggregation slots occupied by jobs
+// by SlotTTL and their deadline as in-flight downloads by
+// VisibilityTimeout. Slots that have already been freed are not occupied
+// again and requeued jobs are not considered in flight again.
+func (s *Storage) RenewDownloads(jobs []*job.Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+
+	now := time.Now()
+	expiry := unixSeconds(now.Add(SlotTTL))
+	deadline := unixSeconds(now.Add(VisibilityTimeout))
+	for _, j := range jobs {
+		pipe.ZAddXX(SlotsKeyPrefix+j.AggrID, redis.Z{Member: j.ID, Score: expiry})
+		pipe.PExpire(SlotsKeyPrefix+j.AggrID, 2*SlotTTL)
+		pipe.ZAddXX(InFlightDownloads, redis.Z{Member: j.ID, Score: deadline})
+	}
+
+	_, err := pipe.Exec()
+	return err
+}
+
+// RequeueExpiredDownloads queues again the downloads whose deadline expired,
+// and returns their number.
+func (s *Storage) RequeueExpiredDownloads() (int, error) {
+	n, err := requeueDownloads.Run(s.Redis, []string{InFlightDownloads, ActiveAggregations},
+		unixSeconds(time.Now()), JobKeyPrefix, JobsKeyPrefix, SlotsKeyPrefix, JobsChannel,
+		priorityBand).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("Could not requeueDownloads: %s", err)
+	}
+	return int(n), nil
+}
+
+// PopRip fetches a job from the RIPQueue ( if any ) and reports any errors.
+// If the queue is empty an ErrEmptyQueue error is returned.
+// Notice: Due to the nature of job deletion, the returned job is not guaranteed to
+// be available in Redis. Its blob, if any, is always set.
+func (s *Storage) PopRip() (job.Job, error) {
+	j, err := s.pop(RIPQueue, "")
+	if err != nil && err != ErrNotFound {
+		return job.Job{}, err
+	}
+
+	pipe := s.Redis.TxPipeline()
+	defer pipe.Close()
+	blob := pipe.HGet(RIPBlobs, j.ID)
+	pipe.HDel(RIPBlobs, j.ID)
+	// Jobs without a blob result in redis.Nil
+	_, err = pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return job.Job{}, err
+	}
+	if blob.Val() != "" {
+		j.Blob = blob.Val()
+	}
+
+	return j, nil
+}
+
+// GetAggregation fetches from Redis the aggregation denoted by id.
+// In the case of ErrNotFound, the returned aggregation has valid ID and the
+// default limit.
+func (s *Storage) GetAggregation(id string) (*job.Aggregation, error) {
+	val, err := s.Redis.HGetAll(AggrKeyPrefix + id).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := val["ID"]; !ok || v == "" {
+		aggr, err := job.NewAggregation(id, aggrDefaultLimit, "")
+		if err != nil {
+			return nil, err
+		}
+		return aggr, ErrNotFound
+	}
+
+	aggr, err := AggregationFromMap(val)
+	return &aggr, err
+}
+
+// SaveAggregation updates/creates the current aggregation in redis.
 func (s *Storage) SaveAggregation(a *job.Aggregation) error {
 	m, err := structToMap(a)
 	if err != nil {
@@ -286,9 +1245,309 @@ func (s *Storage) SaveAggregation(a *job.Aggregation) error {
 	return s.Redis.HMSet(AggrKeyPrefix+a.ID, m).Err()
 }
 
+// QueueDepths returns the number of queued jobs of each active aggregation
+// that has any, keyed by aggregation ID.
+func (s *Storage) QueueDepths() (map[string]int64, error) {
+	ids, err := s.GetActiveAggregations()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.IntCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.ZCard(JobsKeyPrefix + id)
+	}
+	if len(ids) > 0 {
+		if _, err := pipe.Exec(); err != nil {
+			return nil, err
+		}
+	}
+
+	depths := make(map[string]int64, len(ids))
+	for i, id := range ids {
+		if n := cmds[i].Val(); n > 0 {
+			depths[id] = n
+		}
+	}
+	return depths, nil
+}
+
+// ReplacePlaceholderAggregation replaces the settings of the placeholder
+// aggregation with the ID of a, which is created by pausing an idle
+// aggregation, with those of a. Whether the aggregation is paused does not
+// change. It returns false if the aggregation is not a placeholder, e.g.
+// because its settings were already replaced in the meantime.
+func (s *Storage) ReplacePlaceholderAggregation(a *job.Aggregation) (bool, error) {
+	m, err := structToMap(a)
+	if err != nil {
+		return false, err
+	}
+	delete(m, "Paused")
+	m["Placeholder"] = false
+
+	args := make([]interface{}, 0, 2*len(m))
+	for k, v := range m {
+		args = append(args, k, v)
+	}
+
+	ok, err := replaceplaceholder.Run(s.Redis, []string{AggrKeyPrefix + a.ID}, args...).Int64()
+	if err != nil {
+		return false, fmt.Errorf("Could not replaceplaceholder: %s", err)
+	}
+	return ok == 1, nil
+}
+
+// SetAggregationPaused pauses or resumes the aggregation with the given id.
+// Pausing an aggregation that does not exist, e.g. because it has no pending
+// jobs, creates it as a placeholder with the default settings, which are
+// replaced by those of the next enqueued job, while resuming it returns
+// ErrNotFound. Processors are notified when an aggregation is resumed, so
+// that its queued jobs are picked up immediately.
+func (s *Storage) SetAggregationPaused(id string, paused bool) error {
+	ok, err := setpaused.Run(s.Redis, []string{AggrKeyPrefix + id}, paused, id, aggrDefaultLimit).Int64()
+	if err != nil {
+		return fmt.Errorf("Could not setpaused: %s", err)
+	}
+	if ok == 0 {
+		return ErrNotFound
+	}
+	if paused {
+		return nil
+	}
+	return s.Redis.Publish(JobsChannel, id).Err()
+}
+
+// GetValidators fetches the cache validators of the most recent download of
+// the given URL. If there are none, empty validators are returned.
+func (s *Storage) GetValidators(url string) (job.Validators, error) {
+	val, err := s.Redis.HGetAll(ValidatorsKeyPrefix + url).Result()
+	if err != nil {
+		return job.Validators{}, err
+	}
+	return job.Validators{ETag: val["ETag"], LastModified: val["LastModified"], JobID: val["JobID"],
+		Blob: val["Blob"]}, nil
+}
+
+// SaveValidators replaces the cache validators of the given URL with v. If v
+// is empty, the validators of the URL are removed.
+func (s *Storage) SaveValidators(url string, v job.Validators) error {
+	if v.Empty() {
+		return s.RemoveValidators(url)
+	}
+
+	m, err := structToMap(v)
+	if err != nil {
+		return err
+	}
+
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+	pipe.HMSet(ValidatorsKeyPrefix+url, m)
+	pipe.Expire(ValidatorsKeyPrefix+url, validatorsTTL)
+	_, err = pipe.Exec()
+	return err
+}
+
+// RemoveValidators removes the cache validators of the given URL.
+func (s *Storage) RemoveValidators(url string) error {
+	return s.Redis.Del(ValidatorsKeyPrefix + url).Err()
+}
+
+// AcquireBlob adds a reference to the blob with the given SHA-256 checksum
+// and returns its number of references. ErrBlobDeleted is returned if the
+// blob is being deleted.
+func (s *Storage) AcquireBlob(sum string) (int64, error) {
+	n, err := acquireBlob.Run(s.Redis, []string{BlobKeyPrefix + sum}).Int64()
+	if err != nil && err.Error() == "DELETING" {
+		return 0, ErrBlobDeleted
+	}
+	return n, err
+}
+
+// ReleaseBlob removes a reference to the blob with the given SHA-256
+// checksum and returns its number of remaining references. If there are
+// none, the blob is marked as being deleted, until RemoveBlob is called
+// after its file is deleted.
+func (s *Storage) ReleaseBlob(sum string) (int64, error) {
+	return releaseBlob.Run(s.Redis, []string{BlobKeyPrefix + sum},
+		int64(blobDeletionTTL/time.Millisecond)).Int64()
+}
+
+// RemoveBlob removes the reference count of the blob with the given SHA-256
+// checksum, after its file was deleted.
+func (s *Storage) RemoveBlob(sum string) error {
+	return s.Redis.Del(BlobKeyPrefix + sum).Err()
+}
+
+// ClaimBlob marks the blob with the given SHA-256 checksum as being deleted,
+// as ReleaseBlob does, if it is not referenced by any job. It reports
+// whether the blob was claimed, in which case RemoveBlob should be called
+// after its file is deleted.
+func (s *Storage) ClaimBlob(sum string) (bool, error) {
+	return s.Redis.SetNX(BlobKeyPrefix+sum, -1, blobDeletionTTL).Result()
+}
+
+// SaveSchedule updates or creates sc and schedules its next run.
+func (s *Storage) SaveSchedule(sc *job.Schedule) error {
+	m, err := structToMap(sc)
+	if err != nil {
+		return err
+	}
+
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+	pipe.HMSet(ScheduleKeyPrefix+sc.ID, m)
+	pipe.ZAdd(Schedules, redis.Z{Member: sc.ID, Score: float64(sc.NextRunAt)})
+	_, err = pipe.Exec()
+	return err
+}
+
+// ScheduleExists checks if the schedule with the given id exists in Redis.
+func (s *Storage) ScheduleExists(id string) (bool, error) {
+	return s.exists(ScheduleKeyPrefix + id)
+}
+
+// GetSchedule fetches the schedule with the given id from Redis. If it does
+// not exist, ErrNotFound is returned.
+func (s *Storage) GetSchedule(id string) (*job.Schedule, error) {
+	val, err := s.Redis.HGetAll(ScheduleKeyPrefix + id).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := val["ID"]; !ok || v == "" {
+		return nil, ErrNotFound
+	}
+
+	sc, err := scheduleFromMap(val)
+	return &sc, err
+}
+
+// GetSchedules fetches all schedules from Redis, in the order of their next
+// run.
+func (s *Storage) GetSchedules() ([]*job.Schedule, error) {
+	ids, err := s.Redis.ZRange(Schedules, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ScheduleKeyPrefix + id)
+	}
+	if len(ids) > 0 {
+		if _, err := pipe.Exec(); err != nil {
+			return nil, err
+		}
+	}
+
+	schedules := make([]*job.Schedule, 0, len(ids))
+	for _, cmd := range cmds {
+		val := cmd.Val()
+		if v, ok := val["ID"]; !ok || v == "" {
+			// Removed in the meantime
+			continue
+		}
+
+		sc, err := scheduleFromMap(val)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, &sc)
+	}
+	return schedules, nil
+}
+
+// RemoveSchedule removes the schedule with the given id. If it does not
+// exist, ErrNotFound is returned.
+func (s *Storage) RemoveSchedule(id string) error {
+	pipe := s.Redis.Pipeline()
+	defer pipe.Close()
+	del := pipe.Del(ScheduleKeyPrefix + id)
+	pipe.ZRem(Schedules, id)
+	_, err := pipe.Exec()
+	if err != nil {
+		return err
+	}
+	if del.Val() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ClaimDueSchedules returns the IDs of the schedules whose next run is due
+// at now. The returned schedules are not returned again by subsequent calls
+// for ScheduleLease, or until they are rescheduled with RescheduleSchedule.
+func (s *Storage) ClaimDueSchedules(now time.Time) ([]string, error) {
+	ids, err := claimSchedules.Run(s.Redis, []string{Schedules},
+		now.Unix(), now.Add(ScheduleLease).Unix()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Could not claimSchedules: %s", err)
+	}
+
+	var res []string
+	for _, id := range ids.([]interface{}) {
+		res = append(res, id.(string))
+	}
+	return res, nil
+}
+
+// RescheduleSchedule saves the run fields of sc and schedules its next run.
+// It does not recreate sc if it was removed in the meantime, in which case
+// ErrNotFound is returned.
+func (s *Storage) RescheduleSchedule(sc *job.Schedule) error {
+	ok, err := rescheduleSchedule.Run(s.Redis, []string{ScheduleKeyPrefix + sc.ID, Schedules},
+		sc.ID, sc.LastJobID, sc.LastRunAt, sc.NextRunAt).Int64()
+	if err != nil {
+		return fmt.Errorf("Could not rescheduleSchedule: %s", err)
+	}
+	if ok == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// TakeToken takes a token from the rate limit of a, which is shared among
+// all processors. If no token is available, the time after which one will
+// be available is returned instead.
+func (s *Storage) TakeToken(a *job.Aggregation) (time.Duration, error) {
+	wait, err := takeToken.Run(s.Redis, []string{RateLimitKeyPrefix + a.ID},
+		a.Rate, a.BurstSize(), unixSeconds(time.Now())).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("Could not take token: %s", err)
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// ThrottleAggregation stops the jobs of the aggregation with the given id
+// from being popped by any processor for d, unless the aggregation is
+// already throttled for longer. It reports whether the aggregation was
+// throttled.
+func (s *Storage) ThrottleAggregation(id string, d time.Duration) (bool, error) {
+	ok, err := throttle.Run(s.Redis, []string{ThrottleKeyPrefix + id}, int64(d/time.Millisecond)).Int64()
+	if err != nil {
+		return false, fmt.Errorf("Could not throttle: %s", err)
+	}
+	return ok == 1, nil
+}
+
+// AggregationThrottled returns the remaining time for which the aggregation
+// with the given id is throttled, or zero if it is not.
+func (s *Storage) AggregationThrottled(id string) (time.Duration, error) {
+	d, err := s.Redis.PTTL(ThrottleKeyPrefix + id).Result()
+	if err != nil || d < 0 {
+		return 0, err
+	}
+	return d, nil
+}
+
 // RemoveAggregation deletes the aggregation key from Redis
 func (s *Storage) RemoveAggregation(id string) error {
-	_, err := delaggr.Run(s.Redis, []string{JobsKeyPrefix + id, AggrKeyPrefix + id}).Result()
+	_, err := delaggr.Run(s.Redis, []string{JobsKeyPrefix + id, AggrKeyPrefix + id, ActiveAggregations}, id).Result()
 	if err != nil {
 		return fmt.Errorf("Could not delaggr: %s", err)
 	}
@@ -309,6 +1568,51 @@ func AggregationFromMap(m map[string]string) (job.Aggregation, error) {
 			}
 		case "Proxy":
 			aggr.Proxy = v
+		case "Retry":
+			err = aggr.Retry.UnmarshalJSON([]byte(v))
+			if err != nil {
+				return aggr, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "CallbackRetry":
+			err = aggr.CallbackRetry.UnmarshalJSON([]byte(v))
+			if err != nil {
+				return aggr, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Rate":
+			aggr.Rate, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return aggr, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Burst":
+			aggr.Burst, err = strconv.Atoi(v)
+			if err != nil {
+				return aggr, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Segments":
+			aggr.Segments, err = strconv.Atoi(v)
+			if err != nil {
+				return aggr, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Retention":
+			aggr.Retention, err = strconv.Atoi(v)
+			if err != nil {
+				return aggr, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Paused":
+			aggr.Paused, err = strconv.ParseBool(v)
+			if err != nil {
+				return aggr, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Persisted":
+			aggr.Persisted, err = strconv.ParseBool(v)
+			if err != nil {
+				return aggr, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Placeholder":
+			aggr.Placeholder, err = strconv.ParseBool(v)
+			if err != nil {
+				return aggr, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
 		default:
 			return aggr, fmt.Errorf("Field %s with value %s was not found in Aggregarion struct", k, v)
 		}
@@ -328,6 +1632,16 @@ func (s *Storage) RetryCallback(j *job.Job) error {
 		return errors.New("Job doesn't exist in Redis:" + j.ID)
 	}
 
+	// Jobs whose callback failed may be queued for deletion
+	pipe := s.Redis.TxPipeline()
+	defer pipe.Close()
+	pipe.ZRem(RIPQueue, j.ID)
+	pipe.HDel(RIPBlobs, j.ID)
+	_, err = pipe.Exec()
+	if err != nil {
+		return err
+	}
+
 	j.CallbackMeta = ""
 	j.CallbackCount = 0
 	return s.QueuePendingCallback(j, 0)
@@ -376,6 +1690,11 @@ func jobFromMap(m map[string]string) (job.Job, error) {
 			if err != nil {
 				return j, fmt.Errorf("Could not decode struct from map: %v", err)
 			}
+		case "ThrottleCount":
+			j.ThrottleCount, err = strconv.Atoi(v)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
 		case "DownloadMeta":
 			j.DownloadMeta = v
 		case "CallbackURL":
@@ -409,6 +1728,78 @@ func jobFromMap(m map[string]string) (job.Job, error) {
 			}
 		case "UserAgent":
 			j.UserAgent = v
+		case "IncludeAttempts":
+			j.IncludeAttempts, err = strconv.ParseBool(v)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "DownloadRetry":
+			err = j.DownloadRetry.UnmarshalJSON([]byte(v))
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "CallbackRetry":
+			err = j.CallbackRetry.UnmarshalJSON([]byte(v))
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Priority":
+			j.Priority, err = strconv.Atoi(v)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "RunAt":
+			j.RunAt, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "ExpiresAt":
+			j.ExpiresAt, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "IfNoneMatch":
+			j.IfNoneMatch = v
+		case "IfModifiedSince":
+			j.IfModifiedSince = v
+		case "NotModified":
+			j.NotModified, err = strconv.ParseBool(v)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "ResumeValidator":
+			j.ResumeValidator = v
+		case "Segments":
+			j.Segments, err = strconv.Atoi(v)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Retention":
+			j.Retention, err = strconv.Atoi(v)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "ChecksumAlgorithms":
+			j.ChecksumAlgorithms = v
+		case "ExpectedChecksum":
+			j.ExpectedChecksum = v
+		case "Checksums":
+			err = json.Unmarshal([]byte(v), &j.Checksums)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "IncludeMetadata":
+			j.IncludeMetadata, err = strconv.ParseBool(v)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Metadata":
+			err = json.Unmarshal([]byte(v), &j.Metadata)
+			if err != nil {
+				return j, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Blob":
+			j.Blob = v
 		default:
 			return j, fmt.Errorf("Field %s with value %s was not found in Job struct", k, v)
 		}
@@ -416,15 +1807,71 @@ func jobFromMap(m map[string]string) (job.Job, error) {
 	return j, nil
 }
 
+func scheduleFromMap(m map[string]string) (job.Schedule, error) {
+	var err error
+	sc := job.Schedule{}
+	for k, v := range m {
+		switch k {
+		case "ID":
+			sc.ID = v
+		case "Interval":
+			sc.Interval, err = strconv.Atoi(v)
+			if err != nil {
+				return sc, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "Cron":
+			sc.Cron = v
+		case "Job":
+			sc.Job = v
+		case "LastJobID":
+			sc.LastJobID = v
+		case "LastRunAt":
+			sc.LastRunAt, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return sc, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		case "NextRunAt":
+			sc.NextRunAt, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return sc, fmt.Errorf("Could not decode struct from map: %v", err)
+			}
+		default:
+			return sc, fmt.Errorf("Field %s with value %s was not found in Schedule struct", k, v)
+		}
+	}
+	return sc, nil
+}
+
+// queueScore returns the score of j in the queue of its aggregation, if it
+// is to be downloaded at t. Jobs are never downloaded before their RunAt.
+func queueScore(j *job.Job, t time.Time) float64 {
+	at := t.Unix()
+	if j.RunAt > at {
+		at = j.RunAt
+	}
+	return float64(at - int64(j.Priority)*priorityBand)
+}
+
+// unixSeconds returns t as a fractional Unix timestamp.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
 // Checks if key exists in Redis
 func (s *Storage) exists(key string) (bool, error) {
 	res, err := s.Redis.Exists(key).Result()
 	return res > 0, err
 }
 
-// POPs from list and returns the corresponding job
-func (s *Storage) pop(list string) (job.Job, error) {
-	val, err := zpop.Run(s.Redis, []string{list}, time.Now().Unix()).Result()
+// POPs from list and returns the corresponding job. If inflight is not
+// empty, the job is added to the in-flight set with that name.
+func (s *Storage) pop(list, inflight string) (job.Job, error) {
+	keys := []string{list}
+	if inflight != "" {
+		keys = append(keys, inflight)
+	}
+	val, err := zpop.Run(s.Redis, keys, time.Now().Unix(),
+		unixSeconds(time.Now().Add(VisibilityTimeout))).Result()
 
 	if err != nil {
 		switch err.Error() {
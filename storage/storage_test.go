@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"testing"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/skroutz/downloader/config"
@@ -18,7 +19,11 @@ var (
 		ID:          "TestJob",
 		URL:         "http://localhost:12345",
 		AggrID:      "TestAggr",
-		CallbackURL: "http://callback.localhost:12345"}
+		CallbackURL: "http://callback.localhost:12345",
+		DownloadRetry: job.RetryPolicy{
+			MaxAttempts: 5,
+			BaseDelay:   time.Minute,
+			Multiplier:  2}}
 )
 
 func init() {
@@ -88,6 +93,42 @@ func TestPendingJob(t *testing.T) {
 	}
 }
 
+func TestPopRipBlob(t *testing.T) {
+	Redis.FlushDB()
+
+	testJob := job.Job{ID: "TestJob", Blob: "TestBlob"}
+	err := storage.SaveJob(&testJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.QueueJobForDeletion(&testJob, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The job expires before it is deleted
+	err = storage.RemoveJob(testJob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rip, err := storage.PopRip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rip.ID != testJob.ID || rip.Blob != testJob.Blob {
+		t.Errorf("Expected to pop job %s with blob %s, got %#v", testJob.ID, testJob.Blob, rip)
+	}
+
+	n, err := Redis.HLen(RIPBlobs).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("Expected the blob of the popped job to be removed from %s, found %d blobs", RIPBlobs, n)
+	}
+}
+
 func TestRetryCallback(t *testing.T) {
 	Redis.FlushDB()
 
@@ -97,12 +138,20 @@ func TestRetryCallback(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	err = storage.QueueJobForDeletion(&testJob, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	err = storage.RetryCallback(&testJob)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if err = Redis.ZScore(RIPQueue, testJob.ID).Err(); err != redis.Nil {
+		t.Errorf("Expected job to be removed from the deletion queue, got %v", err)
+	}
+
 	queuedJob, err := storage.PopCallback()
 	if err != nil {
 		t.Fatal(err)
@@ -121,6 +170,52 @@ func TestRetryCallback(t *testing.T) {
 	}
 }
 
+func TestJobTTL(t *testing.T) {
+	Redis.FlushDB()
+
+	s := &Storage{Redis: Redis, JobTTL: time.Hour}
+	testJob := job.Job{ID: "TestJob", AggrID: "TestAggr"}
+
+	err := s.QueuePendingDownload(&testJob, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddAttempt(testJob.ID, job.Attempt{ResponseCode: 503})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTTL := func(expire bool) {
+		for _, key := range []string{JobKeyPrefix + testJob.ID, HistoryKeyPrefix + testJob.ID} {
+			ttl, err := Redis.TTL(key).Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expire && (ttl <= 0 || ttl > time.Hour) {
+				t.Errorf("Expected %s to expire after JobTTL, got TTL %s", key, ttl)
+			} else if !expire && ttl >= 0 {
+				t.Errorf("Expected %s not to expire, got TTL %s", key, ttl)
+			}
+		}
+	}
+
+	// The job is queued for longer than JobTTL
+	assertTTL(false)
+
+	testJob.DownloadState = job.StateSuccess
+	testJob.CallbackState = job.StateFailed
+	err = s.SaveJob(&testJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTTL(true)
+
+	err = s.RetryCallback(&testJob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTTL(false)
+}
+
 func TestRemoveAggregationWithNoJobs(t *testing.T) {
 	Redis.FlushDB()
 
@@ -172,3 +267,772 @@ func TestGetAggregation(t *testing.T) {
 		})
 	}
 }
+
+func TestCancellation(t *testing.T) {
+	Redis.FlushDB()
+
+	testJob := job.Job{ID: "TestJob", AggrID: "TestAggr"}
+
+	requested, _, err := storage.CancellationRequested(testJob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested {
+		t.Fatal("Expected cancellation not to have been requested")
+	}
+
+	err = storage.RequestCancellation(testJob.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requested, callback, err := storage.CancellationRequested(testJob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !requested || !callback {
+		t.Fatalf("Expected cancellation with callback to have been requested, got %v, %v", requested, callback)
+	}
+
+	polled, err := storage.CancellationsRequested([]string{"OtherJob", testJob.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if polled[0] || !polled[1] {
+		t.Fatalf("Expected only the cancellation of %s to have been requested, got %v", testJob.ID, polled)
+	}
+
+	err = storage.QueueCancelledJob(&testJob, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requested, _, err = storage.CancellationRequested(testJob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested {
+		t.Error("Expected cancellation request to have been cleared")
+	}
+
+	j, err := storage.GetJob(testJob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.DownloadState != job.StateCancelled {
+		t.Errorf("Expected download state %s, got %s", job.StateCancelled, j.DownloadState)
+	}
+
+	rip, err := storage.PopRip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rip.ID != testJob.ID {
+		t.Error("Expected cancelled job to have been queued for deletion")
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	Redis.FlushDB()
+
+	for i := 0; i < maxHistoryLength+5; i++ {
+		err := storage.AddAttempt(testJob.ID, job.Attempt{ResponseCode: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attempts, err := storage.GetAttempts(testJob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != maxHistoryLength {
+		t.Fatalf("Expected %d attempts, got %d", maxHistoryLength, len(attempts))
+	}
+	if attempts[len(attempts)-1].ResponseCode != maxHistoryLength+4 {
+		t.Errorf("Expected the most recent attempts to have been kept, got %#v", attempts)
+	}
+
+	err = storage.RemoveJob(testJob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attempts, err = storage.GetAttempts(testJob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 0 {
+		t.Errorf("Expected attempts to have been removed along with the job, got %d", len(attempts))
+	}
+}
+
+func TestTakeToken(t *testing.T) {
+	Redis.FlushDB()
+
+	aggr := &job.Aggregation{ID: "TestAggr", Limit: 4, Rate: 10, Burst: 2}
+
+	for i := 0; i < aggr.Burst; i++ {
+		wait, err := storage.TakeToken(aggr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != 0 {
+			t.Fatalf("Expected token %d to be taken, got wait %s", i, wait)
+		}
+	}
+
+	wait, err := storage.TakeToken(aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("Expected to wait up to 100ms for a token, got %s", wait)
+	}
+
+	time.Sleep(wait)
+
+	wait, err = storage.TakeToken(aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != 0 {
+		t.Errorf("Expected token to be taken after waiting, got wait %s", wait)
+	}
+}
+
+func TestSaveAggregation(t *testing.T) {
+	Redis.FlushDB()
+
+	aggr := &job.Aggregation{ID: "TestAggr", Limit: 4, Proxy: "http://proxy.example.com",
+		Rate: 0.5, Burst: 3, Retention: 60, Retry: job.RetryPolicy{MaxAttempts: 7}}
+
+	err := storage.SaveAggregation(aggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := storage.GetAggregation(aggr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *saved != *aggr {
+		t.Errorf("Expected aggregation to be %#v, got %#v", aggr, saved)
+	}
+}
+
+func TestPausedAggregation(t *testing.T) {
+	Redis.FlushDB()
+
+	err := storage.SetAggregationPaused("TestAggr", false)
+	if err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for resuming a missing aggregation, got %v", err)
+	}
+
+	err = storage.SetAggregationPaused("IdleAggr", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, err := storage.GetAggregation("IdleAggr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := job.Aggregation{ID: "IdleAggr", Limit: aggrDefaultLimit, Paused: true, Placeholder: true}
+	if *idle != expected {
+		t.Errorf("Expected idle aggregation to be created as %#v, got %#v", expected, *idle)
+	}
+
+	replacement := job.Aggregation{ID: "IdleAggr", Limit: 2, Rate: 1}
+	replaced, err := storage.ReplacePlaceholderAggregation(&replacement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replaced {
+		t.Error("Expected placeholder aggregation to have been replaced")
+	}
+	idle, err = storage.GetAggregation("IdleAggr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = job.Aggregation{ID: "IdleAggr", Limit: 2, Rate: 1, Paused: true}
+	if *idle != expected {
+		t.Errorf("Expected placeholder aggregation to be replaced by %#v, got %#v", expected, *idle)
+	}
+	replaced, err = storage.ReplacePlaceholderAggregation(&replacement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced {
+		t.Error("Expected non-placeholder aggregation not to have been replaced")
+	}
+
+	testAggr, _ := job.NewAggregation("TestAggr", 8, "")
+	storage.SaveAggregation(testAggr)
+
+	err = storage.SetAggregationPaused(testAggr.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aggr, err := storage.GetAggregation(testAggr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aggr.Paused {
+		t.Error("Expected aggregation to be paused")
+	}
+
+	err = storage.RemoveAggregation(testAggr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, _ := storage.AggregationExists(testAggr)
+	if !exists {
+		t.Error("Expected paused aggregation not to have been deleted")
+	}
+
+	err = storage.SetAggregationPaused(testAggr.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.RemoveAggregation(testAggr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, _ = storage.AggregationExists(testAggr)
+	if exists {
+		t.Error("Expected resumed aggregation to have been deleted")
+	}
+
+	testAggr.Persisted = true
+	storage.SaveAggregation(testAggr)
+
+	err = storage.RemoveAggregation(testAggr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists, _ = storage.AggregationExists(testAggr)
+	if !exists {
+		t.Error("Expected persisted aggregation not to have been deleted")
+	}
+}
+
+func TestActiveAggregations(t *testing.T) {
+	Redis.FlushDB()
+
+	pubsub := Redis.Subscribe(JobsChannel)
+	defer pubsub.Close()
+	ch := pubsub.Channel()
+
+	testAggr, _ := job.NewAggregation(testJob.AggrID, 8, "")
+	storage.SaveAggregation(testAggr)
+	j := testJob
+	err := storage.QueuePendingDownload(&j, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-ch:
+		if msg.Payload != testAggr.ID {
+			t.Errorf("Expected %s to be announced, got %s", testAggr.ID, msg.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected queued jobs to be announced")
+	}
+
+	ids, err := storage.GetActiveAggregations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != testAggr.ID {
+		t.Errorf("Expected active aggregations to be [%s], got %v", testAggr.ID, ids)
+	}
+
+	// The aggregation stays active while it has queued jobs
+	err = storage.RemoveAggregation(testAggr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := storage.IsActiveAggregation(testAggr.ID); !active {
+		t.Error("Expected aggregation with queued jobs to be active")
+	}
+
+	_, err = storage.PopJob(testAggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.RemoveAggregation(testAggr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := storage.IsActiveAggregation(testAggr.ID); active {
+		t.Error("Expected removed aggregation not to be active")
+	}
+
+	// Queues that are missing from the set are indexed
+	Redis.ZAdd(JobsKeyPrefix+"Unindexed", redis.Z{Member: "foo", Score: 1})
+	n, err := storage.IndexActiveAggregations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 aggregation to be indexed, got %d", n)
+	}
+	if active, _ := storage.IsActiveAggregation("Unindexed"); !active {
+		t.Error("Expected indexed aggregation to be active")
+	}
+}
+
+func TestSlots(t *testing.T) {
+	Redis.FlushDB()
+
+	testAggr, _ := job.NewAggregation("TestAggr", 1, "")
+	jobs := []*job.Job{
+		{ID: "TestJob1", AggrID: testAggr.ID},
+		{ID: "TestJob2", AggrID: testAggr.ID},
+		{ID: "TestJob3", AggrID: testAggr.ID},
+	}
+	err := storage.QueuePendingDownloads(jobs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := storage.PopJob(testAggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.PopJob(testAggr)
+	if err != ErrNoSlot {
+		t.Fatalf("Expected ErrNoSlot while the only slot is occupied, got %v", err)
+	}
+
+	// Renewed leases expire later
+	before, _ := Redis.ZScore(SlotsKeyPrefix+testAggr.ID, j.ID).Result()
+	time.Sleep(10 * time.Millisecond)
+	err = storage.RenewDownloads([]*job.Job{&j})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := Redis.ZScore(SlotsKeyPrefix+testAggr.ID, j.ID).Result()
+	if after <= before {
+		t.Errorf("Expected lease to have been extended, was %f and is %f", before, after)
+	}
+
+	err = storage.ReleaseDownload(&j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err = storage.PopJob(testAggr)
+	if err != nil {
+		t.Fatalf("Expected to pop job after releasing the slot, got %v", err)
+	}
+
+	// Released slots are not occupied again by renewals
+	storage.ReleaseDownload(&j)
+	storage.RenewDownloads([]*job.Job{&j})
+	if n, _ := Redis.ZCard(SlotsKeyPrefix + testAggr.ID).Result(); n != 0 {
+		t.Errorf("Expected no occupied slots, got %d", n)
+	}
+
+	// Expired leases are freed
+	Redis.ZAdd(SlotsKeyPrefix+testAggr.ID, redis.Z{Member: "Expired", Score: 1})
+	_, err = storage.PopJob(testAggr)
+	if err != nil {
+		t.Fatalf("Expected expired lease to have been freed, got %v", err)
+	}
+}
+
+func TestThrottledAggregation(t *testing.T) {
+	Redis.FlushDB()
+
+	testAggr, _ := job.NewAggregation("TestAggr", 1, "")
+	err := storage.QueuePendingDownload(&job.Job{ID: "TestJob", AggrID: testAggr.ID}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := storage.ThrottleAggregation(testAggr.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("Expected aggregation to have been throttled")
+	}
+	// Throttles are not shortened
+	ok, err = storage.ThrottleAggregation(testAggr.ID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("Expected aggregation not to have been throttled for less")
+	}
+
+	d, err := storage.AggregationThrottled(testAggr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d < 59*time.Minute {
+		t.Errorf("Expected aggregation to be throttled for an hour, got %s", d)
+	}
+
+	_, err = storage.PopJob(testAggr)
+	if err != ErrThrottled {
+		t.Fatalf("Expected ErrThrottled while the aggregation is throttled, got %v", err)
+	}
+
+	Redis.Del(ThrottleKeyPrefix + testAggr.ID)
+	d, err = storage.AggregationThrottled(testAggr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d != 0 {
+		t.Errorf("Expected aggregation not to be throttled, got %s", d)
+	}
+	_, err = storage.PopJob(testAggr)
+	if err != nil {
+		t.Fatalf("Expected to pop job after the throttle expired, got %v", err)
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	Redis.FlushDB()
+
+	testAggr, _ := job.NewAggregation("TestAggr", 8, "")
+	jobs := []*job.Job{
+		{ID: "Stalled", AggrID: testAggr.ID},
+		{ID: "Completed", AggrID: testAggr.ID},
+		{ID: "Healthy", AggrID: testAggr.ID},
+	}
+	err := storage.QueuePendingDownloads(jobs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	popped := make(map[string]job.Job)
+	for range jobs {
+		j, err := storage.PopJob(testAggr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		popped[j.ID] = j
+	}
+
+	if n, _ := Redis.ZCard(InFlightDownloads).Result(); n != int64(len(jobs)) {
+		t.Fatalf("Expected %d in-flight downloads, got %d", len(jobs), n)
+	}
+
+	completed := popped["Completed"]
+	completed.DownloadState = job.StateSuccess
+	storage.SaveJob(&completed)
+
+	// The deadlines of all jobs but the healthy one expire
+	for _, id := range []string{"Stalled", "Completed"} {
+		Redis.ZAdd(InFlightDownloads, redis.Z{Member: id, Score: 1})
+	}
+
+	n, err := storage.RequeueExpiredDownloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 requeued download, got %d", n)
+	}
+
+	queued, _ := Redis.ZRange(JobsKeyPrefix+testAggr.ID, 0, -1).Result()
+	if len(queued) != 1 || queued[0] != "Stalled" {
+		t.Errorf("Expected only the stalled job to have been requeued, got %v", queued)
+	}
+	inflight, _ := Redis.ZRange(InFlightDownloads, 0, -1).Result()
+	if len(inflight) != 1 || inflight[0] != "Healthy" {
+		t.Errorf("Expected only the healthy job to be in flight, got %v", inflight)
+	}
+	if occupied, _ := Redis.ZScore(SlotsKeyPrefix+testAggr.ID, "Stalled").Result(); occupied != 0 {
+		t.Error("Expected the slot of the requeued job to have been freed")
+	}
+
+	// Callbacks
+	j := popped["Stalled"]
+	err = storage.QueuePendingCallback(&j, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.PopCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := Redis.ZCard(InFlightCallbacks).Result(); n != 1 {
+		t.Fatalf("Expected 1 in-flight callback, got %d", n)
+	}
+
+	err = storage.RenewCallbacks([]string{j.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ = storage.RequeueExpiredCallbacks()
+	if n != 0 {
+		t.Errorf("Expected renewed callback not to have been requeued, got %d", n)
+	}
+
+	Redis.ZAdd(InFlightCallbacks, redis.Z{Member: j.ID, Score: 1})
+	n, _ = storage.RequeueExpiredCallbacks()
+	if n != 1 {
+		t.Errorf("Expected expired callback to have been requeued, got %d", n)
+	}
+	if n, _ := Redis.ZCard(CallbackQueue).Result(); n != 1 {
+		t.Errorf("Expected 1 queued callback, got %d", n)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	Redis.FlushDB()
+
+	testAggr, _ := job.NewAggregation("TestAggr", 8, "")
+	jobs := []*job.Job{
+		{ID: "Backfill", AggrID: testAggr.ID},
+		{ID: "Urgent", AggrID: testAggr.ID, Priority: job.MaxPriority},
+		{ID: "Important", AggrID: testAggr.ID, Priority: 3},
+	}
+	for _, j := range jobs {
+		err := storage.QueuePendingDownload(j, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Retried jobs are not popped before their delay, regardless of
+	// their priority
+	retried := &job.Job{ID: "Retried", AggrID: testAggr.ID, Priority: job.MaxPriority}
+	err := storage.QueuePendingDownload(retried, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"Urgent", "Important", "Backfill"} {
+		j, err := storage.PopJob(testAggr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.ID != expected {
+			t.Errorf("Expected %s to be popped, got %s", expected, j.ID)
+		}
+		if expected == "Urgent" && j.Priority != job.MaxPriority {
+			t.Errorf("Expected priority to be %d, got %d", job.MaxPriority, j.Priority)
+		}
+	}
+
+	_, err = storage.PopJob(testAggr)
+	if err != ErrRetryLater {
+		t.Errorf("Expected ErrRetryLater, got %v", err)
+	}
+}
+
+func TestRunAt(t *testing.T) {
+	Redis.FlushDB()
+
+	testAggr, _ := job.NewAggregation("TestAggr", 8, "")
+	scheduled := &job.Job{ID: "Scheduled", AggrID: testAggr.ID, RunAt: time.Now().Add(time.Hour).Unix(),
+		ExpiresAt: time.Now().Add(2 * time.Hour).Unix()}
+	err := storage.QueuePendingDownload(scheduled, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = storage.PopJob(testAggr)
+	if err != ErrRetryLater {
+		t.Fatalf("Expected ErrRetryLater for a job scheduled in the future, got %v", err)
+	}
+
+	ready := &job.Job{ID: "Ready", AggrID: testAggr.ID, RunAt: time.Now().Add(-time.Hour).Unix()}
+	err = storage.QueuePendingDownload(ready, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := storage.PopJob(testAggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.ID != "Ready" {
+		t.Errorf("Expected Ready to be popped, got %s", j.ID)
+	}
+
+	j, err = storage.GetJob(scheduled.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.RunAt != scheduled.RunAt || j.ExpiresAt != scheduled.ExpiresAt {
+		t.Errorf("Expected %d and %d, got %d and %d", scheduled.RunAt, scheduled.ExpiresAt, j.RunAt, j.ExpiresAt)
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	Redis.FlushDB()
+
+	now := time.Now()
+	due := &job.Schedule{ID: "Due", Interval: 3600, Job: `{"url":"http://foo.bar"}`, NextRunAt: now.Add(-time.Second).Unix()}
+	later := &job.Schedule{ID: "Later", Cron: "0 2 * * *", Job: `{"url":"http://foo.bar"}`, NextRunAt: now.Add(time.Hour).Unix()}
+	for _, sc := range []*job.Schedule{later, due} {
+		err := storage.SaveSchedule(sc)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	schedules, err := storage.GetSchedules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedules) != 2 || *schedules[0] != *due || *schedules[1] != *later {
+		t.Fatalf("Expected schedules in the order of their next run, got %v", schedules)
+	}
+
+	ids, err := storage.ClaimDueSchedules(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != due.ID {
+		t.Fatalf("Expected only %s to be claimed, got %v", due.ID, ids)
+	}
+
+	// Claimed schedules are not claimed again until their lease expires
+	ids, err = storage.ClaimDueSchedules(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("Expected no schedules to be claimed, got %v", ids)
+	}
+	ids, err = storage.ClaimDueSchedules(now.Add(ScheduleLease))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != due.ID {
+		t.Fatalf("Expected %s to be claimed after its lease expired, got %v", due.ID, ids)
+	}
+
+	due.LastJobID = "TestJob"
+	due.LastRunAt = now.Unix()
+	due.NextRunAt = now.Add(time.Hour).Unix()
+	err = storage.RescheduleSchedule(due)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := storage.GetSchedule(due.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *sc != *due {
+		t.Errorf("Expected %v, got %v", due, sc)
+	}
+
+	err = storage.RemoveSchedule(due.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storage.RemoveSchedule(due.ID)
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	_, err = storage.GetSchedule(due.ID)
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Removed schedules are not recreated when rescheduled
+	err = storage.RescheduleSchedule(due)
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	n, _ := Redis.ZCard(Schedules).Result()
+	if n != 1 {
+		t.Errorf("Expected 1 schedule, got %d", n)
+	}
+}
+
+func TestTakeSlots(t *testing.T) {
+	Redis.FlushDB()
+
+	testAggr, _ := job.NewAggregation("TestAggr", 3, "")
+	j := &job.Job{ID: "TestJob", AggrID: testAggr.ID}
+	err := storage.QueuePendingDownload(j, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = storage.PopJob(testAggr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the free slots are occupied
+	members, err := storage.TakeSlots(testAggr, j, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("Expected 2 slots to be occupied, got %v", members)
+	}
+
+	err = storage.RenewSlots(testAggr.ID, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := Redis.ZCard(SlotsKeyPrefix + testAggr.ID).Result()
+	if n != 3 {
+		t.Errorf("Expected 3 occupied slots, got %d", n)
+	}
+
+	err = storage.ReleaseSlots(testAggr.ID, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ = Redis.ZCard(SlotsKeyPrefix + testAggr.ID).Result()
+	if n != 1 {
+		t.Errorf("Expected only the slot of the job to be occupied, got %d", n)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	Redis.FlushDB()
+
+	for i := int64(1); i <= 2; i++ {
+		n, err := storage.AcquireBlob("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != i {
+			t.Fatalf("Expected %d references, got %d", i, n)
+		}
+	}
+
+	for i := int64(1); i >= 0; i-- {
+		n, err := storage.ReleaseBlob("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != i {
+			t.Fatalf("Expected %d remaining references, got %d", i, n)
+		}
+	}
+
+	// The blob cannot be referenced until it is removed
+	_, err := storage.AcquireBlob("foo")
+	if err != ErrBlobDeleted {
+		t.Fatalf("Expected ErrBlobDeleted, got %v", err)
+	}
+
+	err = storage.RemoveBlob("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := storage.AcquireBlob("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 reference, got %d", n)
+	}
+}